@@ -0,0 +1,170 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/iryonetwork/network-poc/openEHR"
+	"github.com/iryonetwork/network-poc/openEHR/ehrdata"
+	"github.com/iryonetwork/network-poc/storage/ehr"
+)
+
+// Attachments, such as ECG recordings and images, are too large to be handled in memory as a whole.
+// They are encrypted in chunks while they are uploaded and decrypted while they are downloaded,
+// the openEHR document only references the uploaded file
+
+// UploadAttachment encrypts attachment read from r with the key of category and streams it to the api.
+// Returns ID of the uploaded file
+func (c *Client) UploadAttachment(owner, category string, r io.Reader) (string, error) {
+	c.log.Debugf("Client::UploadAttachment(%s, %s) called", owner, category)
+
+	id, sealed, err := c.ehr.EncryptReader(owner, category, r, c.state.EncryptionKeys[owner])
+	if err != nil {
+		return "", err
+	}
+	key, err := c.ehr.GetKey(owner, id)
+	if err != nil {
+		return "", err
+	}
+	keySign, err := c.eos.SignHash(key)
+	if err != nil {
+		return "", err
+	}
+
+	body, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(c.writeAttachment(writer, id, key, keySign, sealed))
+	}()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", c.config.IryoAddr, owner), body)
+	if err != nil {
+		body.Close()
+		return "", fmt.Errorf("failed to call UploadAttachment; %v", err)
+	}
+	req.Header.Add("Authorization", c.state.Token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call UploadAttachment; %v", err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 201 {
+		return "", fmt.Errorf("Got code: %d", res.StatusCode)
+	}
+	a := make(map[string]string)
+	if err := json.Unmarshal(b, &a); err != nil {
+		return "", err
+	}
+	if newid := a["fileID"]; newid != id {
+		return "", fmt.Errorf("API stored attachment %s as %s, it does not support client assigned IDs", id, newid)
+	}
+
+	return id, nil
+}
+
+// writeAttachment writes upload form with the sealed attachment. Signature of the file is made
+// while the file is written, so it's sent after it. The api parses the whole form before checking it
+func (c *Client) writeAttachment(writer *multipart.Writer, id string, key []byte, keySign string, sealed io.Reader) error {
+	writer.WriteField("account", c.state.EosAccount)
+	writer.WriteField("key", c.state.GetEosPublicKey())
+	writer.WriteField("dataKey", base64.StdEncoding.EncodeToString(key))
+	writer.WriteField("dataKeySign", keySign)
+
+	part, err := writer.CreateFormFile("data", id)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(part, hash), sealed); err != nil {
+		return err
+	}
+	sign, err := c.state.SignByte(hash.Sum(nil))
+	if err != nil {
+		return err
+	}
+	writer.WriteField("sign", sign)
+
+	return writer.Close()
+}
+
+// DownloadAttachment downloads owner's attachment and writes it decrypted to w. Data is written
+// as soon as each chunk is authenticated, the attachment is only complete if no error is returned
+func (c *Client) DownloadAttachment(owner, id string, w io.Writer) error {
+	c.log.Debugf("Client::DownloadAttachment(%s, %s) called", owner, id)
+
+	key, err := c.ehr.GetKey(owner, id)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		if err := c.downloadDataKey(owner, id); err != nil {
+			return err
+		}
+	}
+	decrypted, err := c.ehr.DecryptWriter(owner, id, w, c.state.EncryptionKeys[owner])
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/%s", c.config.IryoAddr, owner, id), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", c.state.Token)
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Code: %d", res.StatusCode)
+	}
+
+	if _, err := io.Copy(decrypted, res.Body); err != nil {
+		return err
+	}
+	return decrypted.Close()
+}
+
+// downloadDataKey saves wrapped data key of the file listed by the api
+func (c *Client) downloadDataKey(owner, id string) error {
+	list, err := c.Ls(owner)
+	if err != nil {
+		return err
+	}
+	for _, f := range list {
+		if f["fileID"] != id || f["dataKey"] == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(f["dataKey"])
+		if err != nil {
+			return fmt.Errorf("Invalid data key for file %s; %v", id, err)
+		}
+		return c.ehr.SaveKey(owner, id, key)
+	}
+	return fmt.Errorf("Data key for %s_%s does not exist", owner, id)
+}
+
+// SaveAndUploadECG uploads the recording read from attachment and the ECG document referencing it
+func (c *Client) SaveAndUploadECG(owner string, ecg *openEHR.ECG, name, mediaType string, attachment io.Reader) error {
+	id, err := c.UploadAttachment(owner, ehr.CategoryECG, attachment)
+	if err != nil {
+		return err
+	}
+	ecg.AttachmentName = name
+	ecg.AttachmentType = mediaType
+	ecg.AttachmentURI = ehrdata.AttachmentURI(owner, id)
+	ecg.AttachmentData = nil
+
+	return c.SaveAndUploadEhrData(owner, ecg)
+}
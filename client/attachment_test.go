@@ -0,0 +1,110 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/storage/ehr"
+	"github.com/iryonetwork/network-poc/storage/ledger"
+)
+
+// storingAPI keeps uploaded files in memory and serves them back
+func storingAPI(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+	keys := make(map[string]string)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.Method == "POST":
+			if err := r.ParseMultipartForm(0); err != nil {
+				t.Errorf("ParseMultipartForm failed: %v", err)
+				w.WriteHeader(400)
+				return
+			}
+			if r.FormValue("sign") == "" {
+				t.Error("Expected upload to be signed")
+			}
+			file, header, err := r.FormFile("data")
+			if err != nil {
+				t.Errorf("FormFile failed: %v", err)
+				w.WriteHeader(400)
+				return
+			}
+			defer file.Close()
+			files[header.Filename], _ = ioutil.ReadAll(file)
+			keys[header.Filename] = r.FormValue("dataKey")
+			w.WriteHeader(201)
+			json.NewEncoder(w).Encode(map[string]string{"fileID": header.Filename})
+		case len(parts) == 1:
+			list := []map[string]string{}
+			for id, key := range keys {
+				list = append(list, map[string]string{"fileID": id, "dataKey": key})
+			}
+			json.NewEncoder(w).Encode(map[string][]map[string]string{"files": list})
+		default:
+			data, ok := files[parts[1]]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+}
+
+func TestAttachment(t *testing.T) {
+	api := storingAPI(t)
+	defer api.Close()
+
+	cfg := &config.Config{EosAccount: "patient.iryo", IryoAddr: api.URL}
+	log := logger.New(cfg)
+	patient := newTestState(t, cfg)
+	key, err := patient.RecordKey(0)
+	if err != nil {
+		t.Fatalf("RecordKey failed: %v", err)
+	}
+	patient.EncryptionKeys[patient.EosAccount] = key
+	l := ledger.NewMemory(patient, "", log)
+
+	storage := ehr.New()
+	c := New(cfg, patient, l, storage, NewMessageHandler(patient, storage, l, log), log)
+
+	// spans several chunks and ends with a partial one
+	attachment := make([]byte, 3*64*1024+100)
+	rand.Read(attachment)
+	id, err := c.UploadAttachment(patient.EosAccount, ehr.CategoryECG, bytes.NewReader(attachment))
+	if err != nil {
+		t.Fatalf("UploadAttachment failed: %v", err)
+	}
+
+	// doctor's storage does not have the data key yet, it's taken from the listing
+	doctorCfg := &config.Config{EosAccount: "doctor1.iryo", IryoAddr: api.URL}
+	doctor := newTestState(t, doctorCfg)
+	doctor.EncryptionKeys[patient.EosAccount] = key
+	doctorStorage := ehr.New()
+	d := New(doctorCfg, doctor, l, doctorStorage, NewMessageHandler(doctor, doctorStorage, l, log), log)
+
+	var got bytes.Buffer
+	if err := d.DownloadAttachment(patient.EosAccount, id, &got); err != nil {
+		t.Fatalf("DownloadAttachment failed: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), attachment) {
+		t.Errorf("Expected downloaded attachment to match, got %d bytes instead of %d", got.Len(), len(attachment))
+	}
+
+	if err := d.DownloadAttachment(patient.EosAccount, "missing", ioutil.Discard); err == nil {
+		t.Error("Expected download of missing attachment to fail")
+	}
+}
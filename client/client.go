@@ -3,6 +3,7 @@ package client
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,30 +13,36 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 
 	"github.com/iryonetwork/network-poc/config"
 	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/openEHR/ehrdata"
 	"github.com/iryonetwork/network-poc/requests"
 	"github.com/iryonetwork/network-poc/state"
 	"github.com/iryonetwork/network-poc/storage/ehr"
-	"github.com/iryonetwork/network-poc/storage/eos"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 )
 
 type Client struct {
 	config         *config.Config
 	state          *state.State
-	eos            *eos.Storage
+	eos            ledger.Ledger
 	ehr            *ehr.Storage
 	messageHandler MessageHandler
 	log            *logger.Log
 	ws             *Ws
 	request        *requests.Requests
+
+	// frontendConn are websocket connections of the web ui, they outlive reconnects to the api
+	frontendMu   sync.Mutex
+	frontendConn []*websocket.Conn
 }
 
-func New(config *config.Config, state *state.State, eos *eos.Storage, ehr *ehr.Storage, messageHandler MessageHandler, log *logger.Log) *Client {
+func New(config *config.Config, state *state.State, eos ledger.Ledger, ehr *ehr.Storage, messageHandler MessageHandler, log *logger.Log) *Client {
 	c := &Client{
 		config:         config,
 		state:          state,
@@ -56,7 +63,7 @@ func (c *Client) ConnectWs() error {
 		return err
 	}
 	c.ws = wsStorage
-	c.request = requests.NewRequests(c.log, c.config, c.state, wsStorage.Conn(), c.eos)
+	c.request = requests.NewRequests(c.log, c.config, c.state, wsStorage, c.eos)
 	c.messageHandler.SetRequests(c.request)
 	return nil
 }
@@ -151,12 +158,14 @@ func (c *Client) CreateAccount(key string) (string, error) {
 
 	// Check for errors
 	if _, ok := a["error"]; ok {
-		return "", fmt.Errorf(a["error"])
+		return "", fmt.Errorf("%s", a["error"])
 	}
 
 	return a["account"], nil
 }
 
+// Ls lists owner's files. Each file is described with fileID, createdAt, dataKey and author,
+// which is the account that uploaded the file first and the only one besides the owner that can replace it
 func (c *Client) Ls(owner string) ([]map[string]string, error) {
 
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", c.config.IryoAddr, owner), nil)
@@ -209,13 +218,22 @@ func (c *Client) Download(owner, fileID string) error {
 	}
 
 	// save file to local storage
-	c.ehr.Saveid(owner, fileID, []byte(a))
-
-	return nil
+	return c.ehr.Saveid(owner, fileID, []byte(a))
 }
 
-// Update downloads files for user, if they do not exist. Remove them if access was removed
+// Update downloads files for user, if they do not exist. Remove them if access was removed.
+// Our documents in formats not bound to their owner and ID are upgraded afterwards
 func (c *Client) Update(owner string) error {
+	if err := c.update(owner); err != nil {
+		return err
+	}
+	if owner != c.state.EosAccount {
+		return nil
+	}
+	return c.migrate()
+}
+
+func (c *Client) update(owner string) error {
 	// First check if access is granted
 	if owner != c.state.EosAccount {
 		granted, err := c.eos.AccessGranted(owner, c.state.EosAccount)
@@ -223,7 +241,9 @@ func (c *Client) Update(owner string) error {
 			return err
 		}
 		if !granted {
-			c.ehr.RemoveUser(owner)
+			if err := c.ehr.RemoveUser(owner); err != nil {
+				return err
+			}
 			return fmt.Errorf("You don't have permission granted to access this data")
 		}
 	}
@@ -234,12 +254,33 @@ func (c *Client) Update(owner string) error {
 	}
 	// Download missing
 	for _, f := range list {
-		if !c.ehr.Exists(owner, f["fileID"]) {
+		exists, err := c.ehr.Exists(owner, f["fileID"])
+		if err != nil {
+			return err
+		}
+		if !exists {
 			err = c.Download(owner, f["fileID"])
 			if err != nil {
 				return err
 			}
 		}
+
+		// Data keys are replaced when the owner changes the key
+		if f["dataKey"] != "" {
+			key, err := base64.StdEncoding.DecodeString(f["dataKey"])
+			if err != nil {
+				return fmt.Errorf("Invalid data key for file %s; %v", f["fileID"], err)
+			}
+			current, err := c.ehr.GetKey(owner, f["fileID"])
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(key, current) {
+				if err := c.ehr.SaveKey(owner, f["fileID"], key); err != nil {
+					return err
+				}
+			}
+		}
 	}
 	return nil
 }
@@ -247,7 +288,10 @@ func (c *Client) Update(owner string) error {
 func (c *Client) Upload(owner, id string, reupload bool) error {
 	c.log.Debugf("Client::upload(%s) called", owner)
 	// get data from local storage
-	data := c.ehr.Getid(owner, id)
+	data, err := c.ehr.Getid(owner, id)
+	if err != nil {
+		return err
+	}
 	if data == nil {
 		return fmt.Errorf("Document for %s does not exist", owner)
 	}
@@ -263,6 +307,21 @@ func (c *Client) Upload(owner, id string, reupload bool) error {
 	writer.WriteField("account", c.state.EosAccount)
 	writer.WriteField("key", c.state.GetEosPublicKey())
 	writer.WriteField("sign", sign)
+
+	// Add the wrapped data key, documents in legacy format don't have one
+	key, err := c.ehr.GetKey(owner, id)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		keySign, err := c.eos.SignHash(key)
+		if err != nil {
+			return err
+		}
+		writer.WriteField("dataKey", base64.StdEncoding.EncodeToString(key))
+		writer.WriteField("dataKeySign", keySign)
+	}
+
 	part, err := writer.CreateFormFile("data", id)
 	if err != nil {
 		return err
@@ -294,7 +353,7 @@ func (c *Client) Upload(owner, id string, reupload bool) error {
 	}
 	b, _ := ioutil.ReadAll(res.Body)
 	if string(b) == "unknown token" {
-		return fmt.Errorf(string(b))
+		return fmt.Errorf("%s", b)
 	}
 	if res.StatusCode != 201 {
 		return fmt.Errorf("Got code: %d", res.StatusCode)
@@ -305,46 +364,71 @@ func (c *Client) Upload(owner, id string, reupload bool) error {
 		return err
 	}
 
-	if !reupload {
-		newid := a["fileID"]
-		c.ehr.Rename(owner, id, newid)
+	// Document is bound to the proposed ID, older API versions that assign their own are not supported
+	if newid := a["fileID"]; !reupload && newid != id {
+		return fmt.Errorf("API stored document %s as %s, it does not support client assigned IDs", id, newid)
 	}
 
 	return nil
 }
 
-func (c *Client) Reencrypt(key []byte) error {
-	c.log.Debugf("Client:: Reencrypting")
-	err := c.Update(c.state.EosAccount)
+// UploadKey replaces wrapped data key of already uploaded document
+func (c *Client) UploadKey(owner, id string) error {
+	c.log.Debugf("Client::UploadKey(%s, %s) called", owner, id)
+	key, err := c.ehr.GetKey(owner, id)
 	if err != nil {
 		return err
 	}
-	err = c.ehr.Reencrypt(c.state.EosAccount, c.state.EncryptionKeys[c.state.EosAccount], key)
+	if key == nil {
+		return fmt.Errorf("Data key for document %s does not exist", id)
+	}
+	sign, err := c.eos.SignHash(key)
 	if err != nil {
 		return err
 	}
 
-	// Save the new key
-	c.state.EncryptionKeys[c.state.EosAccount] = key
-
-	// Send notification about reencrypting to api
-	err = c.request.ReencryptRequest()
+	data := url.Values{
+		"key":     {c.state.GetEosPublicKey()},
+		"sign":    {sign},
+		"dataKey": {base64.StdEncoding.EncodeToString(key)},
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/%s/%s/key", c.config.IryoAddr, owner, id), strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
-
-	// Take some time, to make sure that api folder no loger contains files
-	time.Sleep(2 * time.Second)
-
-	// Upload new files
-	for id := range c.ehr.Get(c.state.EosAccount) {
-		c.log.Debugf("Uploading %s", id)
-		c.Upload(c.state.EosAccount, id, true)
+	req.Header.Add("Authorization", c.state.Token)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call UploadKey; %v", err)
+	}
+	if res.StatusCode != 201 {
+		return fmt.Errorf("Got code: %d", res.StatusCode)
 	}
 	return nil
 }
-func (c *Client) GrantAccess(to string) error {
-	c.log.Debugf("Client::grantAccess(%s) called", to)
+
+// GrantAccess grants `to` access with `permissions` to documents of listed categories, or all categories
+// if none are listed. Access expires after `duration`, it never expires if duration is zero.
+// Granting access again changes permissions and the expiry
+func (c *Client) GrantAccess(to string, permissions ledger.Permission, duration time.Duration, categories ...string) error {
+	c.log.Debugf("Client::grantAccess(%s, %s, %v, %v) called", to, permissions, duration, categories)
+
+	// Remember which categories to share when the key is sent
+	if c.state.Connections.Categories == nil {
+		c.state.Connections.Categories = make(map[string][]string)
+	}
+	if len(categories) > 0 {
+		c.state.Connections.Categories[to] = categories
+	} else {
+		delete(c.state.Connections.Categories, to)
+	}
+
+	var expires time.Time
+	if duration > 0 {
+		expires = time.Now().Add(duration)
+	}
 
 	// Make sure that reciever exists
 	if !c.eos.CheckAccountExists(to) {
@@ -358,6 +442,11 @@ func (c *Client) GrantAccess(to string) error {
 		if err != nil {
 			return err
 		}
+		// change permissions and expiry
+		if err := c.eos.GrantAccess(to, permissions, expires); err != nil {
+			return fmt.Errorf("failed to call grantAccess; %v", err)
+		}
+		c.setExpiry(to, expires)
 		// make sure doctor is on list of connected
 		conn := false
 		for _, v := range c.state.Connections.GrantedTo {
@@ -373,14 +462,15 @@ func (c *Client) GrantAccess(to string) error {
 
 	// write access granted to blockchain
 	c.log.Debugf("Granting access to %s", to)
-	err := c.eos.GrantAccess(to)
+	err := c.eos.GrantAccess(to, permissions, expires)
 	if err != nil {
 		return fmt.Errorf("failed to call grantAccess; %v", err)
 	}
+	c.setExpiry(to, expires)
 
-	// if request for key was already made send the key
+	// if request for key was already made send the key to users that can read the documents
 	// else notify the doctor that request was granted
-	if _, ok := c.state.Connections.Requested[to]; ok {
+	if _, ok := c.state.Connections.Requested[to]; ok && permissions.CanRead() {
 		// send key for storage encryption
 		err = c.request.SendKey(to)
 		if err != nil {
@@ -410,6 +500,18 @@ func (c *Client) GrantAccess(to string) error {
 	return nil
 }
 
+// setExpiry remembers when access of `to` expires, zero time if it never does
+func (c *Client) setExpiry(to string, expires time.Time) {
+	if c.state.Connections.Expires == nil {
+		c.state.Connections.Expires = make(map[string]time.Time)
+	}
+	if expires.IsZero() {
+		delete(c.state.Connections.Expires, to)
+	} else {
+		c.state.Connections.Expires[to] = expires
+	}
+}
+
 func (c *Client) RevokeAccess(to string) error {
 	c.log.Debugf("Client::revokeAccess(%s) called", to)
 
@@ -425,6 +527,8 @@ func (c *Client) RevokeAccess(to string) error {
 		return err
 	}
 	// remove doctor from our connections
+	delete(c.state.Connections.Categories, to)
+	delete(c.state.Connections.Expires, to)
 	found := false
 	for i, v := range c.state.Connections.GrantedTo {
 		if v == to {
@@ -436,6 +540,11 @@ func (c *Client) RevokeAccess(to string) error {
 	if !found {
 		return fmt.Errorf("%s is not in connections", to)
 	}
+
+	// Revoked user still holds our key, documents are moved to a new one
+	if c.config.RotateOnRevoke {
+		go c.rotateAfterRevoke(to)
+	}
 	return nil
 }
 
@@ -491,10 +600,84 @@ func (c *Client) CheckGrantedStatus(eosAccountName string) (accessGranted bool,
 	return false, false, nil
 }
 
+// EvictRevoked removes locally stored documents of users that revoked our access
+// while we were offline
+func (c *Client) EvictRevoked() error {
+	users, err := c.ehr.Users()
+	if err != nil {
+		return err
+	}
+	for _, owner := range users {
+		if owner == c.state.EosAccount {
+			continue
+		}
+		granted, err := c.eos.AccessGranted(owner, c.state.EosAccount)
+		if err != nil {
+			return err
+		}
+		if !granted {
+			c.log.Debugf("Access to %s's documents was revoked, removing them", owner)
+			if err := c.ehr.RemoveUser(owner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RelinquishAccess gives up access `patient` granted us. Patient's documents and key are
+// removed and the patient is notified
+func (c *Client) RelinquishAccess(patient string) error {
+	c.log.Debugf("Client::relinquishAccess(%s) called", patient)
+
+	if err := c.eos.RelinquishAccess(patient); err != nil {
+		return err
+	}
+	c.RemoveConnection(patient)
+	c.state.Connections.WithoutKey = remove(c.state.Connections.WithoutKey, patient)
+	c.state.Connections.Awaiting = remove(c.state.Connections.Awaiting, patient)
+
+	return c.request.NotifyRelinquished(patient)
+}
+
+// RestorePatients rebuilds list of users who granted us access from the blockchain, so it
+// survives reinstall, and requests keys we don't have yet. Keys are only requested from users
+// missing from the list, others were asked before or can be asked from the list
+func (c *Client) RestorePatients() error {
+	patients, err := c.eos.ListGrantedBy(c.state.EosAccount)
+	if err != nil {
+		return err
+	}
+	for _, patient := range patients {
+		if contains(c.state.Connections.WithKey, patient) || contains(c.state.Connections.Awaiting, patient) ||
+			contains(c.state.Connections.WithoutKey, patient) {
+			continue
+		}
+		c.log.Debugf("Restoring connection to %s", patient)
+		c.state.Connections.WithoutKey = append(c.state.Connections.WithoutKey, patient)
+
+		// the key is only shared with users that can read the documents
+		permissions, err := c.eos.Permissions(patient, c.state.EosAccount)
+		if err != nil {
+			c.log.Printf("Failed to check permissions granted by %s: %v", patient, err)
+			continue
+		}
+		if !permissions.CanRead() {
+			continue
+		}
+		if err := c.request.RequestsKey(patient, ""); err != nil {
+			c.log.Printf("Failed to request key from %s: %v", patient, err)
+		}
+	}
+	return nil
+}
+
 func (c *Client) RemoveConnection(eosAccountName string) {
 	c.log.Debugf("Removing connection: %s", eosAccountName)
 
-	c.ehr.RemoveUser(eosAccountName)
+	if err := c.ehr.RemoveUser(eosAccountName); err != nil {
+		c.log.Printf("Error removing %s's documents: %v", eosAccountName, err)
+	}
 	delete(c.state.EncryptionKeys, eosAccountName)
 
 	for i, v := range c.state.Connections.WithKey {
@@ -509,6 +692,30 @@ func (c *Client) RequestAccess(to, customData string) error {
 	return err
 }
 
+// DenyAccess refuses key request made by `to`. Reason is optional.
+func (c *Client) DenyAccess(to, reason string) error {
+	c.log.Debugf("Client::DenyAccess(%s) called", to)
+
+	if _, ok := c.state.Connections.Requested[to]; !ok {
+		return fmt.Errorf("%s has not requested the key", to)
+	}
+
+	err := c.request.DenyKey(to, reason)
+	if err != nil {
+		return fmt.Errorf("Failed to deny key request; %v", err)
+	}
+
+	delete(c.state.Connections.Requested, to)
+	return nil
+}
+
+// CancelAccessRequest withdraws key request made to `to`. Reason is optional.
+func (c *Client) CancelAccessRequest(to, reason string) error {
+	c.log.Debugf("Client::CancelAccessRequest(%s) called", to)
+
+	return c.request.CancelKeyRequest(to, reason)
+}
+
 func (c *Client) NewRequestKeyQr(customData string) string {
 	qrKey := fmt.Sprintf("%s\n%s", c.state.EosAccount, c.state.PersonalData.Name)
 	if customData != "" {
@@ -528,7 +735,7 @@ func (c *Client) SaveAndUploadEhrData(user string, data interface{}) error {
 }
 
 func (c *Client) SaveAndUploadData(user string, data []byte) error {
-	id, err := c.ehr.Encrypt(user, data, c.state.EncryptionKeys[user])
+	id, err := c.ehr.Encrypt(user, ehrdata.Category(data), data, c.state.EncryptionKeys[user])
 	if err != nil {
 		return err
 	}
@@ -537,20 +744,38 @@ func (c *Client) SaveAndUploadData(user string, data []byte) error {
 }
 
 func (c *Client) AddFrontendWS(conn *websocket.Conn) {
-	c.ws.frontendConn = append(c.ws.frontendConn, conn)
+	c.frontendMu.Lock()
+	defer c.frontendMu.Unlock()
+
+	c.frontendConn = append(c.frontendConn, conn)
 }
 
 func (c *Client) RemoveFrontendWS(conn *websocket.Conn) error {
+	c.frontendMu.Lock()
 	deleted := false
-	for i, v := range c.ws.frontendConn {
+	for i, v := range c.frontendConn {
 		if v == conn {
-			c.ws.frontendConn = append(c.ws.frontendConn[:i], c.ws.frontendConn[i+1:]...)
+			c.frontendConn = append(c.frontendConn[:i], c.frontendConn[i+1:]...)
 			deleted = true
 		}
 	}
+	c.frontendMu.Unlock()
 	if !deleted {
 		return fmt.Errorf("Ws connection not found")
 	}
 	c.log.Debugf("Closing client's ws connection")
 	return conn.Close()
 }
+
+// sendFrontend writes message to all frontend connections. Writes are serialized,
+// as it's called from ws and background goroutines
+func (c *Client) sendFrontend(data []byte) {
+	c.frontendMu.Lock()
+	defer c.frontendMu.Unlock()
+
+	for _, conn := range c.frontendConn {
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			c.log.Debugf("Error writing message: %v", err)
+		}
+	}
+}
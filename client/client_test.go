@@ -0,0 +1,104 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/requests"
+	"github.com/iryonetwork/network-poc/state"
+	"github.com/iryonetwork/network-poc/storage/ehr"
+	"github.com/iryonetwork/network-poc/storage/ledger"
+)
+
+func TestRestorePatients(t *testing.T) {
+	sent := make(chan string, 10)
+	api := fakeAPI(t, sent)
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ledger.json")
+
+	cfg := &config.Config{EosAccount: "doctor1.iryo", IryoAddr: api.URL}
+	log := logger.New(cfg)
+	st, err := state.New(cfg, log)
+	if err != nil {
+		t.Fatalf("state.New failed: %v", err)
+	}
+	if err := st.NewMnemonicKey(); err != nil {
+		t.Fatalf("NewMnemonicKey failed: %v", err)
+	}
+	l := ledger.NewMemory(st, path, log)
+	if err := l.CreateAccount(st.EosAccount, st.GetEosPublicKey()); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+
+	// known.iryo was restored before, emergency.iryo can't read the documents
+	grants := map[string]ledger.Permission{
+		"known.iryo":     ledger.PermissionDefault,
+		"new.iryo":       ledger.PermissionDefault,
+		"emergency.iryo": ledger.PermissionWrite,
+	}
+	for patient, permissions := range grants {
+		ps, err := state.New(&config.Config{EosAccount: patient}, log)
+		if err != nil {
+			t.Fatalf("state.New failed: %v", err)
+		}
+		pl := ledger.NewMemory(ps, path, log)
+		if err := pl.CreateAccount(patient, st.GetEosPublicKey()); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+		if err := pl.GrantAccess(st.EosAccount, permissions, time.Time{}); err != nil {
+			t.Fatalf("GrantAccess failed: %v", err)
+		}
+	}
+	st.Connections.WithoutKey = []string{"known.iryo"}
+
+	storage := ehr.New()
+	c := New(cfg, st, l, storage, NewMessageHandler(st, storage, l, log), log)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(api.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	c.request = requests.NewRequests(log, cfg, st, conn, l)
+
+	for i := 0; i < 2; i++ {
+		if err := c.RestorePatients(); err != nil {
+			t.Fatalf("RestorePatients failed: %v", err)
+		}
+	}
+
+	select {
+	case got := <-sent:
+		if got != "RequestKey" {
+			t.Errorf("Expected RequestKey to be sent, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected key to be requested from new.iryo")
+	}
+	select {
+	case got := <-sent:
+		t.Errorf("Expected key to be requested once, got %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if !contains(st.Connections.Awaiting, "new.iryo") {
+		t.Errorf("Expected to wait for key of new.iryo, got %v", st.Connections.Awaiting)
+	}
+	for _, patient := range []string{"known.iryo", "emergency.iryo"} {
+		if !contains(st.Connections.WithoutKey, patient) {
+			t.Errorf("Expected %s to be listed without key, got %v", patient, st.Connections.WithoutKey)
+		}
+	}
+}
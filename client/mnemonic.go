@@ -0,0 +1,70 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/iryonetwork/network-poc/openEHR"
+	"github.com/iryonetwork/network-poc/state"
+)
+
+// RestoreFromSeed restores our identity after keys were derived from mnemonic on a new device.
+// Record key in use is found by trying derived keys on our documents, personal data is read
+// from them and accounts we granted access to are read from the blockchain
+func (c *Client) RestoreFromSeed() error {
+	c.log.Debugf("Client::RestoreFromSeed() called")
+
+	owner := c.state.EosAccount
+	if err := c.Update(owner); err != nil {
+		return err
+	}
+
+	generation, documents, err := c.findRecordKey(owner)
+	if err != nil {
+		return err
+	}
+	key, err := c.state.RecordKey(generation)
+	if err != nil {
+		return err
+	}
+	c.state.EncryptionKeys[owner] = key
+	c.state.Seed.Generation = generation
+
+	for _, document := range documents {
+		data := &openEHR.PersonalData{}
+		if err := json.Unmarshal(document, data); err == nil && data.FirstName != "" {
+			c.state.PersonalData = data
+		}
+	}
+
+	granted, err := c.eos.ListConnected(owner)
+	if err != nil {
+		return err
+	}
+	c.state.Connections.GrantedTo = granted
+
+	c.log.Printf("Client:: Restored identity from mnemonic, key generation %d", generation)
+	return c.state.Save()
+}
+
+// findRecordKey returns generation of derived key that opens our documents with the documents
+func (c *Client) findRecordKey(owner string) (int, map[string][]byte, error) {
+	ids, err := c.ehr.ListIds(owner)
+	if err != nil || len(ids) == 0 {
+		return 0, nil, err
+	}
+	for generation := 0; generation <= state.MaxKeyGeneration; generation++ {
+		key, err := c.state.RecordKey(generation)
+		if err != nil {
+			return 0, nil, err
+		}
+		documents, err := c.ehr.DecryptAll(owner, key)
+		if len(documents) > 0 {
+			if err != nil {
+				c.log.Printf("Client:: %v", err)
+			}
+			return generation, documents, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("No key derived from mnemonic opens our documents")
+}
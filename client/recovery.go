@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/iryonetwork/network-poc/requests"
+	"github.com/iryonetwork/network-poc/shamir"
+	"github.com/iryonetwork/network-poc/state"
+)
+
+// SetupRecovery splits our master key into shares, one for each trustee. `threshold` shares
+// are needed to recover the key. Trustees are invited to hold a share and the share is sent
+// once they accept, sealed with their X25519 key. Shares are bound to the recovery key derived
+// from `passphrase`, trustees only return them to device that knows it. Shares of previous setup are replaced
+func (c *Client) SetupRecovery(trustees []string, threshold int, passphrase string) error {
+	c.log.Debugf("Client::SetupRecovery(%v, %d) called", trustees, threshold)
+
+	recoveryKey, err := state.RecoveryKey(c.state.EosAccount, passphrase)
+	if err != nil {
+		return err
+	}
+	return c.splitKey(trustees, threshold, recoveryKey.PublicKey().String())
+}
+
+func (c *Client) splitKey(trustees []string, threshold int, recoveryKey string) error {
+	key, ok := c.state.EncryptionKeys[c.state.EosAccount]
+	if !ok {
+		return fmt.Errorf("No key to split")
+	}
+	for i, trustee := range trustees {
+		if trustee == c.state.EosAccount || contains(trustees[:i], trustee) {
+			return fmt.Errorf("Trustees must be other accounts, each listed once")
+		}
+		if !c.eos.CheckAccountExists(trustee) {
+			return fmt.Errorf("Account %s does not exist", trustee)
+		}
+	}
+
+	shares, err := shamir.Split(key, len(trustees), threshold)
+	if err != nil {
+		return err
+	}
+
+	keyHash := sha256.Sum256(key)
+	r := &c.state.Recovery
+	r.ID = ksuid.New().String()
+	r.Trustees = trustees
+	r.Threshold = threshold
+	r.KeyHash = keyHash[:]
+	r.RecoveryKey = recoveryKey
+	r.Pending = make(map[string][]byte)
+	for i, trustee := range trustees {
+		r.Pending[trustee] = shares[i]
+	}
+	if err := c.state.Save(); err != nil {
+		return err
+	}
+
+	for _, trustee := range trustees {
+		if err := c.request.RecoveryInvite(trustee, r.ID); err != nil {
+			return fmt.Errorf("Failed to invite %s; %v", trustee, err)
+		}
+	}
+	return nil
+}
+
+// refreshRecovery splits the key anew after it was rotated, old shares can't recover it anymore
+func (c *Client) refreshRecovery() {
+	r := c.state.Recovery
+	if len(r.Trustees) == 0 || r.RecoveryKey == "" {
+		return
+	}
+	if err := c.splitKey(r.Trustees, r.Threshold, r.RecoveryKey); err != nil {
+		c.log.Printf("Failed to refresh recovery shares: %v", err)
+	}
+}
+
+// RequestRecovery asks trustees to return shares of the master key of account this device
+// is recovering, see state.StartRecovery. Key is recovered as soon as enough shares are returned
+func (c *Client) RequestRecovery(trustees []string) error {
+	c.log.Debugf("Client::RequestRecovery(%v) called", trustees)
+
+	r := &c.state.Recovery
+	if r.Account == "" {
+		return fmt.Errorf("Device is not recovering an account")
+	}
+	r.Asked = trustees
+	r.Collected = make(map[string]state.Share)
+	if err := c.state.Save(); err != nil {
+		return err
+	}
+
+	for _, trustee := range trustees {
+		if err := c.request.RecoveryRequest(trustee, r.Account); err != nil {
+			return fmt.Errorf("Failed to ask %s for the share; %v", trustee, err)
+		}
+	}
+	return nil
+}
+
+// ReturnShare sends share entrusted to us by `owner` to owner's device that requested it with
+// the share's recovery key. It should only be called after owner's identity was confirmed
+func (c *Client) ReturnShare(owner string) error {
+	c.log.Debugf("Client::ReturnShare(%s) called", owner)
+
+	r := &c.state.Recovery
+	key, ok := r.Requested[owner]
+	if !ok {
+		return fmt.Errorf("%s has not requested the share", owner)
+	}
+	share, ok := r.Shares[owner]
+	if !ok {
+		return fmt.Errorf("We hold no share of %s's key", owner)
+	}
+
+	if err := c.request.RecoveryShare(share.RecoveryKey, key, share); err != nil {
+		return fmt.Errorf("Failed to return the share; %v", err)
+	}
+
+	delete(r.Requested, owner)
+	return c.state.Save()
+}
+
+// AcceptRecoveryInvite agrees to hold share of `owner`'s key, the share is sent after that
+func (c *Client) AcceptRecoveryInvite(owner string) error {
+	c.log.Debugf("Client::AcceptRecoveryInvite(%s) called", owner)
+
+	r := &c.state.Recovery
+	id, ok := r.Invited[owner]
+	if !ok {
+		return fmt.Errorf("%s has not invited us to hold their share", owner)
+	}
+	if err := c.request.RecoveryAccept(owner, id); err != nil {
+		return fmt.Errorf("Failed to accept the invite; %v", err)
+	}
+
+	r.Accepted[owner] = id
+	delete(r.Invited, owner)
+	return c.state.Save()
+}
+
+// DeclineRecoveryInvite refuses to hold share of `owner`'s key
+func (c *Client) DeclineRecoveryInvite(owner string) error {
+	c.log.Debugf("Client::DeclineRecoveryInvite(%s) called", owner)
+
+	delete(c.state.Recovery.Invited, owner)
+	return c.state.Save()
+}
+
+// DeclineRecovery refuses to return the share to `owner`
+func (c *Client) DeclineRecovery(owner string) error {
+	c.log.Debugf("Client::DeclineRecovery(%s) called", owner)
+
+	delete(c.state.Recovery.Requested, owner)
+	return c.state.Save()
+}
+
+// recoverKey combines shares of one setup once there are enough of them. Only shares signed by
+// the account are collected, so threshold and hash of the key they carry can be trusted
+func (c *Client) recoverKey() error {
+	r := &c.state.Recovery
+
+	// trustees might hold shares of different setups if some did not get the new share
+	bySetup := make(map[string][]shamir.Share)
+	var setup state.Share
+	for _, share := range r.Collected {
+		bySetup[share.ID] = append(bySetup[share.ID], share.Share)
+		if len(bySetup[share.ID]) >= share.Threshold {
+			setup = share
+		}
+	}
+	if setup.ID == "" {
+		return nil
+	}
+
+	key, err := shamir.Combine(bySetup[setup.ID])
+	if err != nil {
+		return err
+	}
+
+	// Shares of the setup are signed, but a trustee might have returned share of another trustee
+	if keyHash := sha256.Sum256(key); !bytes.Equal(keyHash[:], setup.KeyHash) {
+		return fmt.Errorf("Recovered key does not match the key that was split")
+	}
+
+	owner := r.Account
+	c.log.Printf("Client:: Recovered the key of %s from %d shares", owner, len(bySetup[setup.ID]))
+	c.state.EncryptionKeys[owner] = key
+	r.ID = setup.ID
+	r.Trustees = r.Asked
+	r.Threshold = setup.Threshold
+	r.KeyHash = setup.KeyHash
+	r.RecoveryKey = setup.RecoveryKey
+	r.Asked = nil
+	r.Collected = make(map[string]state.Share)
+	return c.state.Save()
+}
+
+// verifyShare checks that share returned to us was signed with EOS key of the account we are
+// recovering and bound to our recovery key
+func (c *Client) verifyShare(share state.Share) error {
+	if share.RecoveryKey != c.state.GetEosPublicKey() {
+		return fmt.Errorf("Share is not bound to our recovery key")
+	}
+	key, err := requestGetKeyFromSignature(share.Signature, requests.ShareData(share))
+	if err != nil {
+		return err
+	}
+	ok, err := c.eos.CheckAccountKey(c.state.Recovery.Account, key.String())
+	if err != nil {
+		return fmt.Errorf("Failed to check keys of %s; %v", c.state.Recovery.Account, err)
+	}
+	if !ok {
+		return fmt.Errorf("Share was not signed by %s", c.state.Recovery.Account)
+	}
+	return nil
+}
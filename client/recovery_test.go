@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/requests"
+	"github.com/iryonetwork/network-poc/state"
+	"github.com/iryonetwork/network-poc/storage/ehr"
+	"github.com/iryonetwork/network-poc/storage/ledger"
+)
+
+// relayAPI relays requests between ws connections like the api does. Connection is known
+// by its token, which tests set to the account or the recovery key
+func relayAPI(t *testing.T) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	var mu sync.Mutex
+	conns := make(map[string]*websocket.Conn)
+	saved := make(map[string][][]byte)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("token")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.BinaryMessage, []byte("Authorized"))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		welcome, _ := requests.NewWelcome(requests.Capabilities{Version: requests.ProtocolVersion, Features: []string{requests.FeatureCodecJSON}}).Encode()
+		conn.WriteMessage(websocket.BinaryMessage, welcome)
+
+		mu.Lock()
+		conns[name] = conn
+		for _, msg := range saved[name] {
+			conn.WriteMessage(websocket.BinaryMessage, msg)
+		}
+		delete(saved, name)
+		mu.Unlock()
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			req, err := requests.Decode(msg)
+			if err != nil {
+				t.Errorf("Decode failed: %v", err)
+				return
+			}
+			to, _ := req.GetDataString("to")
+			out, _ := requests.Relay(req, name).Encode()
+
+			mu.Lock()
+			if c, ok := conns[to]; ok {
+				c.WriteMessage(websocket.BinaryMessage, out)
+			} else {
+				saved[to] = append(saved[to], out)
+			}
+			mu.Unlock()
+		}
+	}))
+}
+
+type recoveryDevice struct {
+	state  *state.State
+	client *Client
+}
+
+// connectDevice connects client of st to the relay, with ledger shared through ledgerPath
+func connectDevice(t *testing.T, api *httptest.Server, st *state.State, ledgerPath string) *recoveryDevice {
+	cfg := &config.Config{EosAccount: st.EosAccount, IryoAddr: api.URL, WsMessageMaxAge: time.Hour}
+	log := logger.New(cfg)
+	l := ledger.NewMemory(st, ledgerPath, log)
+	if _, err := l.ImportKey(st.EosPrivate); err != nil {
+		t.Fatalf("ImportKey failed: %v", err)
+	}
+	st.Token = st.Sender()
+
+	storage := ehr.New()
+	c := New(cfg, st, l, storage, NewMessageHandler(st, storage, l, log), log)
+	ws, err := ConnectWs(cfg, st, log, c.messageHandler, storage, l)
+	if err != nil {
+		t.Fatalf("ConnectWs failed: %v", err)
+	}
+	c.ws = ws
+	c.request = requests.NewRequests(log, cfg, st, ws, l)
+	c.messageHandler.SetRequests(c.request)
+	return &recoveryDevice{state: st, client: c}
+}
+
+// eventually waits until check reports true
+func eventually(t *testing.T, what string, check func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if check() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting until %s", what)
+}
+
+func TestRecoverOnNewDevice(t *testing.T) {
+	api := relayAPI(t)
+	defer api.Close()
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ledgerPath := filepath.Join(dir, "ledger.json")
+
+	accounts := []string{"patient.iryo", "trustee1.iryo", "trustee2.iryo"}
+	states := make(map[string]*state.State)
+	for _, account := range accounts {
+		st := newTestState(t, &config.Config{EosAccount: account})
+		states[account] = st
+		l := ledger.NewMemory(st, ledgerPath, logger.New(&config.Config{}))
+		if err := l.CreateAccount(account, st.GetEosPublicKey()); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+	}
+	masterKey, err := states["patient.iryo"].RecordKey(0)
+	if err != nil {
+		t.Fatalf("RecordKey failed: %v", err)
+	}
+	states["patient.iryo"].EncryptionKeys["patient.iryo"] = masterKey
+
+	patient := connectDevice(t, api, states["patient.iryo"], ledgerPath)
+	trustees := []*recoveryDevice{
+		connectDevice(t, api, states["trustee1.iryo"], ledgerPath),
+		connectDevice(t, api, states["trustee2.iryo"], ledgerPath),
+	}
+
+	if err := patient.client.SetupRecovery([]string{"trustee1.iryo", "trustee2.iryo"}, 2, "correct horse"); err != nil {
+		t.Fatalf("SetupRecovery failed: %v", err)
+	}
+	for _, trustee := range trustees {
+		trustee := trustee
+		eventually(t, "trustee is invited", func() bool { return trustee.state.Recovery.Invited["patient.iryo"] != "" })
+		if err := trustee.client.AcceptRecoveryInvite("patient.iryo"); err != nil {
+			t.Fatalf("AcceptRecoveryInvite failed: %v", err)
+		}
+		eventually(t, "trustee holds the share", func() bool { return trustee.state.Recovery.Shares["patient.iryo"].Share != nil })
+	}
+
+	// Device with wrong passphrase is not returned the shares
+	wrong := newTestState(t, &config.Config{})
+	if err := wrong.StartRecovery("patient.iryo", "wrong horse"); err != nil {
+		t.Fatalf("StartRecovery failed: %v", err)
+	}
+	if err := connectDevice(t, api, wrong, ledgerPath).client.RequestRecovery([]string{"trustee1.iryo", "trustee2.iryo"}); err != nil {
+		t.Fatalf("RequestRecovery failed: %v", err)
+	}
+
+	// Patient lost the device, new one has a different EOS key
+	st := newTestState(t, &config.Config{})
+	if err := st.StartRecovery("patient.iryo", "correct horse"); err != nil {
+		t.Fatalf("StartRecovery failed: %v", err)
+	}
+	if st.GetEosPublicKey() == states["patient.iryo"].GetEosPublicKey() {
+		t.Fatal("Expected new device to have a different key")
+	}
+	device := connectDevice(t, api, st, ledgerPath)
+	if err := device.client.RequestRecovery([]string{"trustee1.iryo", "trustee2.iryo"}); err != nil {
+		t.Fatalf("RequestRecovery failed: %v", err)
+	}
+
+	for _, trustee := range trustees {
+		trustee := trustee
+		eventually(t, "trustee is asked for the share", func() bool { return trustee.state.Recovery.Requested["patient.iryo"] != nil })
+		// Identity is confirmed out of band, the share goes to the device with the recovery key
+		if err := trustee.client.ReturnShare("patient.iryo"); err != nil {
+			t.Fatalf("ReturnShare failed: %v", err)
+		}
+	}
+
+	eventually(t, "key is recovered", func() bool { return device.state.EncryptionKeys["patient.iryo"] != nil })
+	if !bytes.Equal(device.state.EncryptionKeys["patient.iryo"], masterKey) {
+		t.Error("Expected recovered key to match the master key")
+	}
+	if wrong.EncryptionKeys["patient.iryo"] != nil {
+		t.Error("Expected device with wrong passphrase not to recover the key")
+	}
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iryonetwork/network-poc/openEHR/ehrdata"
+	"github.com/iryonetwork/network-poc/state"
+)
+
+// rotationMu makes sure only one rotation job is running at a time
+var rotationMu sync.Mutex
+
+// rotationProgress is sent to frontend ws while the key is being rotated
+type rotationProgress struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Reencrypt rotates owner's key. Data keys of all documents are wrapped with the new key
+// and uploaded. The old key is used until every upload is confirmed, only then connected
+// users are notified with Reencrypt request. Progress is stored in state, so an interrupted
+// rotation can be continued with ResumeRotation
+func (c *Client) Reencrypt(key []byte) error {
+	return c.reencrypt(key, "requested by user")
+}
+
+func (c *Client) reencrypt(key []byte, reason string) error {
+	c.log.Debugf("Client:: Reencrypting, %s", reason)
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	return c.startRotation(key, reason)
+}
+
+// startRotation starts rotation to key, rotationMu must be held
+func (c *Client) startRotation(key []byte, reason string) error {
+	if c.state.Rotation != nil {
+		return fmt.Errorf("Key rotation is already in progress")
+	}
+
+	c.state.Rotation = &state.Rotation{
+		Owner:    c.state.EosAccount,
+		OldKey:   c.state.EncryptionKeys[c.state.EosAccount],
+		NewKey:   key,
+		Done:     []string{},
+		Reupload: []string{},
+		Reason:   reason,
+	}
+	if err := c.state.Save(); err != nil {
+		return err
+	}
+
+	return c.rotate()
+}
+
+// ResumeRotation continues key rotation that was interrupted
+func (c *Client) ResumeRotation() error {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	if c.state.Rotation == nil {
+		return nil
+	}
+	if c.state.Rotation.Owner != c.state.EosAccount {
+		c.log.Printf("Dropping key rotation of %s, logged in as %s", c.state.Rotation.Owner, c.state.EosAccount)
+		c.state.Rotation = nil
+		return c.state.Save()
+	}
+
+	c.log.Debugf("Client:: Resuming reencryption")
+	return c.rotate()
+}
+
+func (c *Client) rotate() error {
+	r := c.state.Rotation
+	owner := r.Owner
+
+	// Local storage might not contain all documents if the client was restarted
+	if err := c.update(owner); err != nil {
+		return c.rotationFailed(err)
+	}
+
+	ids, err := c.ehr.ListIds(owner)
+	if err != nil {
+		return c.rotationFailed(err)
+	}
+	c.rotationProgress("running", len(r.Done), len(ids), nil)
+
+	for _, id := range ids {
+		if contains(r.Done, id) {
+			continue
+		}
+
+		if err := c.rotateDocument(r, id); err != nil {
+			return c.rotationFailed(err)
+		}
+
+		r.Done = append(r.Done, id)
+		if err := c.state.Save(); err != nil {
+			return c.rotationFailed(err)
+		}
+		c.rotationProgress("running", len(r.Done), len(ids), nil)
+	}
+
+	// All documents are uploaded, the old key is not needed anymore. Documents
+	// were rewritten in bound format, unbound ones can't be ours anymore
+	c.state.EncryptionKeys[owner] = r.NewKey
+	c.state.KeyRotated(r.NewKey)
+	if err := c.ehr.RejectUnbound(owner); err != nil {
+		return c.rotationFailed(err)
+	}
+	if err := c.state.Save(); err != nil {
+		return c.rotationFailed(err)
+	}
+
+	// Send notification about reencrypting to api. Rotation stays in state until
+	// it's sent, so that ResumeRotation sends it if this fails
+	if err := c.request.ReencryptRequest(); err != nil {
+		return c.rotationFailed(err)
+	}
+	c.state.RotationLog = append(c.state.RotationLog, state.RotationRecord{
+		Time:      time.Now(),
+		Reason:    r.Reason,
+		Documents: len(ids),
+	})
+	c.state.Rotation = nil
+	if err := c.state.Save(); err != nil {
+		c.log.Printf("Key rotation failed: %v", err)
+		c.rotationProgress("failed", len(ids), len(ids), err)
+		return err
+	}
+
+	c.rotationProgress("done", len(ids), len(ids), nil)
+	c.refreshRecovery()
+	return nil
+}
+
+// migrate rewrites our documents that are not bound to their owner and ID, so that unbound
+// documents are rejected without waiting for the next key rotation. Documents are rewritten
+// by rotation to the current key, which reuploads them, can be resumed after failure and
+// notifies grantees with Reencrypt request, so they reject the unbound documents as well
+func (c *Client) migrate() error {
+	owner := c.state.EosAccount
+	key := c.state.EncryptionKeys[owner]
+	if key == nil {
+		return nil
+	}
+
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	upgraded, err := c.ehr.Upgraded(owner)
+	if err != nil || upgraded || c.state.Rotation != nil {
+		// rotation in progress rewrites them
+		return err
+	}
+	unbound, err := c.ehr.Unbound(owner)
+	if err != nil {
+		return err
+	}
+	if len(unbound) == 0 {
+		return c.ehr.RejectUnbound(owner)
+	}
+
+	c.log.Debugf("Client:: Upgrading %d documents to bound format", len(unbound))
+	return c.startRotation(key, "documents upgraded to bound format")
+}
+
+// rotateAfterRevoke rotates the key once access of `revoked` was revoked, so that documents
+// uploaded later can't be read with the key they hold. Remaining grantees are notified with
+// Reencrypt request when rotation is done and get the new key through RequestKey/SendKey.
+// Rotation already in progress is finished instead, its new key was not sent to anyone yet
+func (c *Client) rotateAfterRevoke(revoked string) {
+	reason := fmt.Sprintf("access of %s was revoked", revoked)
+
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+
+	var err error
+	if r := c.state.Rotation; r != nil {
+		r.Reason += "; " + reason
+		err = c.rotate()
+	} else {
+		var key []byte
+		key, err = c.state.NextRecordKey()
+		if err == nil {
+			err = c.startRotation(key, reason)
+		}
+	}
+	if err != nil {
+		c.log.Printf("Failed to rotate key after revoking %s: %v", revoked, err)
+	}
+}
+
+// rotateDocument wraps document's data key with the new key and uploads it.
+// Legacy documents and documents without category are encrypted anew and reuploaded as whole
+func (c *Client) rotateDocument(r *state.Rotation, id string) error {
+	reencrypted, err := c.ehr.RewrapID(r.Owner, id, r.OldKey, r.NewKey, ehrdata.Category)
+	if err != nil {
+		return err
+	}
+
+	if reencrypted {
+		// Remember it before uploading, so the whole document is reuploaded on retry
+		r.Reupload = append(r.Reupload, id)
+		if err := c.state.Save(); err != nil {
+			return err
+		}
+	}
+
+	c.log.Debugf("Uploading %s", id)
+	if contains(r.Reupload, id) {
+		return c.Upload(r.Owner, id, true)
+	}
+	return c.UploadKey(r.Owner, id)
+}
+
+func (c *Client) rotationFailed(err error) error {
+	c.log.Printf("Key rotation failed: %v", err)
+	ids, _ := c.ehr.ListIds(c.state.Rotation.Owner)
+	c.rotationProgress("failed", len(c.state.Rotation.Done), len(ids), err)
+	return err
+}
+
+func (c *Client) rotationProgress(status string, done, total int, err error) {
+	progress := rotationProgress{Type: "rotation", Status: status, Done: done, Total: total}
+	if err != nil {
+		progress.Error = err.Error()
+	}
+	data, err := json.Marshal(progress)
+	if err != nil {
+		c.log.Debugf("Error marshaling json: %v", err)
+		return
+	}
+
+	c.sendFrontend(data)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// remove returns list without s
+func remove(list []string, s string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/requests"
+	"github.com/iryonetwork/network-poc/state"
+	"github.com/iryonetwork/network-poc/storage/ehr"
+	"github.com/iryonetwork/network-poc/storage/ledger"
+)
+
+// fakeAPI lists no documents, accepts reuploads and passes names of requests sent over ws to sent
+func fakeAPI(t *testing.T, sent chan<- string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			w.WriteHeader(201)
+			w.Write([]byte(`{}`))
+			return
+		}
+		if r.URL.Path != "/ws" {
+			w.Write([]byte(`{"files":[]}`))
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			req, err := requests.Decode(msg)
+			if err != nil {
+				t.Errorf("Decode failed: %v", err)
+				return
+			}
+			sent <- req.Name
+		}
+	}))
+}
+
+func TestRotateAfterRevoke(t *testing.T) {
+	sent := make(chan string, 10)
+	api := fakeAPI(t, sent)
+	defer api.Close()
+
+	cfg := &config.Config{EosAccount: "patient.iryo", IryoAddr: api.URL, RotateOnRevoke: true}
+	log := logger.New(cfg)
+	st, err := state.New(cfg, log)
+	if err != nil {
+		t.Fatalf("state.New failed: %v", err)
+	}
+	if err := st.NewMnemonicKey(); err != nil {
+		t.Fatalf("NewMnemonicKey failed: %v", err)
+	}
+	oldKey, err := st.RecordKey(0)
+	if err != nil {
+		t.Fatalf("RecordKey failed: %v", err)
+	}
+	st.EncryptionKeys[st.EosAccount] = oldKey
+
+	l := ledger.NewMemory(st, "", log)
+	for _, account := range []string{"patient.iryo", "doctor1.iryo"} {
+		if err := l.CreateAccount(account, st.GetEosPublicKey()); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+	}
+	if err := l.GrantAccess("doctor1.iryo", ledger.PermissionDefault, time.Time{}); err != nil {
+		t.Fatalf("GrantAccess failed: %v", err)
+	}
+	st.Connections.GrantedTo = []string{"doctor1.iryo"}
+
+	storage := ehr.New()
+	c := New(cfg, st, l, storage, NewMessageHandler(st, storage, l, log), log)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(api.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	c.request = requests.NewRequests(log, cfg, st, conn, l)
+
+	if err := c.RevokeAccess("doctor1.iryo"); err != nil {
+		t.Fatalf("RevokeAccess failed: %v", err)
+	}
+	granted, err := l.AccessGranted("patient.iryo", "doctor1.iryo")
+	if err != nil || granted {
+		t.Errorf("Expected access to be revoked, got %v, %v", granted, err)
+	}
+
+	for _, name := range []string{"RevokeKey", "Reencrypt"} {
+		select {
+		case got := <-sent:
+			if got != name {
+				t.Errorf("Expected %s to be sent, got %s", name, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %s to be sent", name)
+		}
+	}
+
+	// Rotation finishes while holding rotationMu
+	var rotations []state.RotationRecord
+	var rotation *state.Rotation
+	var key []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rotationMu.Lock()
+		rotations, rotation, key = st.RotationLog, st.Rotation, st.EncryptionKeys[st.EosAccount]
+		rotationMu.Unlock()
+		if len(rotations) > 0 {
+			break
+		}
+	}
+	if len(rotations) != 1 {
+		t.Fatalf("Expected one rotation in the log, got %d", len(rotations))
+	}
+	if !strings.Contains(rotations[0].Reason, "doctor1.iryo") {
+		t.Errorf("Expected reason to name the revoked account, got %q", rotations[0].Reason)
+	}
+	if bytes.Equal(key, oldKey) {
+		t.Error("Expected key to be rotated")
+	}
+	if rotation != nil {
+		t.Error("Expected rotation to be removed from state")
+	}
+}
+
+func TestMigrateOnSync(t *testing.T) {
+	sent := make(chan string, 10)
+	api := fakeAPI(t, sent)
+	defer api.Close()
+
+	cfg := &config.Config{EosAccount: "patient.iryo", IryoAddr: api.URL}
+	log := logger.New(cfg)
+	st, err := state.New(cfg, log)
+	if err != nil {
+		t.Fatalf("state.New failed: %v", err)
+	}
+	if err := st.NewMnemonicKey(); err != nil {
+		t.Fatalf("NewMnemonicKey failed: %v", err)
+	}
+	key, err := st.RecordKey(0)
+	if err != nil {
+		t.Fatalf("RecordKey failed: %v", err)
+	}
+	st.EncryptionKeys[st.EosAccount] = key
+	l := ledger.NewMemory(st, "", log)
+	if err := l.CreateAccount(st.EosAccount, st.GetEosPublicKey()); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+
+	// Document encrypted before data keys were introduced
+	storage := ehr.New()
+	if err := storage.Saveid(st.EosAccount, "legacy", legacyDocument(t, key, []byte(`{"firstName":"Janez"}`))); err != nil {
+		t.Fatalf("Saveid failed: %v", err)
+	}
+
+	c := New(cfg, st, l, storage, NewMessageHandler(st, storage, l, log), log)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(api.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	c.request = requests.NewRequests(log, cfg, st, conn, l)
+
+	for i := 0; i < 2; i++ {
+		if err := c.Update(st.EosAccount); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+	}
+
+	select {
+	case got := <-sent:
+		if got != "Reencrypt" {
+			t.Errorf("Expected grantees to be notified with Reencrypt, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected grantees to be notified with Reencrypt")
+	}
+	select {
+	case got := <-sent:
+		t.Errorf("Expected documents to be upgraded once, got %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if unbound, err := storage.Unbound(st.EosAccount); err != nil || len(unbound) != 0 {
+		t.Errorf("Expected all documents to be bound, got %v, %v", unbound, err)
+	}
+	if upgraded, err := storage.Upgraded(st.EosAccount); err != nil || !upgraded {
+		t.Errorf("Expected unbound documents to be rejected, got %v, %v", upgraded, err)
+	}
+	if data, err := storage.Decrypt(st.EosAccount, "legacy", key); err != nil || !bytes.Contains(data, []byte("Janez")) {
+		t.Errorf("Expected upgraded document to decrypt with the same key, got %s, %v", data, err)
+	}
+	if !bytes.Equal(st.EncryptionKeys[st.EosAccount], key) {
+		t.Error("Expected key not to change")
+	}
+}
+
+// legacyDocument encrypts data directly with key as nonce | AES-GCM ciphertext
+func legacyDocument(t *testing.T, key, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher failed: %v", err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("NewGCM failed: %v", err)
+	}
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatalf("rand.Read failed: %v", err)
+	}
+	return aesgcm.Seal(nonce, nonce, data, nil)
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/ksuid"
+
+	"github.com/iryonetwork/network-poc/requests"
+)
+
+// KeyDeniedError is returned when the user refused to share the key
+type KeyDeniedError struct {
+	From   string
+	Reason string
+}
+
+func (e *KeyDeniedError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s denied the key request", e.From)
+	}
+	return fmt.Sprintf("%s denied the key request: %s", e.From, e.Reason)
+}
+
+// KeyRequestTimeoutError is returned when no answer arrived before the context was done
+type KeyRequestTimeoutError struct {
+	To  string
+	Err error
+}
+
+func (e *KeyRequestTimeoutError) Error() string {
+	return fmt.Sprintf("no answer to key request from %s; %v", e.To, e.Err)
+}
+
+// calls keeps track of requests waiting for an answer
+type calls struct {
+	mu      sync.Mutex
+	pending map[string]*call
+}
+
+type call struct {
+	to     string
+	answer chan reply
+}
+
+// reply is the request answering a call, with the key imported from it or the reason
+// it could not be imported
+type reply struct {
+	request *requests.Request
+	key     []byte
+	err     error
+}
+
+func newCalls() *calls {
+	return &calls{pending: make(map[string]*call)}
+}
+
+// expect registers a call to `to` and returns channel on which the answer will be delivered
+func (c *calls) expect(correlationID, to string) <-chan reply {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	answer := make(chan reply, 1)
+	c.pending[correlationID] = &call{to: to, answer: answer}
+	return answer
+}
+
+func (c *calls) forget(correlationID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, correlationID)
+}
+
+// resolve delivers the request and the key imported from it, or the import error, to the calls it answers
+func (c *calls) resolve(r *requests.Request, key []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	from, _ := r.GetDataString("from")
+	if id, idErr := r.GetDataString(requests.FieldCorrelationID); idErr == nil {
+		if pending, ok := c.pending[id]; ok && pending.to == from {
+			pending.answer <- reply{r, key, err}
+			delete(c.pending, id)
+		}
+		return
+	}
+
+	// Revoking the key or denial without correlationID answers all calls made to the user
+	if r.Name == "RevokeKey" || r.Name == "DenyKey" {
+		for id, pending := range c.pending {
+			if pending.to == from {
+				pending.answer <- reply{r, key, err}
+				delete(c.pending, id)
+			}
+		}
+	}
+}
+
+// RequestKeyAndWait requests the key from `to` and waits until the key is imported,
+// the request is denied or ctx is done
+func (c *Client) RequestKeyAndWait(ctx context.Context, to string) ([]byte, error) {
+	c.log.Debugf("Client::RequestKeyAndWait(%s) called", to)
+
+	correlationID := ksuid.New().String()
+	answer := c.ws.calls.expect(correlationID, to)
+	defer c.ws.calls.forget(correlationID)
+
+	if err := c.request.RequestsKeyWithID(to, "", correlationID); err != nil {
+		return nil, err
+	}
+
+	select {
+	case a := <-answer:
+		r := a.request
+		switch r.Name {
+		case "ImportKey":
+			if a.err != nil {
+				return nil, fmt.Errorf("Key from %s could not be imported; %v", to, a.err)
+			}
+			return a.key, nil
+		case "DenyKey":
+			reason, _ := r.GetDataString("reason")
+			return nil, &KeyDeniedError{From: to, Reason: reason}
+		case "RevokeKey":
+			return nil, &KeyDeniedError{From: to}
+		default:
+			return nil, fmt.Errorf("Unexpected answer %s to key request", r.Name)
+		}
+	case <-ctx.Done():
+		return nil, &KeyRequestTimeoutError{To: to, Err: ctx.Err()}
+	}
+}
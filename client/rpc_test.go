@@ -0,0 +1,73 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/iryonetwork/network-poc/requests"
+)
+
+func answer(name, from, correlationID string) *requests.Request {
+	r := requests.NewReq(name)
+	r.Append("from", from)
+	if correlationID != "" {
+		r.Append(requests.FieldCorrelationID, correlationID)
+	}
+	return r
+}
+
+func TestCallsResolve(t *testing.T) {
+	c := newCalls()
+	first := c.expect("1", "patient.iryo")
+	second := c.expect("2", "patient.iryo")
+	other := c.expect("3", "other.iryo")
+
+	// answer from someone else must not resolve the call
+	c.resolve(answer("ImportKey", "other.iryo", "1"), nil, nil)
+	// answer to unknown call is ignored
+	c.resolve(answer("ImportKey", "patient.iryo", "4"), nil, nil)
+	c.resolve(answer("ImportKey", "patient.iryo", "1"), []byte("key"), nil)
+
+	select {
+	case r := <-first:
+		if r.request.Name != "ImportKey" {
+			t.Errorf("Expected first call to be answered with ImportKey, got %s", r.request.Name)
+		}
+		if string(r.key) != "key" {
+			t.Errorf("Expected imported key to be delivered, got %q", r.key)
+		}
+	default:
+		t.Errorf("Expected first call to be answered")
+	}
+
+	// revoking the key answers all remaining calls to the user
+	c.resolve(answer("RevokeKey", "patient.iryo", ""), nil, nil)
+	select {
+	case r := <-second:
+		if r.request.Name != "RevokeKey" {
+			t.Errorf("Expected second call to be answered with RevokeKey, got %s", r.request.Name)
+		}
+	default:
+		t.Errorf("Expected second call to be answered")
+	}
+
+	select {
+	case r := <-other:
+		t.Errorf("Expected call to other user to stay pending, got %s", r.request.Name)
+	default:
+	}
+	if len(c.pending) != 1 {
+		t.Errorf("Expected 1 pending call, got %d", len(c.pending))
+	}
+
+	// key that could not be imported is reported to the caller
+	c.resolve(answer("ImportKey", "other.iryo", "3"), nil, errors.New("invalid key"))
+	select {
+	case r := <-other:
+		if r.err == nil || r.key != nil {
+			t.Errorf("Expected import error to be delivered, got %v, %q", r.err, r.key)
+		}
+	default:
+		t.Errorf("Expected call to other user to be answered")
+	}
+}
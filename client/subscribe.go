@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"strconv"
 
 	"github.com/eoscanada/eos-go/ecc"
 
@@ -18,11 +19,11 @@ import (
 	"github.com/iryonetwork/network-poc/requests"
 	"github.com/iryonetwork/network-poc/state"
 	"github.com/iryonetwork/network-poc/storage/ehr"
-	"github.com/iryonetwork/network-poc/storage/eos"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 )
 
 type subscribe struct {
-	eos      *eos.Storage
+	eos      ledger.Ledger
 	ehr      *ehr.Storage
 	requests *requests.Requests
 	ws       *Ws
@@ -36,7 +37,7 @@ type connecter interface{
 	Connect(string, string) error
 }
 
-func NewMessageHandler(state *state.State, ehr *ehr.Storage, eos *eos.Storage, log *logger.Log) *subscribe {
+func NewMessageHandler(state *state.State, ehr *ehr.Storage, eos ledger.Ledger, log *logger.Log) *subscribe {
 	return &subscribe{eos: eos, ehr: ehr, state: state, log: log}
 }
 
@@ -64,20 +65,19 @@ func (s *subscribe) SetConnecter(c connecter) MessageHandler {
 	return s
 }
 
-func (s *subscribe) ImportKey(r *requests.Request) {
+// ImportKey imports the key sent with SendKey and returns it
+func (s *subscribe) ImportKey(r *requests.Request) ([]byte, error) {
 	keyenc, err := base64.StdEncoding.DecodeString(subscribeGetStringDataFromRequest(r, "key", s.log))
 	if err != nil {
-		s.log.Debugf("Error decoding key from base64; %v", err)
+		return nil, fmt.Errorf("Error decoding key from base64; %v", err)
 	}
 	from := subscribeGetStringDataFromRequest(r, "from", s.log)
 	name := subscribeGetStringDataFromRequest(r, "name", s.log)
 	customData := subscribeGetStringDataFromRequest(r, "customData", s.log)
 
-	rnd := rand.Reader
-	key, err := rsa.DecryptOAEP(sha512.New(), rnd, s.state.RSAKey, keyenc, []byte{})
+	key, err := s.decryptKey(r, keyenc)
 	if err != nil {
-		s.log.Printf("Error decrypting key: %v", err)
-		return
+		return nil, fmt.Errorf("Error decrypting key: %v", err)
 	}
 
 	s.log.Debugf("SUBSCRIPTION:: Importing key from user %s (%s)", from, customData)
@@ -85,6 +85,12 @@ func (s *subscribe) ImportKey(r *requests.Request) {
 	s.state.Directory[from] = name
 	s.state.EncryptionKeys[from] = key
 
+	for i, v := range s.state.Connections.Awaiting {
+		if v == from {
+			s.state.Connections.Awaiting = append(s.state.Connections.Awaiting[:i], s.state.Connections.Awaiting[i+1:]...)
+		}
+	}
+
 	exists := false
 	for _, name := range s.state.Connections.WithKey {
 		if name == from {
@@ -102,14 +108,39 @@ func (s *subscribe) ImportKey(r *requests.Request) {
 	}
 
 	s.log.Debugf("SUBSCRIPTION:: Imported key from %s ", from)
+	return key, nil
+}
+
+// decryptKey decrypts the key sent in SendKey with the algorithm the sender chose
+func (s *subscribe) decryptKey(r *requests.Request, keyenc []byte) ([]byte, error) {
+	alg, _ := r.GetDataString(requests.FieldKeyAlg)
+	if alg == requests.KeyAlgX25519 {
+		public, private, err := requests.X25519KeyPair(s.state.EosPrivate)
+		if err != nil {
+			return nil, err
+		}
+		return requests.OpenKey(public, private, keyenc)
+	}
+
+	// Senders that do not set keyAlg use RSA
+	if s.state.RSAKey == nil {
+		return nil, fmt.Errorf("Key was encrypted with RSA, but we don't have RSA key")
+	}
+	return rsa.DecryptOAEP(sha512.New(), rand.Reader, s.state.RSAKey, keyenc, []byte{})
 }
 
 func (s *subscribe) RevokeKey(r *requests.Request) {
 	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	s.removeKey(from)
+}
 
+// removeKey removes `from`'s key and documents
+func (s *subscribe) removeKey(from string) {
 	s.log.Debugf("SUBSCRIPTION:: Revoking %s's key", from)
 
-	s.ehr.RemoveUser(from)
+	if err := s.ehr.RemoveUser(from); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error removing %s's documents: %v", from, err)
+	}
 	delete(s.state.EncryptionKeys, from)
 
 	for i, v := range s.state.Connections.WithKey {
@@ -122,7 +153,13 @@ func (s *subscribe) RevokeKey(r *requests.Request) {
 
 func (s *subscribe) SubReencrypt(r *requests.Request) {
 	from := subscribeGetStringDataFromRequest(r, "from", s.log)
-	s.ehr.RemoveUser(from)
+	if err := s.ehr.RemoveUser(from); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error removing %s's documents: %v", from, err)
+	}
+	// owner rewrote all documents in bound format before notifying us
+	if err := s.ehr.RejectUnbound(from); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error recording %s's documents as upgraded: %v", from, err)
+	}
 	err := s.requests.RequestsKey(from, "")
 	if err != nil {
 		s.log.Printf("Error creating RequestKey: %v", err)
@@ -162,16 +199,113 @@ func (s *subscribe) AccessWasGranted(r *requests.Request) {
 	}
 }
 
+// AccessRelinquished removes user that gave up access we granted from our connections
+func (s *subscribe) AccessRelinquished(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	s.log.Debugf("SUBSCRIPTION:: %s relinquished access", from)
+
+	if granted, err := s.eos.AccessGranted(s.state.EosAccount, from); err != nil || granted {
+		s.log.Debugf("SUBSCRIPTION:: Access of %s is still granted; %v", from, err)
+		return
+	}
+
+	delete(s.state.Connections.Categories, from)
+	delete(s.state.Connections.Expires, from)
+	s.state.Connections.GrantedTo = remove(s.state.Connections.GrantedTo, from)
+
+	// the user still holds our key
+	if s.client != nil && s.client.config.RotateOnRevoke {
+		go s.client.rotateAfterRevoke(from)
+	}
+}
+
+// LedgerAccessGranted handles grant the api found on the ledger. The api does not sign it,
+// so the grant is checked on the ledger before it's acted upon
+func (s *subscribe) LedgerAccessGranted(r *requests.Request) {
+	patient := subscribeGetStringDataFromRequest(r, "patient", s.log)
+	account := subscribeGetStringDataFromRequest(r, "account", s.log)
+	s.log.Debugf("SUBSCRIPTION:: %s granted access to %s", patient, account)
+
+	if granted, err := s.eos.AccessGranted(patient, account); err != nil || !granted {
+		s.log.Debugf("SUBSCRIPTION:: Access of %s to %s is not granted; %v", account, patient, err)
+		return
+	}
+
+	switch s.state.EosAccount {
+	case patient:
+		// access might have been granted from another device
+		if !contains(s.state.Connections.GrantedTo, account) {
+			s.state.Connections.GrantedTo = append(s.state.Connections.GrantedTo, account)
+		}
+
+	case account:
+		if contains(s.state.Connections.WithKey, patient) || contains(s.state.Connections.Awaiting, patient) {
+			return
+		}
+		// the key is only shared with users that can read the documents
+		if permissions, err := s.eos.Permissions(patient, account); err != nil || !permissions.CanRead() {
+			return
+		}
+		if !contains(s.state.Connections.WithoutKey, patient) {
+			s.state.Connections.WithoutKey = append(s.state.Connections.WithoutKey, patient)
+		}
+		if err := s.requests.RequestsKey(patient, ""); err != nil {
+			s.log.Printf("Error occurred while requesting key %s", err.Error())
+		}
+	}
+}
+
+// LedgerAccessRevoked handles revoke the api found on the ledger. It's checked on the ledger
+// as well, access might have been granted again since
+func (s *subscribe) LedgerAccessRevoked(r *requests.Request) {
+	patient := subscribeGetStringDataFromRequest(r, "patient", s.log)
+	account := subscribeGetStringDataFromRequest(r, "account", s.log)
+	s.log.Debugf("SUBSCRIPTION:: %s revoked access of %s", patient, account)
+
+	if granted, err := s.eos.AccessGranted(patient, account); err != nil || granted {
+		s.log.Debugf("SUBSCRIPTION:: Access of %s to %s is still granted; %v", account, patient, err)
+		return
+	}
+
+	switch s.state.EosAccount {
+	case patient:
+		delete(s.state.Connections.Categories, account)
+		delete(s.state.Connections.Expires, account)
+		s.state.Connections.GrantedTo = remove(s.state.Connections.GrantedTo, account)
+
+	case account:
+		s.removeKey(patient)
+		s.state.Connections.WithoutKey = remove(s.state.Connections.WithoutKey, patient)
+		s.state.Connections.Awaiting = remove(s.state.Connections.Awaiting, patient)
+	}
+}
+
 func (s *subscribe) NotifyKeyRequested(r *requests.Request) {
 	s.log.Debugf("SUBSCRIPTION:: Got RequestKey request")
 	from := subscribeGetStringDataFromRequest(r, "from", s.log)
 	name := subscribeGetStringDataFromRequest(r, "name", s.log)
-	rsakey := subscribeGetDataFromRequest(r, "key", s.log)
 	sign := subscribeGetStringDataFromRequest(r, "signature", s.log)
 	customData := subscribeGetStringDataFromRequest(r, "customData", s.log)
+	correlationID, _ := r.GetDataString(requests.FieldCorrelationID)
+	rsakey, rsaErr := r.GetData("key")
+	x25519key, x25519Err := r.GetData(requests.FieldX25519Key)
+
+	// Signature is made over RSA key if it was sent, over X25519 key otherwise
+	signed := rsakey
+	if rsaErr != nil {
+		signed = x25519key
+	}
+	// X25519 key sent along RSA key has its own signature, it's not used if it's not signed
+	if rsaErr == nil && x25519Err == nil {
+		x25519Sign, _ := r.GetDataString(requests.FieldX25519Signature)
+		if ok, err := s.verifyRequestKeyRequest(x25519Sign, from, x25519key); !ok || err != nil {
+			s.log.Printf("SUBSCRIBE:: X25519 key could not be verified, using RSA key; %v", err)
+			x25519Err = fmt.Errorf("X25519 key is not signed")
+		}
+	}
 
 	// Check if account and key are connected
-	valid, err := s.verifyRequestKeyRequest(sign, from, rsakey)
+	valid, err := s.verifyRequestKeyRequest(sign, from, signed)
 	if err != nil {
 		s.log.Printf("Error checking valid account: %v", err)
 		return
@@ -182,22 +316,42 @@ func (s *subscribe) NotifyKeyRequested(r *requests.Request) {
 	}
 
 	// Save the request to storage for later usage
-	pubKey, err := rsaPEMKeyToRSAPublicKey(rsakey)
-	if err != nil {
-		s.log.Printf("SUBSCRIBE:: Error getting rsa public key; %v", err)
+	request := state.Request{CustomData: customData, CorrelationID: correlationID}
+	if x25519Err == nil {
+		if request.X25519Key, err = base64.StdEncoding.DecodeString(string(x25519key)); err != nil || len(request.X25519Key) != 32 {
+			s.log.Printf("SUBSCRIBE:: Invalid x25519 public key; %v", err)
+			request.X25519Key = nil
+		}
+	}
+	if rsaErr == nil {
+		if request.Key, err = rsaPEMKeyToRSAPublicKey(rsakey); err != nil {
+			s.log.Printf("SUBSCRIBE:: Error getting rsa public key; %v", err)
+		}
+	}
+	// Client that can't use sealed boxes needs our RSA key when we request its key
+	if request.Key != nil && request.X25519Key == nil {
+		s.state.SetLegacy(from)
 	}
-	s.state.Connections.Requested[from] = state.Request{Key: pubKey, CustomData: customData}
+	s.state.Connections.Requested[from] = request
 
 	// Add user to directory
 	s.state.Directory[from] = name
 
 	// Check if access is already granted
 	// if it is, send the key without prompting the user for confirmation
-	granted, err := s.eos.AccessGranted(s.state.EosAccount, from)
+	permissions, err := s.eos.Permissions(s.state.EosAccount, from)
 	if err != nil {
 		s.log.Printf("Error getting key: %v", err)
 	}
-	if granted {
+	if permissions != 0 && !permissions.CanRead() {
+		// the key is only shared with users that can read the documents
+		if err := s.requests.DenyKey(from, "Access to read the documents was not granted"); err != nil {
+			s.log.Printf("SUBSCRIBE:: Error denying key request; %v", err)
+		}
+		delete(s.state.Connections.Requested, from)
+		return
+	}
+	if permissions != 0 {
 		s.requests.SendKey(from)
 
 		// make sure they are on the list
@@ -215,6 +369,28 @@ func (s *subscribe) NotifyKeyRequested(r *requests.Request) {
 	}
 }
 
+func (s *subscribe) KeyDenied(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	reason, _ := r.GetDataString("reason")
+
+	s.log.Debugf("SUBSCRIPTION:: %s denied our key request (%s)", from, reason)
+
+	for i, v := range s.state.Connections.Awaiting {
+		if v == from {
+			s.state.Connections.Awaiting = append(s.state.Connections.Awaiting[:i], s.state.Connections.Awaiting[i+1:]...)
+		}
+	}
+}
+
+func (s *subscribe) KeyRequestCancelled(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	reason, _ := r.GetDataString("reason")
+
+	s.log.Debugf("SUBSCRIPTION:: %s cancelled the key request (%s)", from, reason)
+
+	delete(s.state.Connections.Requested, from)
+}
+
 func (s *subscribe) NewUpload(r *requests.Request) {
 	account := subscribeGetStringDataFromRequest(r, "user", s.log)
 
@@ -235,12 +411,7 @@ func (s *subscribe) NewUpload(r *requests.Request) {
 		s.log.Debugf("Error marshaling json: %v", err)
 	}
 	userdata := []byte(fmt.Sprintf(`{"account":"%s"}`, account))
-	for _, conn := range s.ws.frontendConn {
-		err = conn.WriteMessage(1, append(userdata, data...))
-		if err != nil {
-			s.log.Debugf("Error writing message: %v", err)
-		}
-	}
+	s.client.sendFrontend(append(userdata, data...))
 }
 
 func subscribeGetStringDataFromRequest(r *requests.Request, key string, log *logger.Log) string {
@@ -305,3 +476,179 @@ func getHash(in []byte) []byte {
 	sha.Write(in)
 	return sha.Sum(nil)
 }
+
+// RecoveryInvited records invite to hold a share of the sender's key until the user accepts it
+func (s *subscribe) RecoveryInvited(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	id := subscribeGetStringDataFromRequest(r, requests.FieldRecoveryID, s.log)
+	recovery := &s.state.Recovery
+
+	// Key of owner whose share we already hold was split again, e.g. after rotation
+	if _, ok := recovery.Shares[from]; ok {
+		s.log.Debugf("SUBSCRIPTION:: %s split their key again, accepting new share", from)
+		if err := s.requests.RecoveryAccept(from, id); err != nil {
+			s.log.Printf("SUBSCRIPTION:: Error accepting recovery invite: %v", err)
+			return
+		}
+		recovery.Accepted[from] = id
+		return
+	}
+
+	// the user has to accept the invite
+	s.log.Debugf("SUBSCRIPTION:: %s invited us to hold a share of their key", from)
+	recovery.Invited[from] = id
+	if err := s.state.Save(); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error saving state: %v", err)
+	}
+}
+
+// RecoveryAccepted sends the share to trustee that accepted the invite
+func (s *subscribe) RecoveryAccepted(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	id := subscribeGetStringDataFromRequest(r, requests.FieldRecoveryID, s.log)
+	recovery := &s.state.Recovery
+
+	share, ok := recovery.Pending[from]
+	if !ok || id != recovery.ID {
+		s.log.Debugf("SUBSCRIPTION:: %s accepted invite we did not send", from)
+		return
+	}
+	key, err := decodeX25519Key(r)
+	if err != nil {
+		s.log.Printf("SUBSCRIPTION:: Invalid x25519 public key of %s; %v", from, err)
+		return
+	}
+
+	if err := s.requests.StoreShare(from, key, state.Share{ID: id, Threshold: recovery.Threshold, Share: share, KeyHash: recovery.KeyHash, RecoveryKey: recovery.RecoveryKey}); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error sending share to %s: %v", from, err)
+		return
+	}
+	delete(recovery.Pending, from)
+	if err := s.state.Save(); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error saving state: %v", err)
+	}
+	s.log.Debugf("SUBSCRIPTION:: Sent share of our key to %s", from)
+}
+
+// ShareStored keeps share of the sender's key, if we accepted their invite
+func (s *subscribe) ShareStored(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	recovery := &s.state.Recovery
+
+	share, err := s.openShare(r)
+	if err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error opening share of %s's key: %v", from, err)
+		return
+	}
+	if id, ok := recovery.Accepted[from]; !ok || id != share.ID {
+		s.log.Debugf("SUBSCRIPTION:: Dropping share of %s's key, we did not accept the invite", from)
+		return
+	}
+
+	recovery.Shares[from] = share
+	delete(recovery.Accepted, from)
+	if err := s.state.Save(); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error saving state: %v", err)
+	}
+	s.log.Debugf("SUBSCRIPTION:: Holding share of %s's key", from)
+}
+
+// RecoveryRequested remembers the request, the user has to confirm it before the share is returned.
+// Request comes from the owner's new device, which signs it with the recovery key bound to the share
+func (s *subscribe) RecoveryRequested(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	owner := subscribeGetStringDataFromRequest(r, requests.FieldAccount, s.log)
+
+	share, ok := s.state.Recovery.Shares[owner]
+	if !ok {
+		s.log.Debugf("SUBSCRIPTION:: %s requested share of %s we don't hold", from, owner)
+		return
+	}
+	if share.RecoveryKey == "" || share.RecoveryKey != from {
+		s.log.Printf("SUBSCRIPTION:: Dropping request for share of %s, it's not signed with their recovery key", owner)
+		return
+	}
+	key, err := decodeX25519Key(r)
+	if err != nil {
+		s.log.Printf("SUBSCRIPTION:: Invalid x25519 public key of %s's device; %v", owner, err)
+		return
+	}
+
+	s.log.Debugf("SUBSCRIPTION:: %s requested their share back", owner)
+	s.state.Recovery.Requested[owner] = key
+}
+
+// ShareReturned collects share of our key returned by trustee and recovers the key once there are enough
+func (s *subscribe) ShareReturned(r *requests.Request) {
+	from := subscribeGetStringDataFromRequest(r, "from", s.log)
+	recovery := &s.state.Recovery
+
+	if !contains(recovery.Asked, from) {
+		s.log.Debugf("SUBSCRIPTION:: Dropping share from %s, we did not ask for it", from)
+		return
+	}
+	share, err := s.openShare(r)
+	if err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error opening share returned by %s: %v", from, err)
+		return
+	}
+	if err := s.client.verifyShare(share); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Dropping share returned by %s: %v", from, err)
+		return
+	}
+
+	s.log.Debugf("SUBSCRIPTION:: %s returned share of our key", from)
+	recovery.Collected[from] = share
+	if err := s.client.recoverKey(); err != nil {
+		s.log.Printf("SUBSCRIPTION:: Error recovering the key: %v", err)
+	}
+}
+
+// openShare decrypts share sealed with our X25519 key
+func (s *subscribe) openShare(r *requests.Request) (state.Share, error) {
+	sealed, err := base64.StdEncoding.DecodeString(subscribeGetStringDataFromRequest(r, requests.FieldShare, s.log))
+	if err != nil {
+		return state.Share{}, err
+	}
+	threshold, err := strconv.Atoi(subscribeGetStringDataFromRequest(r, requests.FieldThreshold, s.log))
+	if err != nil {
+		return state.Share{}, err
+	}
+
+	public, private, err := requests.X25519KeyPair(s.state.EosPrivate)
+	if err != nil {
+		return state.Share{}, err
+	}
+	share, err := requests.OpenKey(public, private, sealed)
+	if err != nil {
+		return state.Share{}, err
+	}
+	keyHash, err := base64.StdEncoding.DecodeString(subscribeGetStringDataFromRequest(r, requests.FieldKeyHash, s.log))
+	if err != nil {
+		return state.Share{}, err
+	}
+
+	return state.Share{
+		ID:        subscribeGetStringDataFromRequest(r, requests.FieldRecoveryID, s.log),
+		Threshold: threshold,
+		Share:     share,
+		KeyHash:     keyHash,
+		RecoveryKey: subscribeGetStringDataFromRequest(r, requests.FieldRecoveryKey, s.log),
+		Signature:   subscribeGetStringDataFromRequest(r, requests.FieldShareSignature, s.log),
+	}, nil
+}
+
+func decodeX25519Key(r *requests.Request) ([]byte, error) {
+	encoded, err := r.GetDataString(requests.FieldX25519Key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key has %d bytes", len(key))
+	}
+	return key, nil
+}
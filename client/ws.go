@@ -3,6 +3,7 @@ package client
 import (
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,19 +13,22 @@ import (
 	"github.com/iryonetwork/network-poc/requests"
 	"github.com/iryonetwork/network-poc/state"
 	"github.com/iryonetwork/network-poc/storage/ehr"
-	"github.com/iryonetwork/network-poc/storage/eos"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 )
 
 type (
 	Ws struct {
 		conn           *websocket.Conn
-		frontendConn   []*websocket.Conn
+		writeMu        sync.Mutex // serializes writes to conn
 		messageHandler MessageHandler
 		config         *config.Config
 		state          *state.State
 		ehr            *ehr.Storage
-		eos            *eos.Storage
+		eos            ledger.Ledger
 		log            *logger.Log
+		nonces         map[string]time.Time // nonces of verified requests, used to detect replays
+		capabilities   requests.Capabilities
+		calls          *calls
 	}
 
 	MessageHandler interface {
@@ -32,52 +36,120 @@ type (
 		SetWs(ws *Ws) MessageHandler
 		SetRequests(requests *requests.Requests) MessageHandler
 		SetConnecter(connecter) MessageHandler
-		ImportKey(r *requests.Request)
+		ImportKey(r *requests.Request) ([]byte, error)
 		RevokeKey(r *requests.Request)
 		SubReencrypt(r *requests.Request)
 		AccessWasGranted(r *requests.Request)
 		NotifyKeyRequested(r *requests.Request)
+		KeyDenied(r *requests.Request)
+		KeyRequestCancelled(r *requests.Request)
 		NewUpload(r *requests.Request)
+		AccessRelinquished(r *requests.Request)
+		LedgerAccessGranted(r *requests.Request)
+		LedgerAccessRevoked(r *requests.Request)
+		RecoveryInvited(r *requests.Request)
+		RecoveryAccepted(r *requests.Request)
+		ShareStored(r *requests.Request)
+		RecoveryRequested(r *requests.Request)
+		ShareReturned(r *requests.Request)
 	}
 )
 
 // Connect connects client to api
-func ConnectWs(config *config.Config, state *state.State, log *logger.Log, messageHandler MessageHandler, ehr *ehr.Storage, eos *eos.Storage) (*Ws, error) {
+func ConnectWs(config *config.Config, state *state.State, log *logger.Log, messageHandler MessageHandler, ehr *ehr.Storage, eos ledger.Ledger) (*Ws, error) {
+	c, capabilities, err := dial(config, state, log)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Ws{conn: c, config: config, state: state, log: log, messageHandler: messageHandler, ehr: ehr, eos: eos, nonces: make(map[string]time.Time), capabilities: capabilities, calls: newCalls()}
+	messageHandler.SetWs(out)
+	state.Connected = true
+	if !state.Subscribed {
+		out.Subscribe()
+	}
+	return out, nil
+}
+
+// dial opens authorized connection to api and agrees on the protocol
+func dial(config *config.Config, state *state.State, log *logger.Log) (*websocket.Conn, requests.Capabilities, error) {
 	addr := fmt.Sprintf("ws%s/ws?token=%s", config.IryoAddr[4:], state.Token)
 	log.Debugf("WS:: Connecting to ws")
 
 	// Call API's WS
 	c, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Cookie": []string{fmt.Sprintf("token=%s", state.Token)}})
 	if err != nil {
-		return nil, err
+		return nil, requests.Capabilities{}, err
 	}
 
 	// Check if authorized
 	_, msg, err := c.ReadMessage()
 	if err != nil {
-		return nil, err
+		c.Close()
+		return nil, requests.Capabilities{}, err
 	}
-	if string(msg) == "Authorized" {
-		out := &Ws{conn: c, config: config, state: state, log: log, messageHandler: messageHandler, ehr: ehr, eos: eos}
-		messageHandler.SetWs(out)
-		if !state.Subscribed {
-			out.Subscribe()
+	if string(msg) != "Authorized" {
+		c.Close()
+		return nil, requests.Capabilities{}, fmt.Errorf("Error authorizing: %s", string(msg))
+	}
+
+	capabilities, err := handshake(c)
+	if err != nil {
+		c.Close()
+		return nil, requests.Capabilities{}, err
+	}
+	log.Debugf("WS:: Speaking protocol v%d with features %v", capabilities.Version, capabilities.Features)
+	return c, capabilities, nil
+}
+
+// clientCapabilities lists protocol versions and features client supports
+var clientCapabilities = requests.Capabilities{
+	Version:    requests.ProtocolVersion,
+	MinVersion: requests.MinProtocolVersion,
+	Features:   []string{requests.FeatureCodecJSON, requests.FeatureAcks, requests.FeatureMultiDevice},
+}
+
+// handshake sends Hello to the api and reads capabilities both sides agreed on
+func handshake(c *websocket.Conn) (requests.Capabilities, error) {
+	hello, err := requests.NewHello(clientCapabilities).Encode()
+	if err != nil {
+		return requests.Capabilities{}, err
+	}
+	if err := c.WriteMessage(websocket.BinaryMessage, hello); err != nil {
+		return requests.Capabilities{}, err
+	}
+
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			return requests.Capabilities{}, fmt.Errorf("API refused the connection: %s", closeErr.Text)
 		}
-		state.Connected = true
-		return out, nil
+		return requests.Capabilities{}, err
+	}
+	welcome, err := requests.Decode(msg)
+	if err != nil {
+		return requests.Capabilities{}, err
 	}
 
-	return nil, fmt.Errorf("Error authorizing: %s", string(msg))
+	return requests.ParseCapabilities(welcome)
+}
+
+// Capabilities returns protocol version and features negotiated with the api
+func (s *Ws) Capabilities() requests.Capabilities {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.capabilities
 }
 
 func (s *Ws) Subscribe() {
 	s.log.Debugf("WS::Subscribe called")
 
 	s.state.Subscribed = true
-	defer func() {
-		s.state.Subscribed = false
-	}()
 	go func() {
+		defer func() {
+			s.state.Subscribed = false
+		}()
 		for {
 			// Decode the message
 			r, err := s.readMessage()
@@ -90,10 +162,25 @@ func (s *Ws) Subscribe() {
 				break
 			}
 
+			// Acknowledge the message even if it's dropped, so that the api doesn't send it again
+			if deliveryID, err := r.GetDataString(requests.FieldDeliveryID); err == nil {
+				s.ack(deliveryID)
+			}
+
+			// Make sure the request was made by the user it claims to be from
+			if err := s.verify(r); err != nil {
+				s.log.Printf("SUBSCRIBE:: Dropping %s request; %v", r.Name, err)
+				continue
+			}
+
 			// Handle the request
+			var key []byte
+			var importErr error
 			switch r.Name {
 			case "ImportKey":
-				s.messageHandler.ImportKey(r)
+				if key, importErr = s.messageHandler.ImportKey(r); importErr != nil {
+					s.log.Printf("SUBSCRIBE:: Failed to import key: %v", importErr)
+				}
 
 			// Revoke key
 			// Remove all entries connected to user
@@ -115,12 +202,45 @@ func (s *Ws) Subscribe() {
 			case "RequestKey":
 				s.messageHandler.NotifyKeyRequested(r)
 
+			// Our key request was denied
+			case "DenyKey":
+				s.messageHandler.KeyDenied(r)
+
+			// Key request made to us was withdrawn
+			case "CancelKeyRequest":
+				s.messageHandler.KeyRequestCancelled(r)
+
 			case "NewUpload":
 				s.messageHandler.NewUpload(r)
 
+			// User gave up access we granted
+			case "NotifyRelinquished":
+				s.messageHandler.AccessRelinquished(r)
+
+			// Api found grant or revoke on the ledger
+			case "AccessGranted":
+				s.messageHandler.LedgerAccessGranted(r)
+			case "AccessRevoked":
+				s.messageHandler.LedgerAccessRevoked(r)
+
+			// Social recovery of master key
+			case "RecoveryInvite":
+				s.messageHandler.RecoveryInvited(r)
+			case "RecoveryAccept":
+				s.messageHandler.RecoveryAccepted(r)
+			case "StoreShare":
+				s.messageHandler.ShareStored(r)
+			case "RecoveryRequest":
+				s.messageHandler.RecoveryRequested(r)
+			case "RecoveryShare":
+				s.messageHandler.ShareReturned(r)
+
 			default:
 				s.log.Debugf("SUBSCRIPTION:: Got unknown request %v", r.Name)
 			}
+
+			// Wake up whoever is waiting for this request with the key imported from it
+			s.calls.resolve(r, key, importErr)
 		}
 	}()
 }
@@ -136,28 +256,101 @@ func (s *Ws) readMessage() (*requests.Request, error) {
 			if err2 := s.retry(2*time.Second, 5, s.Reconnect); err2 != nil {
 				return nil, err2
 			}
+			return s.readMessage()
 		}
 		return nil, err
 	}
 	return requests.Decode(message)
 }
 
+// verify checks that the request was signed by the account in its `from` field
+// and that it is not a replay of an already handled request
+func (s *Ws) verify(r *requests.Request) error {
+	if !requests.RequiresSignature(r.Name) {
+		return nil
+	}
+
+	from, err := r.GetDataString("from")
+	if err != nil {
+		return err
+	}
+	nonce, signedAt, err := r.Nonce(s.config.WsMessageMaxAge)
+	if err != nil {
+		return err
+	}
+
+	// Check the signature against keys stored on the blockchain
+	key, err := r.SignerKey(s.state.Sender())
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if r.Name == "RecoveryRequest" {
+		// Device recovering an account has no account, it's known by its recovery key
+		ok = key.String() == from
+	} else if ok, err = s.eos.CheckAccountKey(from, key.String()); err != nil {
+		return fmt.Errorf("failed to check %s's keys; %v", from, err)
+	}
+	if !ok {
+		return fmt.Errorf("request is not signed by %s", from)
+	}
+
+	// Forget nonces of requests that would be rejected as expired anyway
+	for id, ts := range s.nonces {
+		if time.Since(ts) > s.config.WsMessageMaxAge {
+			delete(s.nonces, id)
+		}
+	}
+	id := from + ":" + nonce
+	if _, ok := s.nonces[id]; ok {
+		return fmt.Errorf("request %s from %s was already handled", nonce, from)
+	}
+	s.nonces[id] = signedAt
+
+	return nil
+}
+
+// ack tells the api the message with `deliveryID` was received
+func (s *Ws) ack(deliveryID string) {
+	ack, err := requests.NewAck(deliveryID).Encode()
+	if err == nil {
+		err = s.WriteMessage(websocket.BinaryMessage, ack)
+	}
+	if err != nil {
+		s.log.Printf("SUBSCRIBE:: Failed to acknowledge message %s: %v", deliveryID, err)
+	}
+}
+
+// WriteMessage writes to the api connection, it's safe for concurrent use
+func (s *Ws) WriteMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.conn.WriteMessage(messageType, data)
+}
+
 func (s *Ws) Close() error {
 	s.log.Debugf("WS:: Closing connection")
-	return s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return s.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 }
 
 func (s *Ws) Conn() *websocket.Conn {
 	return s.conn
 }
 
+// Reconnect replaces the connection to the api. Pending calls and nonces of handled requests
+// are kept, so calls made before are answered over the new connection and replays are still dropped
 func (s *Ws) Reconnect() error {
-	temp, err := ConnectWs(s.config, s.state, s.log, s.messageHandler, s.ehr, s.eos)
+	c, capabilities, err := dial(s.config, s.state, s.log)
 	if err != nil {
 		return err
 	}
 
-	s.conn = temp.conn
+	s.writeMu.Lock()
+	s.conn = c
+	s.capabilities = capabilities
+	s.writeMu.Unlock()
+	s.state.Connected = true
 	return nil
 }
 
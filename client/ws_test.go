@@ -0,0 +1,132 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/requests"
+	"github.com/iryonetwork/network-poc/state"
+	"github.com/iryonetwork/network-poc/storage/ehr"
+	"github.com/iryonetwork/network-poc/storage/ledger"
+)
+
+// handshakeAPI authorizes every ws connection, agrees on the protocol and passes
+// the connection to conns and requests it receives to sent
+func handshakeAPI(t *testing.T, conns chan<- *websocket.Conn, sent chan<- *requests.Request) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.BinaryMessage, []byte("Authorized"))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		welcome, _ := requests.NewWelcome(clientCapabilities).Encode()
+		conn.WriteMessage(websocket.BinaryMessage, welcome)
+		conns <- conn
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if req, err := requests.Decode(msg); err == nil {
+				sent <- req
+			}
+		}
+	}))
+}
+
+func newTestState(t *testing.T, cfg *config.Config) *state.State {
+	st, err := state.New(cfg, logger.New(cfg))
+	if err != nil {
+		t.Fatalf("state.New failed: %v", err)
+	}
+	if err := st.NewMnemonicKey(); err != nil {
+		t.Fatalf("NewMnemonicKey failed: %v", err)
+	}
+	return st
+}
+
+func TestReconnectKeepsCalls(t *testing.T) {
+	conns := make(chan *websocket.Conn, 2)
+	sent := make(chan *requests.Request, 10)
+	api := handshakeAPI(t, conns, sent)
+	defer api.Close()
+
+	cfg := &config.Config{EosAccount: "doctor1.iryo", IryoAddr: api.URL, WsMessageMaxAge: time.Hour}
+	log := logger.New(cfg)
+	doctor := newTestState(t, cfg)
+	patient := newTestState(t, &config.Config{EosAccount: "patient.iryo"})
+	l := ledger.NewMemory(doctor, "", log)
+	for _, st := range []*state.State{doctor, patient} {
+		if err := l.CreateAccount(st.EosAccount, st.GetEosPublicKey()); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+	}
+
+	storage := ehr.New()
+	handler := NewMessageHandler(doctor, storage, l, log)
+	ws, err := ConnectWs(cfg, doctor, log, handler, storage, l)
+	if err != nil {
+		t.Fatalf("ConnectWs failed: %v", err)
+	}
+	request := requests.NewRequests(log, cfg, doctor, ws, l)
+	handler.SetRequests(request)
+	first := <-conns
+
+	// Call is made before the connection drops
+	correlationID := "call1"
+	answer := ws.calls.expect(correlationID, "patient.iryo")
+	first.Close()
+	var second *websocket.Conn
+	select {
+	case second = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected client to reconnect")
+	}
+
+	deny := requests.NewReq("DenyKey")
+	deny.Append("to", "doctor1.iryo")
+	deny.Append("reason", "not now")
+	deny.Append(requests.FieldCorrelationID, correlationID)
+	if err := deny.Sign("patient.iryo", "doctor1.iryo", ledger.NewMemory(patient, "", log).SignHash); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	msg, _ := requests.Relay(deny, "patient.iryo").Encode()
+	second.WriteMessage(websocket.BinaryMessage, msg)
+
+	select {
+	case a := <-answer:
+		if reason, _ := a.request.GetDataString("reason"); a.request.Name != "DenyKey" || reason != "not now" {
+			t.Errorf("Expected the call made before reconnect to be denied, got %s", a.request.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the call made before reconnect to be answered")
+	}
+
+	// Requests are written to the new connection
+	if err := request.CancelKeyRequest("patient.iryo", ""); err != nil {
+		t.Fatalf("CancelKeyRequest failed: %v", err)
+	}
+	for {
+		select {
+		case r := <-sent:
+			if r.Name != "CancelKeyRequest" {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected CancelKeyRequest to be sent over the new connection")
+		}
+		break
+	}
+}
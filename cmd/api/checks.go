@@ -7,6 +7,8 @@ import (
 	"strings"
 
 	"github.com/eoscanada/eos-go/ecc"
+
+	"github.com/iryonetwork/network-poc/storage/ledger"
 )
 
 func (s *storage) checkSignature(keystr, signature string, data []byte) (int, error) {
@@ -41,13 +43,13 @@ func getHash(in []byte) []byte {
 	return sha.Sum(nil)
 }
 
-// Verify that accounts have all the permissions needed to work with eachother
+// Verify that accounts have all the permissions needed to upload owner's data
 func (s *storage) checkEOSAccountConnections(account, owner, key string) (int, error) {
 	if code, err := s.checkKeyAndID(account, key); err != nil {
 		return code, err
 	}
 
-	return s.checkAccessGranted(owner, account)
+	return s.checkAccessGranted(owner, account, true)
 }
 
 // Verifies that account and key are connected
@@ -67,7 +69,9 @@ func (s *storage) checkKeyAndID(id, key string) (int, error) {
 	return 200, nil
 }
 
-func (s *storage) checkAccessGranted(owner, account string) (int, error) {
+// checkAccessGranted verifies that owner granted account permission to write their data if `write` is set,
+// to read it otherwise
+func (s *storage) checkAccessGranted(owner, account string, write bool) (int, error) {
 	if code, err := s.checkAccountExists(owner); err != nil {
 		return code, err
 	}
@@ -75,11 +79,59 @@ func (s *storage) checkAccessGranted(owner, account string) (int, error) {
 		return code, err
 	}
 
-	if ok, err := s.eos.AccessGranted(owner, account); err != nil {
+	permissions, err := s.eos.Permissions(owner, account)
+	if err != nil {
 		s.log.Printf("Error checking connection; %+v", err)
 		return 500, fmt.Errorf("Internal server error")
-	} else if !ok {
+	}
+	switch {
+	case permissions == 0:
 		return 403, fmt.Errorf("You don't have patient's permission to access the data")
+	case write && !permissions.Has(ledger.PermissionWrite):
+		return 403, fmt.Errorf("You don't have patient's permission to upload the data")
+	case !write && !permissions.CanRead():
+		return 403, fmt.Errorf("You don't have patient's permission to read the data")
+	}
+	return 200, nil
+}
+
+// auditEmergency records read of owner's data by account that is allowed to read it only in emergency,
+// so the patient can see who used the emergency access
+func (s *storage) auditEmergency(owner, account, document string) {
+	permissions, err := s.eos.Permissions(owner, account)
+	if err != nil || permissions.Has(ledger.PermissionRead) {
+		return
+	}
+
+	s.log.Printf("Emergency access of %s to %s's %s", account, owner, document)
+	if err := s.db.AddAudit(owner, account, document); err != nil {
+		s.log.Printf("Error adding audit entry; %v", err)
+	}
+}
+
+// checkOwner verifies that account is the owner, only the owner holds the key data keys are wrapped with
+func (s *storage) checkOwner(owner, account string) (int, error) {
+	if account != owner {
+		return 403, fmt.Errorf("Only %s can replace keys of their files", owner)
+	}
+	return 200, nil
+}
+
+// checkAuthor verifies that account may replace owner's file, only the owner and the author of the file can
+func (s *storage) checkAuthor(owner, account, fid string) (int, error) {
+	if account == owner {
+		return 200, nil
+	}
+	author, err := s.db.GetAuthor(owner, fid)
+	if err != nil {
+		s.log.Printf("Error getting author of %s/%s; %+v", owner, fid, err)
+		return 500, fmt.Errorf("Internal server error")
+	}
+	if author == "" {
+		return 403, fmt.Errorf("Author of file %s is not known, only %s can replace it", fid, owner)
+	}
+	if author != account {
+		return 403, fmt.Errorf("File %s was uploaded by %s, only they or %s can replace it", fid, author, owner)
 	}
 	return 200, nil
 }
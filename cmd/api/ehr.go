@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"mime/multipart"
@@ -10,12 +11,96 @@ import (
 	"github.com/gofrs/uuid"
 )
 
-func (s *storage) saveFileWithChecks(owner, account, key, signature string, file multipart.File, header *multipart.FileHeader, reuploadFid string) (fid string, ts string, code int, err error) {
+func (s *storage) saveFileWithChecks(owner, account, key, signature string, file multipart.File, header *multipart.FileHeader, reuploadFid, dataKey, dataKeySignature string) (fid string, ts string, code int, err error) {
 	if code, err = s.checkEOSAccountConnections(account, owner, key); err != nil {
 		return "", "", code, err
 	}
+	if reuploadFid != "" {
+		if code, err = s.checkAuthor(owner, account, reuploadFid); err != nil {
+			return "", "", code, err
+		}
+	}
+
+	// verify data key before the file is saved
+	var keyData []byte
+	if dataKey != "" {
+		if keyData, code, err = s.getDataKey(key, dataKeySignature, dataKey); err != nil {
+			return "", "", code, err
+		}
+	}
+
+	fid, ts, code, err = s.saveFile(owner, account, key, signature, file, header, reuploadFid)
+	if err != nil {
+		return fid, ts, code, err
+	}
+	// Author is recorded on first upload, so that other grantees can't replace the file
+	if reuploadFid == "" {
+		if err := s.db.SetAuthor(owner, fid, account); err != nil {
+			s.log.Printf("Failed to record author of %s. Error: %+v", fid, err)
+			return "", "", 500, fmt.Errorf("Failed to record author of the file")
+		}
+	}
+	if keyData == nil {
+		return fid, ts, code, err
+	}
+
+	code, err = s.writeDataKey(owner, fid, keyData)
+	return fid, ts, code, err
+}
+
+// saveDataKeyWithChecks replaces wrapped data key of existing file
+func (s *storage) saveDataKeyWithChecks(owner, account, key, signature, dataKey, fid string) (int, error) {
+	if code, err := s.checkEOSAccountConnections(account, owner, key); err != nil {
+		return code, err
+	}
+	// Grantees could make the file unreadable by replacing its key
+	if code, err := s.checkOwner(owner, account); err != nil {
+		return code, err
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/%s/%s/%s", s.config.StoragePath, "ehr", owner, fid)); os.IsNotExist(err) {
+		return 404, fmt.Errorf("File %s not found, cannot replace its key", fid)
+	}
+
+	keyData, code, err := s.getDataKey(key, signature, dataKey)
+	if err != nil {
+		return code, err
+	}
+
+	return s.writeDataKey(owner, fid, keyData)
+}
+
+// getDataKey decodes base64 encoded data key and verifies its signature
+func (s *storage) getDataKey(keystr, signature, dataKey string) ([]byte, int, error) {
+	data, err := base64.StdEncoding.DecodeString(dataKey)
+	if err != nil {
+		return nil, 400, fmt.Errorf("Data key is not base64 encoded")
+	}
+	if code, err := s.checkSignature(keystr, signature, data); err != nil {
+		return nil, code, err
+	}
+	return data, 200, nil
+}
+
+func (s *storage) writeDataKey(owner, fid string, data []byte) (int, error) {
+	os.MkdirAll(fmt.Sprintf("%s/%s/%s", s.config.StoragePath, "ehr-keys", owner), os.ModePerm)
 
-	return s.saveFile(owner, account, key, signature, file, header, reuploadFid)
+	err := ioutil.WriteFile(fmt.Sprintf("%s/%s/%s/%s", s.config.StoragePath, "ehr-keys", owner, fid), data, 0600)
+	if err != nil {
+		s.log.Printf("Failed to save data key. Error: %+v", err)
+		return 500, fmt.Errorf("Failed to save data key")
+	}
+	s.log.Debugf("Data key for %s saved", fid)
+	return 201, nil
+}
+
+// readDataKey returns base64 encoded wrapped data key of the file,
+// or empty string if file does not have one
+func (s *storage) readDataKey(owner, fid string) string {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/%s/%s", s.config.StoragePath, "ehr-keys", owner, fid))
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
 }
 func (s *storage) saveFile(owner, account, key, signature string, file multipart.File, header *multipart.FileHeader, reuploadFid string) (fid string, ts string, code int, err error) {
 	if reuploadFid != "" {
@@ -24,7 +109,7 @@ func (s *storage) saveFile(owner, account, key, signature string, file multipart
 		}
 		fid = reuploadFid
 	} else {
-		fid, code, err = s.getFilename(header)
+		fid, code, err = s.getFilename(owner, header)
 		if err != nil {
 			return "", "", code, err
 		}
@@ -57,7 +142,16 @@ func (s *storage) saveFile(owner, account, key, signature string, file multipart
 	return
 }
 
-func (s *storage) getFilename(header *multipart.FileHeader) (fid string, code int, err error) {
+func (s *storage) getFilename(owner string, header *multipart.FileHeader) (fid string, code int, err error) {
+	// Keep the ID proposed by the client, it is bound into the encrypted document
+	if proposed, err := uuid.FromString(header.Filename); err == nil && proposed.Version() == uuid.V1 {
+		fid = proposed.String()
+		if _, err := os.Stat(fmt.Sprintf("%s/%s/%s/%s", s.config.StoragePath, "ehr", owner, fid)); !os.IsNotExist(err) {
+			return "", 409, fmt.Errorf("File %s already exists", fid)
+		}
+		return fid, 200, nil
+	}
+
 	uuid, err := uuid.NewV1()
 	if err != nil {
 		s.log.Printf("Failed to create filename")
@@ -107,6 +201,8 @@ type lsResponse struct {
 type lsFile struct {
 	FileID    string `json:"fileID,omitempty"`
 	CreatedAt string `json:"createdAt,omitempty"`
+	DataKey   string `json:"dataKey,omitempty"`
+	Author    string `json:"author,omitempty"`
 }
 
 func (s *storage) listFiles(account string) (*lsResponse, int, error) {
@@ -123,7 +219,11 @@ func (s *storage) listFiles(account string) (*lsResponse, int, error) {
 			if err != nil {
 				return out, code, err
 			}
-			out.Files = append(out.Files, lsFile{fn, ts})
+			author, err := s.db.GetAuthor(account, fn)
+			if err != nil {
+				s.log.Debugf("Error getting author of %s; %+v", fn, err)
+			}
+			out.Files = append(out.Files, lsFile{fn, ts, s.readDataKey(account, fn), author})
 		}
 		if len(out.Files) == 0 {
 			return out, 404, fmt.Errorf("404 no files found for account %s", account)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -10,13 +11,14 @@ import (
 	"github.com/iryonetwork/network-poc/db"
 	"github.com/iryonetwork/network-poc/logger"
 	"github.com/iryonetwork/network-poc/state"
-	"github.com/iryonetwork/network-poc/storage/eos"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 	"github.com/iryonetwork/network-poc/storage/token"
 	"github.com/iryonetwork/network-poc/storage/ws/hub"
 )
 
 type handlers struct {
-	eos    *eos.Storage
+	eos    ledger.Ledger
+	acl    *ledger.Cache
 	hub    *hub.Hub
 	token  *token.TokenList
 	config *config.Config
@@ -115,7 +117,7 @@ func (h *handlers) uploadHandler(w http.ResponseWriter, r *http.Request, fid str
 	}
 
 	// Save the file
-	fid, ts, code, err := funcs.saveFileWithChecks(owner, account, key, r.FormValue("sign"), file, header, fid)
+	fid, ts, code, err := funcs.saveFileWithChecks(owner, account, key, r.FormValue("sign"), file, header, fid, r.FormValue("dataKey"), r.FormValue("dataKeySign"))
 	if err != nil {
 		h.writeErrorJson(w, code, err.Error())
 		return
@@ -131,6 +133,34 @@ func (h *handlers) uploadHandler(w http.ResponseWriter, r *http.Request, fid str
 	json.NewEncoder(w).Encode(response)
 }
 
+// dataKeyHandler replaces wrapped data key of a file without reuploading the file
+func (h *handlers) dataKeyHandler(w http.ResponseWriter, r *http.Request) {
+	funcs := storage{h}
+
+	params := mux.Vars(r)
+	owner := params["account"]
+	fid := params["fid"]
+
+	// Authorize the user
+	token := r.Header.Get("Authorization")
+	account, code, err := funcs.tokenValidateGetName(token)
+	if err != nil {
+		h.writeErrorJson(w, code, err.Error())
+		return
+	}
+
+	r.ParseForm()
+	code, err = funcs.saveDataKeyWithChecks(owner, account, r.PostForm.Get("key"), r.PostForm.Get("sign"), r.PostForm.Get("dataKey"), fid)
+	if err != nil {
+		h.writeErrorJson(w, code, err.Error())
+		return
+	}
+
+	h.log.Debugf("API:: Data key of %s replaced", fid)
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(uploadResponse{FileID: fid})
+}
+
 func (h *handlers) lsHandler(w http.ResponseWriter, r *http.Request) {
 	funcs := storage{h}
 
@@ -145,10 +175,11 @@ func (h *handlers) lsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if code, err = funcs.checkAccessGranted(owner, account); err != nil {
+	if code, err = funcs.checkAccessGranted(owner, account, false); err != nil {
 		h.writeErrorJson(w, code, err.Error())
 		return
 	}
+	funcs.auditEmergency(owner, account, "list of files")
 	response, code, err := funcs.listFiles(owner)
 	if err != nil {
 		h.writeErrorJson(w, code, err.Error())
@@ -169,10 +200,11 @@ func (h *handlers) downloadHandler(w http.ResponseWriter, r *http.Request) {
 	token := r.Header.Get("Authorization")
 	account, code, err := funcs.tokenValidateGetName(token)
 	// make sure connected has access to data
-	if code, err := funcs.checkAccessGranted(owner, account); err != nil {
+	if code, err := funcs.checkAccessGranted(owner, account, false); err != nil {
 		h.writeErrorBody(w, code, err.Error())
 		return
 	}
+	funcs.auditEmergency(owner, account, fid)
 	f, code, err := funcs.readFileData(owner, fid)
 	if err != nil {
 		h.writeErrorBody(w, code, err.Error())
@@ -183,6 +215,31 @@ func (h *handlers) downloadHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// auditHandler lists reads of owner's documents made with emergency permission, only the owner can see it
+func (h *handlers) auditHandler(w http.ResponseWriter, r *http.Request) {
+	funcs := storage{h}
+
+	owner := mux.Vars(r)["account"]
+	token := r.Header.Get("Authorization")
+	account, code, err := funcs.tokenValidateGetName(token)
+	if err != nil {
+		h.writeErrorJson(w, code, err.Error())
+		return
+	}
+	if account != owner {
+		h.writeErrorJson(w, 403, fmt.Sprintf("Only %s can read their audit log", owner))
+		return
+	}
+
+	entries, err := h.db.GetAudit(owner)
+	if err != nil {
+		h.log.Printf("Error reading audit log; %v", err)
+		h.writeErrorJson(w, 500, "Internal server error")
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
 func (h *handlers) createaccHandler(w http.ResponseWriter, r *http.Request) {
 	funcs := storage{h}
 
@@ -222,7 +279,7 @@ func (h *handlers) accountToIDHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if code, err = funcs.checkAccessGranted(owner, account); err != nil {
+	if code, err = funcs.checkAccessGranted(owner, account, false); err != nil {
 		h.writeErrorJson(w, code, err.Error())
 		return
 	}
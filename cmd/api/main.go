@@ -3,6 +3,7 @@ package main
 import (
 	stdlog "log"
 	"net/http"
+	"time"
 
 	"github.com/iryonetwork/network-poc/db"
 
@@ -14,7 +15,7 @@ import (
 	"github.com/iryonetwork/network-poc/config"
 	"github.com/iryonetwork/network-poc/logger"
 	"github.com/iryonetwork/network-poc/state"
-	"github.com/iryonetwork/network-poc/storage/eos"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 	"github.com/rs/cors"
 )
 
@@ -33,14 +34,20 @@ func main() {
 	}
 	defer state.Close()
 
-	eos, err := eos.New(config, state, log)
+	l, err := ledger.Open(config, state, log)
 	if err != nil {
-		log.Fatalf("Erorr creating eos storage; %v", err)
+		log.Fatalf("Erorr creating ledger; %v", err)
 	}
-	eos.ImportKey(state.EosPrivate)
+	l.ImportKey(state.EosPrivate)
+	// ACL lookups are cached, entries are invalidated when grant or revoke is relayed
+	acl := ledger.NewCache(l, config.ACLCacheTTL)
+	go func() {
+		for range time.Tick(config.ACLCacheTTL) {
+			acl.Expire()
+		}
+	}()
 
 	hub := hub.NewHub(log)
-	go hub.Run()
 
 	db, err := db.Init(config, log)
 	if err != nil {
@@ -51,23 +58,32 @@ func main() {
 	h := &handlers{
 		hub:    hub,
 		token:  token.Init(log),
-		eos:    eos,
+		eos:    acl,
+		acl:    acl,
 		state:  state,
 		config: config,
 		log:    log,
 		db:     db,
 	}
+
+	// Clients are notified about grants and revokes found on the chain
+	if w, ok := l.(ledger.Watcher); ok && config.WatcherInterval > 0 {
+		go (&watcher{wsStruct{h}, w}).run(config.WatcherInterval)
+	}
+
 	router := mux.NewRouter()
 
 	router.HandleFunc("/login", h.loginHandler).Methods("POST")
 	router.HandleFunc("/ws", h.wsHandler)
 	router.HandleFunc("/account", h.createaccHandler).Methods("POST")
 	router.HandleFunc("/{account}/id", h.accountToIDHandler).Methods("GET")
+	router.HandleFunc("/{account}/audit", h.auditHandler).Methods("GET")
 	router.HandleFunc("/{account}", h.lsHandler).Methods("GET")
 	router.HandleFunc("/{account}/{fid}", h.downloadHandler).Methods("GET")
 	router.HandleFunc("/{account}/{fid}", func(w http.ResponseWriter, r *http.Request) {
 		h.uploadHandler(w, r, mux.Vars(r)["fid"])
 	}).Methods("PUT")
+	router.HandleFunc("/{account}/{fid}/key", h.dataKeyHandler).Methods("PUT")
 	router.HandleFunc("/{account}", func(w http.ResponseWriter, r *http.Request) {
 		h.uploadHandler(w, r, "")
 	}).Methods("POST")
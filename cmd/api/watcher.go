@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/iryonetwork/network-poc/requests"
+	"github.com/iryonetwork/network-poc/storage/ledger"
+)
+
+// watcher follows grants and revokes written to the ledger and notifies both parties,
+// so that clients don't depend on the patient's client to tell them
+type watcher struct {
+	wsStruct
+	ledger ledger.Watcher
+}
+
+// run reads new blocks every `interval`, starting after the block in the db cursor.
+// When there is no cursor yet, watching starts at the current block
+func (w *watcher) run(interval time.Duration) {
+	cursor, err := w.db.GetCursor()
+	if err != nil {
+		w.log.Printf("WATCHER:: Error reading cursor; %v", err)
+		return
+	}
+	if cursor == 0 {
+		if cursor, err = w.ledger.LastIrreversibleBlock(); err != nil {
+			w.log.Printf("WATCHER:: Error getting last block; %v", err)
+		}
+	}
+	w.log.Debugf("WATCHER:: Watching blocks after %d", cursor)
+
+	for {
+		cursor = w.follow(cursor)
+		time.Sleep(interval)
+	}
+}
+
+// follow handles blocks after `cursor` up to the last irreversible one and returns the new cursor.
+// Block that could not be read is read again on the next call
+func (w *watcher) follow(cursor uint32) uint32 {
+	last, err := w.ledger.LastIrreversibleBlock()
+	if err != nil {
+		w.log.Printf("WATCHER:: Error getting last block; %v", err)
+		return cursor
+	}
+	if cursor == 0 || cursor >= last {
+		return last
+	}
+
+	start := cursor
+	for cursor < last {
+		events, err := w.ledger.AccessEvents(cursor + 1)
+		if err != nil {
+			w.log.Printf("WATCHER:: Error reading block %d; %v", cursor+1, err)
+			break
+		}
+		cursor++
+		for _, event := range events {
+			w.notify(event)
+		}
+	}
+
+	if cursor != start {
+		if err := w.db.SetCursor(cursor); err != nil {
+			w.log.Printf("WATCHER:: Error saving cursor; %v", err)
+		}
+	}
+	return cursor
+}
+
+// notify sends AccessGranted or AccessRevoked to the patient and the grantee
+func (w *watcher) notify(event ledger.AccessEvent) {
+	w.acl.Invalidate(event.Patient, event.Account)
+
+	var r *requests.Request
+	if event.Granted {
+		r = requests.NewReq("AccessGranted")
+		r.Append("permissions", event.Permissions.String())
+		if !event.Expires.IsZero() {
+			r.Append("expires", strconv.FormatInt(event.Expires.Unix(), 10))
+		}
+	} else {
+		r = requests.NewReq("AccessRevoked")
+	}
+	r.Append("patient", event.Patient)
+	r.Append("account", event.Account)
+
+	w.log.Debugf("WATCHER:: Sending %s of %s to %s", r.Name, event.Patient, event.Account)
+	for _, to := range []string{event.Patient, event.Account} {
+		if err := w.sendRequest(r, to); err != nil {
+			w.log.Printf("WATCHER:: Error sending %s to %s; %v", r.Name, to, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/iryonetwork/network-poc/requests"
@@ -11,43 +12,64 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-func (s *wsStruct) HandleRequest(reqdata []byte, from string, db *db.Db) error {
+// HandleRequest handles request sent by `from`, which is a public key if the sender has no `account`
+func (s *wsStruct) HandleRequest(c *websocket.Conn, reqdata []byte, from string, account bool, db *db.Db) error {
 	inReq, err := requests.Decode(reqdata)
 	if err != nil {
 		return err
 	}
-	customData, _ := inReq.GetDataString("customData")
+
+	// Client received the message, it doesn't have to be sent again
+	if inReq.Name == "Ack" {
+		deliveryID, err := inReq.GetDataString(requests.FieldDeliveryID)
+		if err != nil {
+			return err
+		}
+		return s.hub.Ack(c, from, deliveryID)
+	}
 
 	s.log.Debugf("WS_API:: Got request: %s", inReq.Name)
 	var r *requests.Request
 
+	// Device without account can only ask trustees to return shares bound to its recovery key
+	if !account && inReq.Name != "RecoveryRequest" {
+		return fmt.Errorf("%s without account can't send %s", from, inReq.Name)
+	}
+
+	// Requests are relayed with all fields intact,
+	// so that the recipient can verify the sender's signature
 	switch inReq.Name {
 	case "SendKey":
 		s.log.Debugf("WS_API:: Sending key")
-		r = requests.NewReq("ImportKey")
-		key, err := inReq.GetDataString("key")
-		if err != nil {
+		if _, err := inReq.GetDataString("key"); err != nil {
 			return err
 		}
 		name, err := db.GetName(from)
 		if err != nil {
 			return err
 		}
+		r = requests.Relay(inReq, from)
 		r.Append("name", name)
-		r.Append("key", key)
-		r.Append("from", from)
-		if customData != "" {
-			r.Append("customData", customData)
-		}
 
 	case "RevokeKey":
 		s.log.Debugf("WS_API:: Revoking key")
-		r = requests.NewReq("RevokeKey")
-		r.Append("from", (from))
+		r = requests.Relay(inReq, from)
+
+	case "NotifyRelinquished":
+		s.log.Debugf("WS_API:: Got access relinquished notification from %s", from)
+		r = requests.Relay(inReq, from)
+
+	case "DenyKey":
+		s.log.Debugf("WS_API:: Denying key request")
+		r = requests.Relay(inReq, from)
+
+	case "CancelKeyRequest":
+		s.log.Debugf("WS_API:: Cancelling key request")
+		r = requests.Relay(inReq, from)
 
 	case "RequestKey":
 		s.log.Debugf("WS_API:: Requesting key")
-		err := s.requestKey(inReq, from, db)
+		err := s.requestKey(c, inReq, from, db)
 		return err
 
 	case "Reencrypt":
@@ -61,12 +83,13 @@ func (s *wsStruct) HandleRequest(reqdata []byte, from string, db *db.Db) error {
 		if err != nil {
 			return err
 		}
-		r = requests.NewReq("NotifyGranted")
-		r.Append("from", (from))
-		r.Append("name", (name))
-		if customData != "" {
-			r.Append("customData", customData)
-		}
+		r = requests.Relay(inReq, from)
+		r.Append("name", name)
+
+	// Shares are sealed for the recipient, api only relays them
+	case "RecoveryInvite", "RecoveryAccept", "StoreShare", "RecoveryRequest", "RecoveryShare":
+		s.log.Debugf("WS_API:: Relaying %s from %s", inReq.Name, from)
+		r = requests.Relay(inReq, from)
 
 	default:
 		s.log.Debugf("Recieved an invalid request")
@@ -78,6 +101,12 @@ func (s *wsStruct) HandleRequest(reqdata []byte, from string, db *db.Db) error {
 	if err != nil {
 		return err
 	}
+	// Shares are returned to the device recovering the key, which is known by its recovery key
+	if inReq.Name == "RecoveryShare" {
+		if _, err := ecc.NewPublicKey(sendTo); err == nil {
+			return s.sendRequest(r, sendTo)
+		}
+	}
 	// Check if reciever exists
 	if !s.eos.CheckAccountExists(sendTo) {
 		s.log.Debugf("User %s does not exists, trashing the request", sendTo)
@@ -87,31 +116,9 @@ func (s *wsStruct) HandleRequest(reqdata []byte, from string, db *db.Db) error {
 	return s.sendRequest(r, sendTo)
 }
 
+// sendRequest sends the request to all devices of user `to`, it's sent when they connect if they are offline
 func (s *wsStruct) sendRequest(r *requests.Request, to string) error {
-	// Encode
-	req, err := r.Encode()
-	if err != nil {
-		return err
-	}
-
-	// handle sending
-	// send if user is connected
-	if s.hub.Connected(to) {
-		// get connection
-		conn, err := s.hub.GetConn(to)
-		if err != nil {
-			return err
-		}
-		// send
-		conn.WriteMessage(websocket.BinaryMessage, req)
-	} else {
-		s.log.Debugf("User %s not connected, can't send message. Message will be sent when connented", to)
-		// user is not connected, add the request to storage
-		s.hub.AddRequest(to, req)
-		return nil
-	}
-	return nil
-
+	return s.hub.Send(to, r)
 }
 
 func (s *wsStruct) reencrypt(r *requests.Request, from string) error {
@@ -121,51 +128,49 @@ func (s *wsStruct) reencrypt(r *requests.Request, from string) error {
 		return err
 	}
 	// Construct request
-	r = requests.NewReq("Reencrypt")
-	r.Append("from", (from))
-	req, err := r.Encode()
-	if err != nil {
-		return err
-	}
+	r = requests.Relay(r, from)
 
 	// Send to all connected users
 	for _, to := range sendTo {
-		if s.hub.Connected(to) {
-			conn, err := s.hub.GetConn(to)
-			if err != nil {
-				return err
-			}
-			err = conn.WriteMessage(websocket.BinaryMessage, req)
-		} else {
-			s.log.Debugf("User %s not connected, can't send message. Message will be sent when connented", to)
-			s.hub.AddRequest(to, req)
+		if e := s.sendRequest(r, to); e != nil {
+			err = e
 		}
 	}
 	return err
 }
 
-func (s *wsStruct) requestKey(r *requests.Request, from string, db *db.Db) error {
-	// Get the data in request
-	rsakey, err := r.GetData("key")
+func (s *wsStruct) requestKey(c *websocket.Conn, r *requests.Request, from string, db *db.Db) error {
+	// Get the data in request, signature is made over RSA key if it was sent, over X25519 key otherwise
+	key, err := r.GetData("key")
 	if err != nil {
-		return err
+		if key, err = r.GetData(requests.FieldX25519Key); err != nil {
+			return err
+		}
 	}
 	sign, err := r.GetDataString("signature")
 	if err != nil {
 		return err
 	}
 
-	// ignore error if not set
-	customData, _ := r.GetDataString("customData")
+	// X25519 key sent along RSA key is signed on its own
+	if x25519key, err := r.GetData(requests.FieldX25519Key); err == nil && !bytes.Equal(x25519key, key) {
+		x25519Sign, err := r.GetDataString(requests.FieldX25519Signature)
+		if err != nil {
+			return err
+		}
+		if valid, err := s.verifyRequestKeyRequest(x25519Sign, from, x25519key); !valid || err != nil {
+			if err == nil {
+				err = fmt.Errorf("X25519 key signature is not valid")
+			}
+			return err
+		}
+	}
 
 	// verify it
-	if valid, err := s.verifyRequestKeyRequest(sign, from, rsakey); !valid || err != nil {
-		conn, err2 := s.hub.GetConn(from)
-		if err2 != nil {
+	if valid, err := s.verifyRequestKeyRequest(sign, from, key); !valid || err != nil {
+		if err2 := s.hub.Reply(c, from, []byte("Problem verifying your request")); err2 != nil {
 			return err2
 		}
-
-		conn.WriteMessage(websocket.BinaryMessage, []byte("Problem verifying your request"))
 		return err
 	}
 
@@ -180,19 +185,15 @@ func (s *wsStruct) requestKey(r *requests.Request, from string, db *db.Db) error
 		return err
 	}
 
-	r.Remove("to")
-	r.Append("from", from)
+	r = requests.Relay(r, from)
 	r.Append("name", name)
-	if customData != "" {
-		r.Append("customData", customData)
-	}
 	s.sendRequest(r, sendto)
 
 	return nil
 }
 
-func (s *wsStruct) verifyRequestKeyRequest(signature, from string, rsakey []byte) (bool, error) {
-	eoskey, err := requestGetKeyFromSignature(signature, rsakey)
+func (s *wsStruct) verifyRequestKeyRequest(signature, from string, key []byte) (bool, error) {
+	eoskey, err := requestGetKeyFromSignature(signature, key)
 	if err != nil {
 		return false, err
 	}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/iryonetwork/network-poc/requests"
@@ -45,11 +47,22 @@ func (h *handlers) wsHandler(w http.ResponseWriter, r *http.Request) {
 		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Unatuhorized"))
 		return
 	}
+	// Device recovering a key logs in with its recovery key instead of an account
+	account := h.token.IsAccount(token)
 	h.log.Debugf("Token ok")
 	c.WriteMessage(websocket.BinaryMessage, []byte("Authorized"))
 
+	// Agree on protocol version and features
+	capabilities, err := ws.handshake(c)
+	if err != nil {
+		h.log.Debugf("Handshake with %s failed: %v", user, err)
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(requests.CloseIncompatibleProtocol, err.Error()))
+		return
+	}
+	h.log.Debugf("%s speaks protocol v%d with features %v", user, capabilities.Version, capabilities.Features)
+
 	// Add user to hub
-	h.hub.Register(c, user)
+	h.hub.Register(c, user, capabilities)
 	defer h.hub.Unregister(c, user)
 
 	for {
@@ -62,17 +75,59 @@ func (h *handlers) wsHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			break
 		}
-		err = ws.HandleRequest(message, user, h.db)
+		err = ws.HandleRequest(c, message, user, account, h.db)
 		if err != nil {
 			h.log.Debugf("Error HandlingRequest: %v", err)
 		}
 	}
 }
 
+// serverCapabilities lists protocol versions and features api supports
+var serverCapabilities = requests.Capabilities{
+	Version:    requests.ProtocolVersion,
+	MinVersion: requests.MinProtocolVersion,
+	Features:   []string{requests.FeatureCodecJSON, requests.FeatureAcks, requests.FeatureMultiDevice},
+}
+
+// how long to wait for client's Hello
+const helloTimeout = 10 * time.Second
+
+// handshake reads client's Hello and responds with negotiated capabilities
+func (s *wsStruct) handshake(c *websocket.Conn) (requests.Capabilities, error) {
+	c.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		return requests.Capabilities{}, fmt.Errorf("Hello not received")
+	}
+	hello, err := requests.Decode(message)
+	if err != nil || hello.Name != "Hello" {
+		return requests.Capabilities{}, fmt.Errorf("Expected Hello")
+	}
+	client, err := requests.ParseCapabilities(hello)
+	if err != nil {
+		return requests.Capabilities{}, err
+	}
+
+	negotiated, err := requests.Negotiate(client, serverCapabilities)
+	if err != nil {
+		return requests.Capabilities{}, err
+	}
+
+	welcome, err := requests.NewWelcome(negotiated).Encode()
+	if err != nil {
+		return requests.Capabilities{}, err
+	}
+	return negotiated, c.WriteMessage(websocket.BinaryMessage, welcome)
+}
+
 // notify all users that are online and connected to `owner` that new file has been uploaded
 func (s *storage) notifyConnectedUpload(owner, uploader, fileID string) {
 	// generate message
-	notification := s.notifyUploadRequest(owner, fileID)
+	notification := requests.NewReq("NewUpload")
+	notification.Append("user", owner)
+	notification.Append("fileID", fileID)
 
 	// list users to notify
 	connected, err := s.eos.ListConnected(owner)
@@ -89,24 +144,9 @@ func (s *storage) notifyConnectedUpload(owner, uploader, fileID string) {
 
 		// if user is connected send notification
 		if s.hub.Connected(v) {
-			c, err := s.hub.GetConn(v)
-			if err != nil {
-				s.log.Printf("Error getting ws.conn; %v", err)
+			if err := s.hub.Send(v, notification); err != nil {
+				s.log.Printf("Error sending NewUpload to %s; %v", v, err)
 			}
-			c.WriteMessage(websocket.BinaryMessage, notification)
 		}
 	}
 }
-
-func (s *storage) notifyUploadRequest(owner, fileID string) []byte {
-	req := requests.NewReq("NewUpload")
-	req.Append("user", owner)
-	req.Append("fileID", fileID)
-
-	out, err := req.Encode()
-	if err != nil {
-		s.log.Printf("Error encoding request NewUpload; %v", err)
-	}
-
-	return out
-}
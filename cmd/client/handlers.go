@@ -1,12 +1,16 @@
 package main
 
 import (
-	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/iryonetwork/network-poc/client"
 	"github.com/iryonetwork/network-poc/logger"
@@ -15,6 +19,7 @@ import (
 	"github.com/iryonetwork/network-poc/config"
 	"github.com/iryonetwork/network-poc/state"
 	"github.com/iryonetwork/network-poc/storage/ehr"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 )
 
 type handlers struct {
@@ -44,14 +49,24 @@ func (h *handlers) ehrHandler(w http.ResponseWriter, r *http.Request) {
 		outErr = err.Error()
 		goto show
 	} else {
-		for k := range h.ehr.Get(owner) {
-			ehr[k] = string(h.ehr.Getid(owner, k))
-			var v []byte
-			v, err = h.ehr.Decrypt(owner, k, h.state.EncryptionKeys[owner])
-			if err != nil {
-				break
+		// work on snapshots, documents may change while syncing in the background
+		documents, getErr := h.ehr.Get(owner)
+		if getErr != nil {
+			outErr = getErr.Error()
+			goto show
+		}
+		for k, v := range documents {
+			ehr[k] = string(v)
+		}
+		// documents of categories not shared with us are missing
+		decrypted, decryptErr := h.ehr.DecryptAll(owner, h.state.EncryptionKeys[owner])
+		if decryptErr != nil {
+			outErr = decryptErr.Error()
+		}
+		for k, v := range decrypted {
+			if _, ok := ehr[k]; ok {
+				ehr[k+"_dec"] = string(v)
 			}
-			ehr[k+"_dec"] = string(v)
 		}
 	}
 	if err != nil {
@@ -142,6 +157,70 @@ func (h *handlers) saveEHRHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, 302)
 }
 
+// ecgHandler saves ECG with the recording sent as `attachment`. The form is read as a stream,
+// so the recording is encrypted and uploaded without holding it in memory. Fields have to precede it
+func (h *handlers) ecgHandler(w http.ResponseWriter, r *http.Request) {
+	owner := h.state.EosAccount
+	ecg := ehrdata.NewECG(h.state)
+
+	reader, err := r.MultipartReader()
+	for err == nil {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			err = fmt.Errorf("ECG recording is missing")
+			break
+		}
+		if partErr != nil {
+			err = partErr
+			break
+		}
+		if part.FormName() == "attachment" {
+			err = h.client.SaveAndUploadECG(owner, ecg, part.FileName(), part.Header.Get("Content-Type"), part)
+			break
+		}
+
+		value, readErr := ioutil.ReadAll(io.LimitReader(part, 1024))
+		if readErr != nil {
+			err = readErr
+			break
+		}
+		switch part.FormName() {
+		case "owner":
+			owner = string(value)
+		case "interpretation":
+			ecg.AutomaticInterpretation = string(value)
+		}
+	}
+
+	url := "/"
+	if h.config.ClientType == "Doctor" {
+		url = "/ehr/" + owner
+	}
+	if err != nil {
+		url += "?error=" + err.Error()
+	}
+
+	http.Redirect(w, r, url, 302)
+}
+
+// attachmentHandler serves decrypted attachment referenced as iryo://owner/id at /attachment/owner/id
+func (h *handlers) attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	owner, id, err := ehrdata.ParseAttachmentURI("iryo://" + strings.TrimPrefix(r.URL.EscapedPath(), "/attachment/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if mediaType := r.URL.Query().Get("type"); mediaType != "" {
+		w.Header().Set("Content-Type", mediaType)
+	}
+
+	// chunks are written as they are authenticated, truncated response means the attachment failed to decrypt
+	if err := h.client.DownloadAttachment(owner, id, w); err != nil {
+		h.log.Printf("Failed to download attachment %s of %s: %v", id, owner, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
 func (h *handlers) requestHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	to := r.Form["to"][0]
@@ -166,9 +245,18 @@ func (h *handlers) ignoreHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handlers) reencryptHandler(w http.ResponseWriter, r *http.Request) {
+	// Continue rotation that did not finish
+	if h.state.Rotation != nil {
+		if err := h.client.ResumeRotation(); err != nil {
+			http.Redirect(w, r, "/?error="+err.Error(), 302)
+			return
+		}
+		http.Redirect(w, r, "/", 302)
+		return
+	}
+
 	// We need new key
-	key := make([]byte, 32)
-	_, err := rand.Read(key)
+	key, err := h.state.NextRecordKey()
 	if err != nil {
 		http.Redirect(w, r, "/?error="+err.Error(), 302)
 		return
@@ -185,7 +273,16 @@ func (h *handlers) reencryptHandler(w http.ResponseWriter, r *http.Request) {
 
 func (h *handlers) grantAccessHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	err := h.client.GrantAccess(r.Form["to"][0])
+	// Access never expires if number of days is not set
+	var duration time.Duration
+	days, err := strconv.Atoi(r.Form.Get("days"))
+	if err == nil && days > 0 {
+		duration = time.Duration(days) * 24 * time.Hour
+	}
+	permissions, err := ledger.ParsePermissions(r.Form["permission"])
+	if err == nil {
+		err = h.client.GrantAccess(r.Form["to"][0], permissions, duration, r.Form["category"]...)
+	}
 	url := "/"
 	if err != nil {
 		url += "?error=" + err.Error()
@@ -194,9 +291,22 @@ func (h *handlers) grantAccessHandler(w http.ResponseWriter, r *http.Request) {
 }
 func (h *handlers) denyAccessHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	to := r.Form["to"][0]
-	delete(h.state.Connections.Requested, to)
-	http.Redirect(w, r, "/", 302)
+	err := h.client.DenyAccess(r.Form["to"][0], r.Form.Get("reason"))
+	url := "/"
+	if err != nil {
+		url += "?error=" + err.Error()
+	}
+	http.Redirect(w, r, url, 302)
+}
+
+func (h *handlers) cancelRequestHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	err := h.client.CancelAccessRequest(r.Form["to"][0], r.Form.Get("reason"))
+	url := "/"
+	if err != nil {
+		url += "?error=" + err.Error()
+	}
+	http.Redirect(w, r, url, 302)
 }
 
 func (h *handlers) revokeAccessHandler(w http.ResponseWriter, r *http.Request) {
@@ -209,11 +319,136 @@ func (h *handlers) revokeAccessHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, 302)
 }
 
+// leaveHandler gives up access the patient granted us
+func (h *handlers) leaveHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	err := h.client.RelinquishAccess(r.Form.Get("patient"))
+	url := "/"
+	if err != nil {
+		url += "?error=" + err.Error()
+	}
+	http.Redirect(w, r, url, 302)
+}
+
+func (h *handlers) recoverySetupHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	threshold, err := strconv.Atoi(r.Form.Get("threshold"))
+	if err == nil {
+		err = h.client.SetupRecovery(splitAccounts(r.Form.Get("trustees")), threshold, r.Form.Get("passphrase"))
+	}
+	if err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+func (h *handlers) recoveryAcceptHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	err := h.client.AcceptRecoveryInvite(r.Form.Get("owner"))
+	if err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+func (h *handlers) recoveryRejectHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	err := h.client.DeclineRecoveryInvite(r.Form.Get("owner"))
+	if err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+func (h *handlers) recoveryRequestHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	err := h.client.RequestRecovery(splitAccounts(r.Form.Get("trustees")))
+	if err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+func (h *handlers) recoveryReturnHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	err := h.client.ReturnShare(r.Form.Get("owner"))
+	if err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+func (h *handlers) recoveryDeclineHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	err := h.client.DeclineRecovery(r.Form.Get("owner"))
+	if err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+// mnemonicConfirmHandler confirms the mnemonic with words typed in fields word<position>
+func (h *handlers) mnemonicConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	words := make(map[int]string)
+	for field := range r.Form {
+		if position, err := strconv.Atoi(strings.TrimPrefix(field, "word")); err == nil && strings.HasPrefix(field, "word") {
+			words[position] = r.Form.Get(field)
+		}
+	}
+	if err := h.state.ConfirmMnemonic(words); err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+// splitAccounts splits comma separated list of accounts
+func splitAccounts(list string) []string {
+	out := []string{}
+	for _, account := range strings.Split(list, ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			out = append(out, account)
+		}
+	}
+	return out
+}
+
 func (h *handlers) switchModeHandler(w http.ResponseWriter, r *http.Request) {
 	h.state.IsDoctor = !h.state.IsDoctor
 	http.Redirect(w, r, "/", 302)
 }
 
+// backupHandler exports our identity encrypted with passphrase,
+// start a client with IDENTITY_BACKUP to continue on another device
+func (h *handlers) backupHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	archive, err := h.state.Export(r.PostForm.Get("passphrase"))
+	if err != nil {
+		http.Redirect(w, r, "/?error="+err.Error(), 302)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.iryo", h.state.EosAccount))
+	w.Write(archive)
+}
+
+// statsHandler reports how much space compression of documents saved
+func (h *handlers) statsHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := json.Marshal(h.ehr.Stats())
+	if err != nil {
+		h.log.Debugf("error marshaling stats: %v", err)
+	}
+	w.Write(a)
+}
+
 func (h *handlers) configHandler(w http.ResponseWriter, r *http.Request) {
 	a, err := json.Marshal(h.config)
 	if err != nil {
@@ -6,8 +6,11 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/iryonetwork/network-poc/state"
+	"github.com/iryonetwork/network-poc/storage/ehr"
 
 	"github.com/iryonetwork/network-poc/openEHR/ehrdata"
 	qrcode "github.com/skip2/go-qrcode"
@@ -20,16 +23,18 @@ func (h *handlers) indexHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	outErr := r.URL.Query().Get("error")
 
+	// Device recovering a key has no account and no documents yet
 	user := h.state.EosAccount
-	err = h.client.Update(user)
-	if err != nil {
-		outErr = err.Error()
+	if user != "" {
+		if err := h.client.Update(user); err != nil {
+			outErr = err.Error()
+		}
 	}
-	ehr, err := ehrdata.ExtractEhrData(h.state.EosAccount, h.ehr, h.state)
+	ehrData, err := ehrdata.ExtractEhrData(h.state.EosAccount, h.ehr, h.state)
 	if err != nil {
 		outErr = err.Error()
 	}
-	jsonEhr, err := json.Marshal(ehr)
+	jsonEhr, err := json.Marshal(ehrData)
 	if err != nil {
 		outErr = err.Error()
 	}
@@ -43,6 +48,16 @@ func (h *handlers) indexHandler(w http.ResponseWriter, r *http.Request) {
 		log.Fatalf("Error creating qr png: %v", err)
 	}
 
+	// Phrase is shown until user confirms they wrote it down
+	var mnemonic []string
+	var challenge []int
+	if h.state.Seed.Mnemonic != "" {
+		mnemonic = strings.Fields(h.state.Seed.Mnemonic)
+		if challenge, err = h.state.MnemonicChallenge(); err != nil {
+			outErr = err.Error()
+		}
+	}
+
 	data := struct {
 		Type        string
 		Name        string
@@ -57,7 +72,20 @@ func (h *handlers) indexHandler(w http.ResponseWriter, r *http.Request) {
 		Connected   bool
 		Granted     map[string]string
 		GrantedFrom map[string]string
+		Awaiting    map[string]string
 		IsDoctor    bool
+		Rotating    bool
+		Categories  []string
+
+		Trustees          []string
+		Threshold         int
+		RecoveryRequested map[string]string
+		RecoveryInvites   map[string]string
+
+		Mnemonic          []string
+		MnemonicChallenge []int
+		RotationLog       []state.RotationRecord
+		Expires           map[string]time.Time
 	}{
 		h.config.ClientType,
 		h.state.PersonalData.Name,
@@ -72,7 +100,18 @@ func (h *handlers) indexHandler(w http.ResponseWriter, r *http.Request) {
 		h.state.Connected,
 		h.state.GetNames(h.state.Connections.WithoutKey),
 		h.state.GetNames(h.state.Connections.WithKey),
+		h.state.GetNames(h.state.Connections.Awaiting),
 		h.state.IsDoctor,
+		h.state.Rotation != nil,
+		ehr.Categories,
+		h.state.Recovery.Trustees,
+		h.state.Recovery.Threshold,
+		h.state.GetNames(recoveryRequestsToArray(h.state.Recovery.Requested)),
+		h.state.GetNames(recoveryInvitesToArray(h.state.Recovery.Invited)),
+		mnemonic,
+		challenge,
+		h.state.RotationLog,
+		h.state.Connections.Expires,
 	}
 
 	if err := t.Execute(w, data); err != nil {
@@ -88,6 +127,22 @@ func mapKeysToArray(m map[string]state.Request) []string {
 	return out
 }
 
+func recoveryRequestsToArray(m map[string][]byte) []string {
+	out := []string{}
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
+
+func recoveryInvitesToArray(m map[string]string) []string {
+	out := []string{}
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
+
 func (h *handlers) doctorIndexHandler(w http.ResponseWriter, r *http.Request) {
 	t, err := template.ParseFiles("templates/doctor/index.html")
 	if err != nil {
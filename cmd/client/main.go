@@ -3,16 +3,18 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"io/ioutil"
 	stdlog "log"
 	"net/http"
 
 	"github.com/iryonetwork/network-poc/client"
 	"github.com/iryonetwork/network-poc/config"
 	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/openEHR"
 	"github.com/iryonetwork/network-poc/openEHR/personaldata"
 	"github.com/iryonetwork/network-poc/state"
 	"github.com/iryonetwork/network-poc/storage/ehr"
-	"github.com/iryonetwork/network-poc/storage/eos"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 )
 
 func main() {
@@ -29,32 +31,84 @@ func main() {
 	}
 	defer state.Close()
 
-	personaldata.New(state)
+	// Continue as the user from identity backup
+	if config.IdentityBackup != "" {
+		archive, err := ioutil.ReadFile(config.IdentityBackup)
+		if err != nil {
+			log.Fatalf("failed to read identity backup; %v", err)
+		}
+		if err := state.Import(archive, config.IdentityBackupPassphrase); err != nil {
+			log.Fatalf("failed to import identity backup; %v", err)
+		}
+	}
+	// Continue as the user whose keys are derived from mnemonic, account name is not derived.
+	// Seed is not saved, so mnemonic is given on every start to derive the keys rotated to
+	fromMnemonic := config.Mnemonic != "" && state.EosPrivate == ""
+	if config.Mnemonic != "" {
+		if fromMnemonic && state.EosAccount == "" {
+			log.Fatalf("EOS_ACCOUNT is required to restore from mnemonic")
+		}
+		eosPrivate := state.EosPrivate
+		if err := state.SetMnemonic(config.Mnemonic); err != nil {
+			log.Fatalf("failed to restore from mnemonic; %v", err)
+		}
+		if eosPrivate != "" && eosPrivate != state.EosPrivate {
+			log.Fatalf("MNEMONIC does not belong to the user")
+		}
+	}
+	// Device recovering master key of account lost with another device has no account,
+	// it connects with the recovery key derived from the passphrase
+	recovering := config.RecoverAccount != ""
+	if recovering {
+		if err := state.StartRecovery(config.RecoverAccount, config.RecoveryPassphrase); err != nil {
+			log.Fatalf("failed to derive recovery key; %v", err)
+		}
+		state.PersonalData = &openEHR.PersonalData{}
+	}
+	// Restored identity is reused, new user is created otherwise
+	restored := config.IdentityBackup != "" || config.Mnemonic != "" || recovering
 
-	eos, err := eos.New(config, state, log)
+	if !restored {
+		personaldata.New(state)
+	}
+
+	ledger, err := ledger.Open(config, state, log)
+	if err != nil {
+		log.Fatalf("failed to setup ledger; %v", err)
+	}
+	ehr, err := ehr.Open(config)
 	if err != nil {
-		log.Fatalf("failed to setup eth storage; %v", err)
+		log.Fatalf("failed to open ehr storage; %v", err)
 	}
-	ehr := ehr.New()
+	defer ehr.Close()
 
-	if eos.NewKey() != nil {
+	if restored {
+		if _, err := ledger.ImportKey(state.EosPrivate); err != nil {
+			log.Fatalf("Failed to import key; %v", err)
+		}
+	} else if err := ledger.NewKey(); err != nil {
 		log.Fatalf("Failed to create new key; %v", err)
 	}
 
-	state.RSAKey, err = rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		log.Fatalf("Failed generating rsa key")
+	// RSA key is only needed to exchange keys with clients that don't support sealed boxes
+	if config.LegacyRSAKeys && state.RSAKey == nil {
+		state.RSAKey, err = rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			log.Fatalf("Failed generating rsa key")
+		}
 	}
 
-	client := client.New(config, state, eos, ehr, client.NewMessageHandler(state, ehr, eos, log), log)
+	client := client.New(config, state, ledger, ehr, client.NewMessageHandler(state, ehr, ledger, log), log)
 
 	if err = client.Login(); err != nil {
 		log.Fatalf("Failed to login; %v", err)
 	}
 
-	state.EosAccount, err = client.CreateAccount(state.GetEosPublicKey())
-	if err != nil {
-		log.Fatalf("Failed to create account: %v", err)
+	if !restored {
+		state.EosAccount, err = client.CreateAccount(state.GetEosPublicKey())
+		if err != nil {
+			log.Fatalf("Failed to create account: %v", err)
+		}
 	}
 
 	err = client.ConnectWs()
@@ -63,16 +117,43 @@ func main() {
 	}
 	defer client.CloseWs()
 
-	// Create key
-	key := make([]byte, 32)
-	_, err = rand.Read(key)
-	if err != nil {
-		log.Fatalf("failed to generate random key: %v", err)
+	if fromMnemonic {
+		if err := client.RestoreFromSeed(); err != nil {
+			log.Fatalf("Failed to restore from mnemonic: %v", err)
+		}
+	}
+
+	if !restored {
+		// Initial key is derived from mnemonic
+		key, err := state.RecordKey(0)
+		if err != nil {
+			log.Fatalf("failed to derive key: %v", err)
+		}
+		state.EncryptionKeys[state.EosAccount] = key
+
+		if err := personaldata.Upload(state, ehr, client); err != nil {
+			log.Fatalf("Error uploading personal data: %v", err)
+		}
+	}
+
+	if !recovering {
+		// Documents of users that revoked our access while we were offline are not kept
+		if err := client.EvictRevoked(); err != nil {
+			log.Printf("Failed to evict documents of revoked users: %v", err)
+		}
+		// Users who granted us access are kept on the blockchain, local list might be lost
+		if err := client.RestorePatients(); err != nil {
+			log.Printf("Failed to restore users who granted access: %v", err)
+		}
 	}
-	state.EncryptionKeys[state.EosAccount] = key
 
-	if err := personaldata.Upload(state, ehr, client); err != nil {
-		log.Fatalf("Error uploading personal data: %v", err)
+	// Finish key rotation interrupted by restart
+	if state.Rotation != nil {
+		go func() {
+			if err := client.ResumeRotation(); err != nil {
+				log.Printf("Failed to resume key rotation: %v", err)
+			}
+		}()
 	}
 
 	h := &handlers{
@@ -86,6 +167,8 @@ func main() {
 	http.HandleFunc("/", h.indexHandler)
 	http.HandleFunc("/ehr/", h.ehrHandler)
 	http.HandleFunc("/save", h.saveEHRHandler)
+	http.HandleFunc("/ecg", h.ecgHandler)
+	http.HandleFunc("/attachment/", h.attachmentHandler)
 	http.HandleFunc("/close", h.closeHandler)
 	http.HandleFunc("/connect", h.connectHandler)
 	http.HandleFunc("/request", h.requestHandler)
@@ -93,8 +176,19 @@ func main() {
 	http.HandleFunc("/reencrypt", h.reencryptHandler)
 	http.HandleFunc("/grant", h.grantAccessHandler)
 	http.HandleFunc("/deny", h.denyAccessHandler)
+	http.HandleFunc("/cancel", h.cancelRequestHandler)
 	http.HandleFunc("/revoke", h.revokeAccessHandler)
+	http.HandleFunc("/leave", h.leaveHandler)
+	http.HandleFunc("/recovery/setup", h.recoverySetupHandler)
+	http.HandleFunc("/recovery/accept", h.recoveryAcceptHandler)
+	http.HandleFunc("/recovery/reject", h.recoveryRejectHandler)
+	http.HandleFunc("/recovery/request", h.recoveryRequestHandler)
+	http.HandleFunc("/recovery/return", h.recoveryReturnHandler)
+	http.HandleFunc("/recovery/decline", h.recoveryDeclineHandler)
+	http.HandleFunc("/mnemonic/confirm", h.mnemonicConfirmHandler)
 	http.HandleFunc("/config", h.configHandler)
+	http.HandleFunc("/backup", h.backupHandler)
+	http.HandleFunc("/stats", h.statsHandler)
 	http.HandleFunc("/ws", h.wsHandler)
 	if config.ClientType == "Doctor" {
 		http.HandleFunc("/switchMode", h.switchModeHandler)
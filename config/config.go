@@ -1,29 +1,47 @@
 package config
 
 import (
+	"time"
+
 	"github.com/caarlos0/env"
 )
 
 type Config struct {
-	IryoAddr                     string `env:"IRYO_ADDR" envDefault:"localhost:8000"`
-	EosAPI                       string `env:"EOS_API" envDefault:"http://localhost:8888"`
-	EosPrivate                   string `env:"EOS_PRIVATE"`
-	EosAccount                   string `env:"EOS_ACCOUNT"`
-	EosContractAccount           string `env:"EOS_CONTRACT_ACCOUNT"`
-	EosContractName              string `env:"EOS_CONTRACT_NAME"`
-	EosTokenAccount              string `env:"EOS_TOKEN_ACCOUNT"`
-	EosTokenName                 string `env:"EOS_TOKEN_NAME"`
-	EosAccountFormat             string `env:"EOS_ACCOUNT_FORMAT" envDefault:"[a-z1-5]{7}\\.iryo"`
-	EosRequiresRAM               bool   `env:"EOS_REQUIRES_RAM" envDefault:"0"`
-	EosMinimumRAM                int    `env:"EOS_MINIMUM_RAM" envDefault:"10000"`
-	EosStakeRAM                  int    `env:"EOS_STAKE_RAM" envDefault:"4096"`
-	ClientType                   string `env:"CLIENT_TYPE" envDefault:"Patient"`
-	ClientAddr                   string `env:"CLIENT_ADDR" envDefault:"localhost:9000"`
-	Debug                        bool   `env:"DEBUG" envDefault:"1"`
-	StoragePath                  string `env:"DATA_PATH" envDefault:"/data"`
-	PersistentState              bool   `env:"PERSISTENT_STATE" envDefault:"0"`
-	PersistentStateEncryptionKey string `env:"PERSISTENT_STATE_ENCRYPTION_KEY"`
-	PersistentStateStoragePath   string `env:"PERSISTENT_STATE_STORAGE_PATH"`
+	IryoAddr                     string        `env:"IRYO_ADDR" envDefault:"localhost:8000"`
+	EosAPI                       string        `env:"EOS_API" envDefault:"http://localhost:8888"`
+	EosPrivate                   string        `env:"EOS_PRIVATE"`
+	EosAccount                   string        `env:"EOS_ACCOUNT"`
+	EosContractAccount           string        `env:"EOS_CONTRACT_ACCOUNT"`
+	EosContractName              string        `env:"EOS_CONTRACT_NAME"`
+	EosTokenAccount              string        `env:"EOS_TOKEN_ACCOUNT"`
+	EosTokenName                 string        `env:"EOS_TOKEN_NAME"`
+	EosAccountFormat             string        `env:"EOS_ACCOUNT_FORMAT" envDefault:"[a-z1-5]{7}\\.iryo"`
+	EosRequiresRAM               bool          `env:"EOS_REQUIRES_RAM" envDefault:"0"`
+	EosMinimumRAM                int           `env:"EOS_MINIMUM_RAM" envDefault:"10000"`
+	EosStakeRAM                  int           `env:"EOS_STAKE_RAM" envDefault:"4096"`
+	Ledger                       string        `env:"LEDGER" envDefault:"eos"`
+	LedgerPath                   string        `env:"LEDGER_PATH"`
+	ACLCacheTTL                  time.Duration `env:"ACL_CACHE_TTL" envDefault:"10s"`
+	WatcherInterval              time.Duration `env:"WATCHER_INTERVAL" envDefault:"1s"`
+	ClientType                   string        `env:"CLIENT_TYPE" envDefault:"Patient"`
+	ClientAddr                   string        `env:"CLIENT_ADDR" envDefault:"localhost:9000"`
+	Debug                        bool          `env:"DEBUG" envDefault:"1"`
+	StoragePath                  string        `env:"DATA_PATH" envDefault:"/data"`
+	PersistentState              bool          `env:"PERSISTENT_STATE" envDefault:"0"`
+	PersistentStateEncryptionKey string        `env:"PERSISTENT_STATE_ENCRYPTION_KEY"`
+	PersistentStateStoragePath   string        `env:"PERSISTENT_STATE_STORAGE_PATH"`
+	WsMessageMaxAge              time.Duration `env:"WS_MESSAGE_MAX_AGE" envDefault:"24h"`
+	LegacyRSAKeys                bool          `env:"LEGACY_RSA_KEYS" envDefault:"0"`
+	RotateOnRevoke               bool          `env:"ROTATE_ON_REVOKE" envDefault:"0"`
+	EhrStorage                   string        `env:"EHR_STORAGE" envDefault:"memory"`
+	EhrStoragePath               string        `env:"EHR_STORAGE_PATH"`
+	EhrStorageEncryptionKey      string        `env:"EHR_STORAGE_ENCRYPTION_KEY"`
+	EhrCompression               string        `env:"EHR_COMPRESSION" envDefault:"none"`
+	IdentityBackup               string        `env:"IDENTITY_BACKUP"`
+	IdentityBackupPassphrase     string        `env:"IDENTITY_BACKUP_PASSPHRASE" json:"-"`
+	Mnemonic                     string        `env:"MNEMONIC" json:"-"`
+	RecoverAccount               string        `env:"RECOVER_ACCOUNT"`
+	RecoveryPassphrase           string        `env:"RECOVERY_PASSPHRASE" json:"-"`
 }
 
 func New() (*Config, error) {
@@ -1,4 +1,5 @@
 #include <eosio/eosio.hpp>
+#include <eosio/system.hpp>
 
 using namespace eosio;
 
@@ -6,20 +7,47 @@ class [[eosio::contract]] iryo : public contract {
   public:
       using contract::contract;
 
+      // permissions is bitmask of read (1), write (2) and emergency (4) access,
+      // expires is unix time in seconds after which access is no longer granted, 0 if it never expires
       [[eosio::action]]
-      void grantaccess( name patient, name connectedUser ) {
+      void grantaccess( name patient, name connectedUser, uint8_t permissions, uint32_t expires ) {
         require_auth( patient );
+        eosio::check(permissions != 0 && permissions < 8, "Invalid permissions");
+        eosio::check(expires == 0 || expires > current_time_point().sec_since_epoch(), "Expiry is in the past");
 
         personInx persons( get_self(), patient.value );
+        granteeInx grantees( get_self(), connectedUser.value );
 
-        // check if access is already granted
+        // granting access again, e.g. after it expired, only changes permissions and the expiry
         auto iterator = persons.find(connectedUser.value);
-        eosio::check(iterator == persons.end(), "Access already granted");
-
-        // add to table
-        persons.emplace(patient, [&]( auto& row ) {
-          row.key = connectedUser;
-        });
+        if (iterator != persons.end()) {
+          persons.modify(iterator, patient, [&]( auto& row ) {
+            row.permissions = permissions;
+            row.expires = expires;
+          });
+        } else {
+          // add to table
+          persons.emplace(patient, [&]( auto& row ) {
+            row.key = connectedUser;
+            row.permissions = permissions;
+            row.expires = expires;
+          });
+        }
+
+        // keep reverse index in sync, grants made before it existed are added to it here
+        auto reverse = grantees.find(patient.value);
+        if (reverse != grantees.end()) {
+          grantees.modify(reverse, patient, [&]( auto& row ) {
+            row.permissions = permissions;
+            row.expires = expires;
+          });
+        } else {
+          grantees.emplace(patient, [&]( auto& row ) {
+            row.key = patient;
+            row.permissions = permissions;
+            row.expires = expires;
+          });
+        }
 
         // check if access was granted
         iterator = persons.find(connectedUser.value);
@@ -29,44 +57,54 @@ class [[eosio::contract]] iryo : public contract {
       [[eosio::action]]
       void revokeaccess( name patient, name connectedUser ) {
         require_auth( patient );
-
-        personInx persons( get_self(), patient.value );
-
-        // check access was granted in the past
-        auto iterator = persons.find(connectedUser.value);
-        eosio::check(iterator != persons.end(), "Did not find a connection to revoke");
-
-        // remove row
-        persons.erase(iterator);
-
-        // check access was revoked
-        iterator = persons.find(connectedUser.value);
-        eosio::check(iterator == persons.end(), "Connection not removed");
+        removeaccess( patient, connectedUser );
       }
 
       [[eosio::action]]
       void revokeaccess2( name patient, name connectedUser ) {
         require_auth( connectedUser );
-
-        personInx persons( get_self(), patient.value );
-
-        // check access was granted in the past
-        auto iterator = persons.find(connectedUser.value);
-        eosio::check(iterator != persons.end(), "Did not find a connection to revoke");
-
-        // remove row
-        persons.erase(iterator);
-
-        // check access was revoked
-        iterator = persons.find(connectedUser.value);
-        eosio::check(iterator == persons.end(), "Connection not removed");
+        removeaccess( patient, connectedUser );
       }
 
   private:
     struct [[eosio::table]] person {
       name key;
+      uint8_t permissions;
+      uint32_t expires;
       uint64_t primary_key() const { return key.value;}
     };
 
     typedef eosio::multi_index<"person"_n, person> personInx;
+
+    // reverse index of person table, scoped by grantee and keyed by patient
+    struct [[eosio::table]] grantee {
+      name key;
+      uint8_t permissions;
+      uint32_t expires;
+      uint64_t primary_key() const { return key.value;}
+    };
+
+    typedef eosio::multi_index<"grantee"_n, grantee> granteeInx;
+
+    void removeaccess( name patient, name connectedUser ) {
+      personInx persons( get_self(), patient.value );
+
+      // check access was granted in the past
+      auto iterator = persons.find(connectedUser.value);
+      eosio::check(iterator != persons.end(), "Did not find a connection to revoke");
+
+      // remove row
+      persons.erase(iterator);
+
+      // check access was revoked
+      iterator = persons.find(connectedUser.value);
+      eosio::check(iterator == persons.end(), "Connection not removed");
+
+      // grants made before reverse index existed are not in it
+      granteeInx grantees( get_self(), connectedUser.value );
+      auto reverse = grantees.find(patient.value);
+      if (reverse != grantees.end()) {
+        grantees.erase(reverse);
+      }
+    }
 };
@@ -1,15 +1,26 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/iryonetwork/network-poc/config"
 	"github.com/iryonetwork/network-poc/logger"
+	bolt "go.etcd.io/bbolt"
 )
 
-const namesBucket = "names"
+const (
+	namesBucket   = "names"
+	authorsBucket = "authors"
+	watcherBucket = "watcher"
+	auditBucket   = "audit"
+
+	cursorKey = "cursor"
+)
 
 type Db struct {
 	db     *bolt.DB
@@ -32,8 +43,12 @@ func Init(config *config.Config, log *logger.Log) (*Db, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(namesBucket))
-		return err
+		for _, bucket := range []string{namesBucket, authorsBucket, watcherBucket, auditBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 
 	return &Db{db: db, config: config, log: log}, err
@@ -74,6 +89,101 @@ func (d *Db) AddName(account, name string) error {
 	return nil
 }
 
+// GetAuthor returns account that uploaded owner's file first, empty string if it's not known
+func (d *Db) GetAuthor(owner, fid string) (author string, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(authorsBucket))
+		author = string(b.Get(authorKey(owner, fid)))
+		return nil
+	})
+
+	return author, err
+}
+
+// SetAuthor records account that uploaded owner's file
+func (d *Db) SetAuthor(owner, fid, author string) error {
+	d.log.Debugf("Setting author of %s/%s to %s", owner, fid, author)
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(authorsBucket))
+		return b.Put(authorKey(owner, fid), []byte(author))
+	})
+}
+
+func authorKey(owner, fid string) []byte {
+	return []byte(owner + "/" + fid)
+}
+
+// GetCursor returns number of the last block read by the watcher, 0 if no block was read yet
+func (d *Db) GetCursor() (block uint32, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(watcherBucket)).Get([]byte(cursorKey))
+		if len(v) == 4 {
+			block = binary.BigEndian.Uint32(v)
+		}
+		return nil
+	})
+
+	return block, err
+}
+
+// SetCursor records number of the last block read by the watcher
+func (d *Db) SetCursor(block uint32) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, block)
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(watcherBucket)).Put([]byte(cursorKey), v)
+	})
+}
+
+// AuditEntry is a read of owner's documents made with emergency permission
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Account  string    `json:"account"`
+	Document string    `json:"document"`
+}
+
+// AddAudit records that account read owner's document with emergency permission
+func (d *Db) AddAudit(owner, account, document string) error {
+	entry := AuditEntry{Time: time.Now().UTC(), Account: account, Document: document}
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(auditBucket))
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(append(auditPrefix(owner), key...), v)
+	})
+}
+
+// GetAudit returns emergency reads of owner's documents, oldest first
+func (d *Db) GetAudit(owner string) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(auditBucket)).Cursor()
+		prefix := auditPrefix(owner)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			entry := AuditEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+func auditPrefix(owner string) []byte {
+	return []byte(owner + "/")
+}
+
 func (d *Db) Close() {
 	d.db.Close()
 }
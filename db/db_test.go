@@ -0,0 +1,100 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+)
+
+func TestAuthor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{StoragePath: dir}
+	d, err := Init(cfg, logger.New(cfg))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer d.Close()
+
+	if author, err := d.GetAuthor("patient.iryo", "fid"); err != nil || author != "" {
+		t.Errorf("Expected no author, got %q, %v", author, err)
+	}
+	if err := d.SetAuthor("patient.iryo", "fid", "doctor1.iryo"); err != nil {
+		t.Fatalf("SetAuthor failed: %v", err)
+	}
+	if author, _ := d.GetAuthor("patient.iryo", "fid"); author != "doctor1.iryo" {
+		t.Errorf("Expected doctor1.iryo, got %q", author)
+	}
+	if author, _ := d.GetAuthor("other.iryo", "fid"); author != "" {
+		t.Errorf("Author of another owner's file returned: %q", author)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{StoragePath: dir}
+	d, err := Init(cfg, logger.New(cfg))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	if block, err := d.GetCursor(); err != nil || block != 0 {
+		t.Errorf("Expected no cursor, got %d, %v", block, err)
+	}
+	if err := d.SetCursor(1234); err != nil {
+		t.Fatalf("SetCursor failed: %v", err)
+	}
+	d.Close()
+
+	// cursor survives restart
+	d, err = Init(cfg, logger.New(cfg))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer d.Close()
+	if block, _ := d.GetCursor(); block != 1234 {
+		t.Errorf("Expected 1234, got %d", block)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{StoragePath: dir}
+	d, err := Init(cfg, logger.New(cfg))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer d.Close()
+
+	for _, document := range []string{"fid1", "fid2"} {
+		if err := d.AddAudit("patient.iryo", "ambulance", document); err != nil {
+			t.Fatalf("AddAudit failed: %v", err)
+		}
+	}
+	d.AddAudit("patient", "ambulance", "other")
+
+	entries, err := d.GetAudit("patient.iryo")
+	if err != nil {
+		t.Fatalf("GetAudit failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Document != "fid1" || entries[1].Document != "fid2" || entries[0].Account != "ambulance" {
+		t.Errorf("Unexpected audit entries %+v", entries)
+	}
+}
@@ -1,7 +1,6 @@
 module github.com/iryonetwork/network-poc
 
 require (
-	github.com/boltdb/bolt v1.3.1
 	github.com/caarlos0/env v3.4.0+incompatible
 	github.com/eoscanada/eos-go v0.8.11
 	github.com/go-openapi/swag v0.17.2
@@ -19,8 +18,10 @@ require (
 	github.com/tidwall/match v1.0.1 // indirect
 	github.com/tidwall/pretty v0.0.0-20190325153808-1166b9ac2b65 // indirect
 	github.com/tidwall/sjson v1.0.4 // indirect
+	github.com/tyler-smith/go-bip39 v1.0.2
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.9.1 // indirect
-	golang.org/x/crypto v0.0.0-20180910181607-0e37d006457b // indirect
+	golang.org/x/crypto v0.0.0-20180910181607-0e37d006457b
 )
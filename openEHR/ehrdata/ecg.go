@@ -0,0 +1,35 @@
+package ehrdata
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/iryonetwork/network-poc/openEHR"
+	"github.com/iryonetwork/network-poc/state"
+)
+
+const attachmentScheme = "iryo://"
+
+func NewECG(state *state.State) *openEHR.ECG {
+	return &openEHR.ECG{
+		Shared: openEHR.Shared{
+			Repeating: state.PersonalData.Repeating,
+			Category:  "433|event",
+			Timestamp: timestamp(),
+		},
+	}
+}
+
+// AttachmentURI references attachment uploaded as owner's file with id
+func AttachmentURI(owner, id string) string {
+	return fmt.Sprintf("%s%s/%s", attachmentScheme, owner, id)
+}
+
+// ParseAttachmentURI returns owner and file ID of attachment referenced by uri
+func ParseAttachmentURI(uri string) (owner, id string, err error) {
+	parts := strings.Split(strings.TrimPrefix(uri, attachmentScheme), "/")
+	if !strings.HasPrefix(uri, attachmentScheme) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid attachment URI %s", uri)
+	}
+	return parts[0], parts[1], nil
+}
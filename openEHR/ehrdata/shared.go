@@ -30,19 +30,34 @@ type Entry struct {
 	Value     []string
 }
 
+// Category returns the encryption category of openEHR document
+func Category(document []byte) string {
+	fields := make(map[string]interface{})
+	json.Unmarshal(document, &fields)
+
+	if category, ok := fields["/category"].(string); ok && strings.Contains(category, "persistent") {
+		return ehr.CategoryPersonal
+	}
+	for k := range fields {
+		if strings.Contains(k, "ecg_result") {
+			return ehr.CategoryECG
+		}
+	}
+	return ehr.CategoryVitalSigns
+}
+
 // Get each of EHR values in type of Entry. The order of indexes of Entry.Timestamp is equal to the order of indexes of Entry.Value
+// Documents of categories that were not shared with us are skipped. If other documents can't be
+// decrypted, the error is returned together with values of the rest
 func ExtractEhrData(owner string, ehr *ehr.Storage, state *state.State) (*map[string]Entry, error) {
 	listOfData := []*openEHR.All{}
-	for _, id := range ehr.ListIds(owner) {
-		datajson, err := ehr.Decrypt(owner, id, state.EncryptionKeys[owner])
-		if err != nil {
-			return nil, err
-		}
+	documents, err := ehr.DecryptAll(owner, state.EncryptionKeys[owner])
+	for _, datajson := range documents {
 		data := ReadFromJSON(datajson)
 		listOfData = append(listOfData, data)
 	}
 
-	return setDataByTime(listOfData), nil
+	return setDataByTime(listOfData), err
 }
 
 func setDataByTime(data []*openEHR.All) *map[string]Entry {
@@ -57,12 +57,12 @@ func getGender() string {
 	return "local::at0311|Female|"
 }
 
-func Upload(state *state.State, ehr *ehr.Storage, client *client.Client) error {
+func Upload(state *state.State, storage *ehr.Storage, client *client.Client) error {
 	data, err := json.Marshal(state.PersonalData)
 	if err != nil {
 		return err
 	}
-	id, err := ehr.Encrypt(state.EosAccount, data, state.EncryptionKeys[state.EosAccount])
+	id, err := storage.Encrypt(state.EosAccount, ehr.CategoryPersonal, data, state.EncryptionKeys[state.EosAccount])
 	if err != nil {
 		return err
 	}
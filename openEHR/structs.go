@@ -70,6 +70,7 @@ type ECG struct {
 	AttachmentName          string  `json:"/content[openEHR-EHR-OBSERVATION.ecg_result.v0]/data[at0001]/events[at0002]/data[at0005]/items[at0083|openEHR-EHR-CLUSTER.multimedia.v0]/items[at0002]/value,omitempty"`
 	AttachmentType          string  `json:"/content[openEHR-EHR-OBSERVATION.ecg_result.v0]/data[at0001]/events[at0002]/data[at0005]/items[at0083|openEHR-EHR-CLUSTER.multimedia.v0]/items[at0001]/value|media_type,omitempty"`
 	AttachmentData          *string `json:"/content[openEHR-EHR-OBSERVATION.ecg_result.v0]/data[at0001]/events[at0002]/data[at0005]/items[at0083|openEHR-EHR-CLUSTER.multimedia.v0]/items[at0001]/value|data,omitempty"`
+	AttachmentURI           string  `json:"/content[openEHR-EHR-OBSERVATION.ecg_result.v0]/data[at0001]/events[at0002]/data[at0005]/items[at0083|openEHR-EHR-CLUSTER.multimedia.v0]/items[at0001]/value|uri,omitempty"` // recording uploaded as attachment
 }
 
 type VitalSignsFields struct {
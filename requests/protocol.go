@@ -0,0 +1,132 @@
+package requests
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the newest version of ws protocol we speak
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version of ws protocol we still speak
+	MinProtocolVersion = 1
+
+	// CloseIncompatibleProtocol is the close code sent to clients that can't be served
+	CloseIncompatibleProtocol = 4001
+)
+
+// Features that can be negotiated in the handshake, features one side doesn't know are ignored.
+// With acks the api adds delivery ID to messages it sends and keeps them until the client answers
+// with Ack, unacknowledged messages are sent again when the client reconnects.
+// With multi-device the account can stay connected from several devices, each of them gets all
+// messages. Connection without it replaces other connections of the account
+const (
+	FeatureCodecJSON   = "codec/json"
+	FeatureAcks        = "acks"
+	FeatureMultiDevice = "multi-device"
+
+	// FieldDeliveryID is added by the api to messages sent to clients that negotiated acks
+	FieldDeliveryID = "deliveryID"
+)
+
+// NewAck creates client's acknowledgement of message with `deliveryID`
+func NewAck(deliveryID string) *Request {
+	r := NewReq("Ack")
+	r.Append(FieldDeliveryID, deliveryID)
+	return r
+}
+
+// Capabilities describe what one side of ws connection supports,
+// or after the handshake, what both sides agreed on
+type Capabilities struct {
+	Version    int
+	MinVersion int
+	Features   []string
+}
+
+// Has reports whether feature is supported
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHello creates request that the client sends right after it's authorized
+func NewHello(c Capabilities) *Request {
+	return c.request("Hello")
+}
+
+// NewWelcome creates api's response to Hello containing negotiated capabilities
+func NewWelcome(c Capabilities) *Request {
+	return c.request("Welcome")
+}
+
+func (c Capabilities) request(name string) *Request {
+	r := NewReq(name)
+	r.Append("version", strconv.Itoa(c.Version))
+	r.Append("minVersion", strconv.Itoa(c.MinVersion))
+	r.Append("features", strings.Join(c.Features, ","))
+	return r
+}
+
+// ParseCapabilities reads capabilities from Hello or Welcome request
+func ParseCapabilities(r *Request) (Capabilities, error) {
+	out := Capabilities{}
+	if r.Name != "Hello" && r.Name != "Welcome" {
+		return out, fmt.Errorf("Expected Hello or Welcome, got %s", r.Name)
+	}
+
+	version, err := r.GetDataString("version")
+	if err != nil {
+		return out, err
+	}
+	if out.Version, err = strconv.Atoi(version); err != nil {
+		return out, fmt.Errorf("Invalid protocol version %s", version)
+	}
+	out.MinVersion = out.Version
+	if minVersion, err := r.GetDataString("minVersion"); err == nil {
+		if out.MinVersion, err = strconv.Atoi(minVersion); err != nil {
+			return out, fmt.Errorf("Invalid minimal protocol version %s", minVersion)
+		}
+	}
+
+	if features, _ := r.GetDataString("features"); features != "" {
+		out.Features = strings.Split(features, ",")
+	}
+
+	return out, nil
+}
+
+// Negotiate picks the newest protocol version and features supported by both sides.
+// Returns error if there is no version or codec both sides understand.
+func Negotiate(client, server Capabilities) (Capabilities, error) {
+	version := client.Version
+	if server.Version < version {
+		version = server.Version
+	}
+	if version < client.MinVersion || version < server.MinVersion {
+		return Capabilities{}, fmt.Errorf("Protocol version %d-%d is not supported, use %d-%d", client.MinVersion, client.Version, server.MinVersion, server.Version)
+	}
+
+	out := Capabilities{Version: version, MinVersion: version, Features: []string{}}
+	for _, f := range client.Features {
+		if server.Has(f) {
+			out.Features = append(out.Features, f)
+		}
+	}
+	if !out.Has(FeatureCodecJSON) {
+		codecs := []string{}
+		for _, f := range server.Features {
+			if strings.HasPrefix(f, "codec/") {
+				codecs = append(codecs, f)
+			}
+		}
+		return Capabilities{}, fmt.Errorf("No supported codec, use one of: %s", strings.Join(codecs, ","))
+	}
+
+	return out, nil
+}
@@ -0,0 +1,70 @@
+package requests
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	server := Capabilities{Version: 3, MinVersion: 2, Features: []string{FeatureCodecJSON, FeatureAcks}}
+
+	tests := []struct {
+		name     string
+		client   Capabilities
+		expected *Capabilities
+	}{
+		{
+			"same version",
+			Capabilities{Version: 3, MinVersion: 1, Features: []string{FeatureCodecJSON, FeatureAcks, FeatureMultiDevice}},
+			&Capabilities{Version: 3, MinVersion: 3, Features: []string{FeatureCodecJSON, FeatureAcks}},
+		},
+		{
+			"older client",
+			Capabilities{Version: 2, MinVersion: 2, Features: []string{FeatureCodecJSON}},
+			&Capabilities{Version: 2, MinVersion: 2, Features: []string{FeatureCodecJSON}},
+		},
+		{
+			"newer client",
+			Capabilities{Version: 5, MinVersion: 3, Features: []string{FeatureCodecJSON}},
+			&Capabilities{Version: 3, MinVersion: 3, Features: []string{FeatureCodecJSON}},
+		},
+		{
+			"too old client",
+			Capabilities{Version: 1, MinVersion: 1, Features: []string{FeatureCodecJSON}},
+			nil,
+		},
+		{
+			"too new client",
+			Capabilities{Version: 5, MinVersion: 4, Features: []string{FeatureCodecJSON}},
+			nil,
+		},
+		{
+			"no common codec",
+			Capabilities{Version: 3, MinVersion: 3, Features: []string{"codec/msgpack", FeatureAcks}},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		// capabilities are sent over the wire
+		hello, err := ParseCapabilities(NewHello(test.client))
+		if err != nil {
+			t.Fatalf("%s: couldn't parse Hello; %v", test.name, err)
+		}
+
+		got, err := Negotiate(hello, server)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected client to be rejected, got %+v", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected client to be accepted; %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, *test.expected) {
+			t.Errorf("%s: expected\n%+v\ngot\n%+v", test.name, *test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package requests
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+
+	"github.com/iryonetwork/network-poc/state"
+)
+
+// Fields of recovery requests
+const (
+	FieldRecoveryID     = "recoveryID"
+	FieldThreshold      = "threshold"
+	FieldShare          = "share"
+	FieldKeyHash        = "keyHash"
+	FieldShareSignature = "shareSignature"
+	FieldRecoveryKey    = "recoveryKey"
+	FieldAccount        = "account"
+)
+
+// ShareData returns data the owner signs for each share. Threshold and hash of the key are bound
+// to the share, so that trustee can't make the owner combine wrong shares into a wrong key.
+// Recovery key is bound as well, so that trustee can't be made to return the share to another device
+func ShareData(share state.Share) []byte {
+	h := sha256.Sum256(share.Share)
+	return []byte(fmt.Sprintf("%s/%d/%x/%x/%s", share.ID, share.Threshold, h, share.KeyHash, share.RecoveryKey))
+}
+
+// RecoveryInvite asks `to` to hold a share of our master key
+func (s *Requests) RecoveryInvite(to, recoveryID string) error {
+	s.log.Debugf("WS:: Inviting %s to hold a share of our key", to)
+
+	r := NewReq("RecoveryInvite")
+	r.Append("to", to)
+	r.Append(FieldRecoveryID, recoveryID)
+
+	return s.send(r, to)
+}
+
+// RecoveryAccept accepts invite of `to`, the share will be sealed with our X25519 key
+func (s *Requests) RecoveryAccept(to, recoveryID string) error {
+	s.log.Debugf("WS:: Accepting to hold a share of %s's key", to)
+
+	r := NewReq("RecoveryAccept")
+	r.Append("to", to)
+	r.Append(FieldRecoveryID, recoveryID)
+	if err := s.appendX25519Key(r); err != nil {
+		return err
+	}
+
+	return s.send(r, to)
+}
+
+// StoreShare sends share of our master key to trustee `to`, signed with our EOS key
+func (s *Requests) StoreShare(to string, x25519Key []byte, share state.Share) error {
+	s.log.Debugf("WS:: Sending share of our key to %s", to)
+
+	sign, err := s.eos.SignHash(ShareData(share))
+	if err != nil {
+		return err
+	}
+	share.Signature = sign
+	return s.sendShare("StoreShare", to, x25519Key, share)
+}
+
+// RecoveryRequest asks trustee `to` to return the share of `account`'s master key to this device.
+// Device has no account, the request is signed with the recovery key the share is bound to
+func (s *Requests) RecoveryRequest(to, account string) error {
+	s.log.Debugf("WS:: Requesting share of %s's key from %s", account, to)
+
+	r := NewReq("RecoveryRequest")
+	r.Append("to", to)
+	r.Append(FieldAccount, account)
+	if err := s.appendX25519Key(r); err != nil {
+		return err
+	}
+
+	return s.send(r, to)
+}
+
+// RecoveryShare returns share entrusted to us to owner's device `to`, which is identified by
+// the share's recovery key, sealed with its X25519 key `x25519Key`
+func (s *Requests) RecoveryShare(to string, x25519Key []byte, share state.Share) error {
+	s.log.Debugf("WS:: Returning share to %s", to)
+
+	return s.sendShare("RecoveryShare", to, x25519Key, share)
+}
+
+func (s *Requests) sendShare(name, to string, x25519Key []byte, share state.Share) error {
+	r := NewReq(name)
+	r.Append("to", to)
+
+	recipient := new([32]byte)
+	copy(recipient[:], x25519Key)
+	sealed, err := SealKey(recipient, share.Share)
+	if err != nil {
+		return err
+	}
+	r.Append(FieldShare, base64.StdEncoding.EncodeToString(sealed))
+	r.Append(FieldRecoveryID, share.ID)
+	r.Append(FieldThreshold, strconv.Itoa(share.Threshold))
+	r.Append(FieldKeyHash, base64.StdEncoding.EncodeToString(share.KeyHash))
+	r.Append(FieldRecoveryKey, share.RecoveryKey)
+	r.Append(FieldShareSignature, share.Signature)
+
+	return s.send(r, to)
+}
+
+// appendX25519Key adds our X25519 public key, it's authenticated by the request's signature
+func (s *Requests) appendX25519Key(r *Request) error {
+	public, _, err := X25519KeyPair(s.state.EosPrivate)
+	if err != nil {
+		return err
+	}
+	r.Append(FieldX25519Key, base64.StdEncoding.EncodeToString(public[:]))
+	return nil
+}
@@ -12,7 +12,8 @@ import (
 
 	"github.com/iryonetwork/network-poc/config"
 	"github.com/iryonetwork/network-poc/state"
-	"github.com/iryonetwork/network-poc/storage/eos"
+	"github.com/iryonetwork/network-poc/storage/ehr"
+	"github.com/iryonetwork/network-poc/storage/ledger"
 
 	"github.com/gorilla/websocket"
 	"github.com/iryonetwork/network-poc/logger"
@@ -22,11 +23,17 @@ type Requests struct {
 	log    *logger.Log
 	config *config.Config
 	state  *state.State
-	conn   *websocket.Conn
-	eos    *eos.Storage
+	conn   Conn
+	eos    ledger.Ledger
 }
 
-func NewRequests(log *logger.Log, cfg *config.Config, state *state.State, conn *websocket.Conn, eos *eos.Storage) *Requests {
+// Conn is the ws connection requests are written to, *websocket.Conn or
+// a wrapper that allows writes from several goroutines
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
+}
+
+func NewRequests(log *logger.Log, cfg *config.Config, state *state.State, conn Conn, eos ledger.Ledger) *Requests {
 	return &Requests{log, cfg, state, conn, eos}
 }
 
@@ -40,10 +47,38 @@ func (s *Requests) SendKey(to string) error {
 		return fmt.Errorf("No key from user %s found", to)
 	}
 
-	// Encrypt key
-	rnd := rand.Reader
-	encKey, err := rsa.EncryptOAEP(sha512.New(), rnd, accessRequest.Key, s.state.EncryptionKeys[s.state.EosAccount], []byte{})
+	// Send only keys of categories shared with the user
+	categories, ok := s.state.Connections.Categories[to]
+	if !ok {
+		categories = ehr.Categories
+	}
+	keys, err := ehr.ParseKeys(s.state.EncryptionKeys[s.state.EosAccount])
+	if err != nil {
+		return err
+	}
+	shared, err := keys.Share(categories)
+	if err != nil {
+		return err
+	}
+	key, err := shared.Encode()
+	if err != nil {
+		return err
+	}
 
+	// Encrypt key, prefer sealed box if requester supports it
+	var encKey []byte
+	switch {
+	case accessRequest.X25519Key != nil:
+		to := new([32]byte)
+		copy(to[:], accessRequest.X25519Key)
+		encKey, err = SealKey(to, key)
+		r.Append(FieldKeyAlg, KeyAlgX25519)
+	case accessRequest.Key != nil:
+		encKey, err = rsa.EncryptOAEP(sha512.New(), rand.Reader, accessRequest.Key, key, []byte{})
+		r.Append(FieldKeyAlg, KeyAlgRSA)
+	default:
+		return fmt.Errorf("User %s did not send a key to encrypt the key with", to)
+	}
 	if err != nil {
 		return err
 	}
@@ -52,12 +87,12 @@ func (s *Requests) SendKey(to string) error {
 	// append customData if set
 	r.Append("customData", accessRequest.CustomData)
 
-	req, err := r.Encode()
-	if err != nil {
-		return err
+	// let the requester match the key to its request
+	if accessRequest.CorrelationID != "" {
+		r.Append(FieldCorrelationID, accessRequest.CorrelationID)
 	}
 
-	err = s.conn.WriteMessage(websocket.BinaryMessage, req)
+	err = s.send(r, to)
 	s.log.Debugf("Sent SendKey request")
 	return err
 }
@@ -67,35 +102,58 @@ func (s *Requests) RevokeKey(to string) error {
 
 	r := NewReq("RevokeKey")
 	r.Append("to", to)
-	req, err := r.Encode()
-	if err != nil {
-		return err
-	}
-	err = s.conn.WriteMessage(websocket.BinaryMessage, req)
-	return err
+
+	return s.send(r, to)
 }
 
 func (s *Requests) RequestsKey(to, customData string) error {
+	return s.RequestsKeyWithID(to, customData, "")
+}
+
+// RequestsKeyWithID requests the key from `to`. Response to the request will carry `correlationID`
+func (s *Requests) RequestsKeyWithID(to, customData, correlationID string) error {
 	s.log.Debugf("WS:: Requesting encryption key from %s", to)
 
 	r := NewReq("RequestKey")
 	r.Append("to", to)
 
-	// Generate public key
-	key, err := rsaPublicToByte(&s.state.RSAKey.PublicKey)
+	// X25519 key is derived from our EOS key
+	public, _, err := X25519KeyPair(s.state.EosPrivate)
 	if err != nil {
 		return err
 	}
+	key := []byte(base64.StdEncoding.EncodeToString(public[:]))
+	r.Append(FieldX25519Key, string(key))
+
+	// Older clients only know RSA, send RSA key as well if `to` uses one or legacy keys are enabled
+	legacy := s.config.LegacyRSAKeys || s.state.IsLegacy(to)
+	if legacy {
+		rsaKey, err := s.state.LegacyRSAKey()
+		if err != nil {
+			return err
+		}
+		if key, err = rsaPublicToByte(&rsaKey.PublicKey); err != nil {
+			return err
+		}
+		r.Append("key", string(key))
+	}
 
-	r.Append("key", string(key))
-
-	// Sign the key
+	// Sign the key, RSA key if it was sent, X25519 key otherwise
 	sign, err := s.eos.SignHash(key)
 	if err != nil {
 		return err
 	}
 	r.Append("signature", sign)
 
+	// X25519 key sent along RSA key is signed on its own
+	if legacy {
+		sign, err := s.eos.SignHash([]byte(base64.StdEncoding.EncodeToString(public[:])))
+		if err != nil {
+			return err
+		}
+		r.Append(FieldX25519Signature, sign)
+	}
+
 	// Add your EOS key
 	r.Append("eoskey", s.state.GetEosPublicKey())
 
@@ -104,8 +162,22 @@ func (s *Requests) RequestsKey(to, customData string) error {
 		r.Append("customData", customData)
 	}
 
-	req, err := r.Encode()
-	err = s.conn.WriteMessage(websocket.BinaryMessage, req)
+	if correlationID != "" {
+		r.Append(FieldCorrelationID, correlationID)
+	}
+
+	err = s.send(r, to)
+
+	// Remember that we're waiting for the key
+	awaiting := false
+	for _, v := range s.state.Connections.Awaiting {
+		if v == to {
+			awaiting = true
+		}
+	}
+	if !awaiting {
+		s.state.Connections.Awaiting = append(s.state.Connections.Awaiting, to)
+	}
 
 	// Check if user is on GrantedWithoutKeys list
 	for i, v := range s.state.Connections.WithoutKey {
@@ -142,11 +214,56 @@ func (s *Requests) NotifyGranted(to, customData string) error {
 		r.Append("customData", customData)
 	}
 
-	req, err := r.Encode()
-	if err != nil {
-		return err
+	return s.send(r, to)
+}
+
+// NotifyRelinquished lets patient `to` know that we gave up access they granted us
+func (s *Requests) NotifyRelinquished(to string) error {
+	s.log.Debugf("WS:: Notifying %s that access was relinquished", to)
+
+	r := NewReq("NotifyRelinquished")
+	r.Append("to", to)
+
+	return s.send(r, to)
+}
+
+// DenyKey lets `to` know that its key request was denied
+func (s *Requests) DenyKey(to, reason string) error {
+	s.log.Debugf("WS:: Denying key request from %s", to)
+
+	r := NewReq("DenyKey")
+	r.Append("to", to)
+	if reason != "" {
+		r.Append("reason", reason)
+	}
+
+	// let the requester match the denial to its request
+	if accessRequest, ok := s.state.Connections.Requested[to]; ok && accessRequest.CorrelationID != "" {
+		r.Append(FieldCorrelationID, accessRequest.CorrelationID)
+	}
+
+	return s.send(r, to)
+}
+
+// CancelKeyRequest withdraws our key request made to `to`
+func (s *Requests) CancelKeyRequest(to, reason string) error {
+	s.log.Debugf("WS:: Cancelling key request made to %s", to)
+
+	r := NewReq("CancelKeyRequest")
+	r.Append("to", to)
+	if reason != "" {
+		r.Append("reason", reason)
+	}
+
+	err := s.send(r, to)
+
+	// We no longer wait for the key
+	for i, v := range s.state.Connections.Awaiting {
+		if v == to {
+			s.state.Connections.Awaiting = append(s.state.Connections.Awaiting[:i], s.state.Connections.Awaiting[i+1:]...)
+		}
 	}
-	err = s.conn.WriteMessage(websocket.BinaryMessage, req)
+
 	return err
 }
 
@@ -154,15 +271,28 @@ func (s *Requests) ReencryptRequest() error {
 	s.log.Debugf("WS: Sending reeencrypted notification")
 
 	r := NewReq("Reencrypt")
+
+	// Reencrypt is sent to all connected users, so it has no recipient
+	return s.send(r, "")
+}
+
+// send signs the request with our EOS key and writes it to the api
+func (s *Requests) send(r *Request, to string) error {
+	if err := r.Sign(s.state.Sender(), to, s.eos.SignHash); err != nil {
+		return fmt.Errorf("failed to sign %s request; %v", r.Name, err)
+	}
+
 	req, err := r.Encode()
 	if err != nil {
 		return err
 	}
-	err = s.conn.WriteMessage(websocket.BinaryMessage, req)
 
-	return err
+	return s.conn.WriteMessage(websocket.BinaryMessage, req)
 }
 
+// FieldCorrelationID is set on requests that expect an answer and copied to the answer
+const FieldCorrelationID = "correlationID"
+
 type Request struct {
 	Name   string
 	Fields map[string]string
@@ -0,0 +1,57 @@
+package requests
+
+import (
+	"testing"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/state"
+	"github.com/iryonetwork/network-poc/storage/ledger"
+)
+
+// captureConn keeps the last request written to it
+type captureConn struct {
+	last *Request
+}
+
+func (c *captureConn) WriteMessage(messageType int, data []byte) error {
+	r, err := Decode(data)
+	c.last = r
+	return err
+}
+
+func TestRequestKeyWithLegacyPeer(t *testing.T) {
+	cfg := &config.Config{EosAccount: "doctor1.iryo"}
+	log := logger.New(cfg)
+	st, err := state.New(cfg, log)
+	if err != nil {
+		t.Fatalf("state.New failed: %v", err)
+	}
+	l := ledger.NewMemory(st, "", log)
+	if err := l.NewKey(); err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	conn := &captureConn{}
+	r := NewRequests(log, cfg, st, conn, l)
+
+	if err := r.RequestsKey("patient.iryo", ""); err != nil {
+		t.Fatalf("RequestsKey failed: %v", err)
+	}
+	if _, err := conn.last.GetData("key"); err == nil {
+		t.Error("Expected RSA key not to be sent to client that supports sealed boxes")
+	}
+	if st.RSAKey != nil {
+		t.Error("Expected RSA key not to be generated")
+	}
+
+	st.SetLegacy("old.iryo")
+	if err := r.RequestsKey("old.iryo", ""); err != nil {
+		t.Fatalf("RequestsKey failed: %v", err)
+	}
+	if _, err := conn.last.GetData("key"); err != nil {
+		t.Error("Expected RSA key to be sent to legacy client")
+	}
+	if _, err := conn.last.GetDataString(FieldX25519Signature); err != nil {
+		t.Error("Expected X25519 key sent along RSA key to be signed")
+	}
+}
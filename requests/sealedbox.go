@@ -0,0 +1,87 @@
+package requests
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Algorithms used to send the encryption key in SendKey
+const (
+	KeyAlgRSA    = "rsa-oaep"
+	KeyAlgX25519 = "x25519"
+
+	// FieldKeyAlg names the algorithm used to encrypt the key
+	FieldKeyAlg = "keyAlg"
+	// FieldX25519Key is the requester's X25519 public key in RequestKey
+	FieldX25519Key = "x25519key"
+	// FieldX25519Signature is signature of the X25519 key, sent when `signature` is made over RSA key
+	FieldX25519Signature = "x25519signature"
+)
+
+const sealedBoxOverhead = 32 + box.Overhead
+
+// X25519KeyPair derives X25519 key pair from EOS private key, so the pair does not have
+// to be generated and stored. Public key is authenticated by the EOS signature of the request
+func X25519KeyPair(eosPrivate string) (public, private *[32]byte, err error) {
+	public, private = new([32]byte), new([32]byte)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(eosPrivate), nil, []byte("iryo x25519")), private[:]); err != nil {
+		return nil, nil, err
+	}
+	curve25519.ScalarBaseMult(public, private)
+	return public, private, nil
+}
+
+// SealKey encrypts message so that only owner of `to` public key can read it.
+// Format is compatible with libsodium's crypto_box_seal: ephemeral public key || box
+func SealKey(to *[32]byte, message []byte) ([]byte, error) {
+	ephemeralPublic, ephemeralPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := sealNonce(ephemeralPublic, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return box.Seal(ephemeralPublic[:], message, nonce, to, ephemeralPrivate), nil
+}
+
+// OpenKey decrypts message sealed with SealKey
+func OpenKey(public, private *[32]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealedBoxOverhead {
+		return nil, fmt.Errorf("Sealed key too short")
+	}
+	ephemeralPublic := new([32]byte)
+	copy(ephemeralPublic[:], sealed[:32])
+
+	nonce, err := sealNonce(ephemeralPublic, public)
+	if err != nil {
+		return nil, err
+	}
+	out, ok := box.Open(nil, sealed[32:], nonce, ephemeralPublic, private)
+	if !ok {
+		return nil, fmt.Errorf("Failed to open sealed key")
+	}
+	return out, nil
+}
+
+// sealNonce is blake2b(ephemeral public key || recipient's public key)
+func sealNonce(ephemeralPublic, to *[32]byte) (*[24]byte, error) {
+	h, err := blake2b.New(24, nil)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(ephemeralPublic[:])
+	h.Write(to[:])
+
+	nonce := new([24]byte)
+	copy(nonce[:], h.Sum(nil))
+	return nonce, nil
+}
@@ -0,0 +1,34 @@
+package requests
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealKey(t *testing.T) {
+	public, private, err := X25519KeyPair("5KQwrPbwdL6PhXujxW37FSSQZ1JiwsST4cqQzDeyXtP79zkvFD3")
+	if err != nil {
+		t.Fatalf("X25519KeyPair failed: %v", err)
+	}
+	again, _, _ := X25519KeyPair("5KQwrPbwdL6PhXujxW37FSSQZ1JiwsST4cqQzDeyXtP79zkvFD3")
+	if *again != *public {
+		t.Error("Key pair derived from the same EOS key should not change")
+	}
+
+	sealed, err := SealKey(public, []byte("key"))
+	if err != nil {
+		t.Fatalf("SealKey failed: %v", err)
+	}
+	opened, err := OpenKey(public, private, sealed)
+	if err != nil {
+		t.Fatalf("OpenKey failed: %v", err)
+	}
+	if !bytes.Equal(opened, []byte("key")) {
+		t.Errorf("Expected key, got %s", opened)
+	}
+
+	other, otherPrivate, _ := X25519KeyPair("5HpHagT65TZzG1PH3CSu63k8DbpvD8s5ip4nEB3kEsreAbuatmU")
+	if _, err := OpenKey(other, otherPrivate, sealed); err == nil {
+		t.Error("Sealed key should not open with other key")
+	}
+}
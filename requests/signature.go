@@ -0,0 +1,182 @@
+package requests
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/eoscanada/eos-go/ecc"
+)
+
+const (
+	FieldNonce     = "nonce"
+	FieldTimestamp = "timestamp"
+	FieldSignature = "messageSignature"
+
+	// maxClockSkew is how far in the future a message timestamp is still accepted
+	maxClockSkew = 5 * time.Minute
+)
+
+// Fields added or removed by the api while relaying a message. They are not
+// covered by the sender's signature; `from` and `to` are signed separately.
+var transportFields = map[string]bool{
+	"from":          true,
+	"to":            true,
+	"name":          true,
+	FieldSignature:  true,
+	FieldDeliveryID: true,
+}
+
+// Names under which the api delivers relayed requests
+var relayedAs = map[string]string{
+	"SendKey": "ImportKey",
+}
+
+// Requests that are sent to every connected user and therefore have no recipient
+var broadcasts = map[string]bool{
+	"Reencrypt": true,
+}
+
+// Requests created by the api itself. These are the only requests that are
+// accepted without the sender's signature.
+var apiOriginated = map[string]bool{
+	"NewUpload":     true,
+	"AccessGranted": true,
+	"AccessRevoked": true,
+}
+
+// RelayedName returns the name under which the api delivers request `name`
+func RelayedName(name string) string {
+	if relayed, ok := relayedAs[name]; ok {
+		return relayed
+	}
+	return name
+}
+
+// RequiresSignature reports whether request `name` has to be signed by its sender
+func RequiresSignature(name string) bool {
+	return !apiOriginated[name]
+}
+
+// Relay creates the request that the api delivers in place of `in`, sent by `from`.
+// All signed fields are copied as they are, so that the recipient can verify them.
+func Relay(in *Request, from string) *Request {
+	out := NewReq(RelayedName(in.Name))
+	for k, v := range in.Fields {
+		if k == "to" {
+			continue
+		}
+		out.Append(k, v)
+	}
+	out.Append("from", from)
+
+	return out
+}
+
+// Sign adds nonce and timestamp to the request and signs its canonical encoding
+// as sent from `from` to `to` using `sign`
+func (r *Request) Sign(from, to string, sign func(data []byte) (string, error)) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce; %v", err)
+	}
+	r.Append(FieldNonce, hex.EncodeToString(nonce))
+	r.Append(FieldTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+
+	data, err := r.canonical(RelayedName(r.Name), from, to)
+	if err != nil {
+		return err
+	}
+	signature, err := sign(data)
+	if err != nil {
+		return err
+	}
+	r.Append(FieldSignature, signature)
+
+	return nil
+}
+
+// SignerKey returns the EOS public key that signed the request as it was
+// delivered to `self`. It's on the caller to check that the key belongs to sender.
+func (r *Request) SignerKey(self string) (ecc.PublicKey, error) {
+	strsign, err := r.GetDataString(FieldSignature)
+	if err != nil {
+		return ecc.PublicKey{}, fmt.Errorf("Request %s is not signed", r.Name)
+	}
+	from, err := r.GetDataString("from")
+	if err != nil {
+		return ecc.PublicKey{}, err
+	}
+
+	to := self
+	if broadcasts[r.Name] {
+		to = ""
+	}
+	data, err := r.canonical(r.Name, from, to)
+	if err != nil {
+		return ecc.PublicKey{}, err
+	}
+
+	sign, err := ecc.NewSignature(strsign)
+	if err != nil {
+		return ecc.PublicKey{}, err
+	}
+	hash := sha256.Sum256(data)
+	key, err := sign.PublicKey(hash[:])
+	if err != nil {
+		return ecc.PublicKey{}, fmt.Errorf("Signature could not be verified; %v", err)
+	}
+
+	return key, nil
+}
+
+// Nonce returns request's nonce and the time it was signed at.
+// Returns error if the time is too far in the future or older than maxAge
+func (r *Request) Nonce(maxAge time.Duration) (string, time.Time, error) {
+	nonce, err := r.GetDataString(FieldNonce)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ts, err := r.GetDataString(FieldTimestamp)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Invalid timestamp %s", ts)
+	}
+
+	signedAt := time.Unix(unix, 0)
+	if time.Until(signedAt) > maxClockSkew {
+		return "", time.Time{}, fmt.Errorf("Request %s was signed in the future (%s)", r.Name, signedAt)
+	}
+	if time.Since(signedAt) > maxAge {
+		return "", time.Time{}, fmt.Errorf("Request %s has expired (signed at %s)", r.Name, signedAt)
+	}
+
+	return nonce, signedAt, nil
+}
+
+// canonical returns deterministic encoding of the request covered by the signature.
+// Empty fields are left out, as the api does not relay them.
+func (r *Request) canonical(name, from, to string) ([]byte, error) {
+	fields := make(map[string]string)
+	for k, v := range r.Fields {
+		if transportFields[k] || v == "" {
+			continue
+		}
+		fields[k] = v
+	}
+
+	// json.Marshal sorts map keys, which makes the encoding deterministic
+	return json.Marshal(struct {
+		Name   string            `json:"name"`
+		From   string            `json:"from"`
+		To     string            `json:"to"`
+		Fields map[string]string `json:"fields"`
+	}{name, from, to, fields})
+}
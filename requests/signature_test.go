@@ -0,0 +1,93 @@
+package requests
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go/ecc"
+)
+
+func signWith(key *ecc.PrivateKey) func([]byte) (string, error) {
+	return func(data []byte) (string, error) {
+		hash := sha256.Sum256(data)
+		sign, err := key.Sign(hash[:])
+		return sign.String(), err
+	}
+}
+
+func TestSignedRequestSurvivesRelay(t *testing.T) {
+	key, err := ecc.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatalf("Couldn't generate EOS key")
+	}
+
+	r := NewReq("SendKey")
+	r.Append("to", "doctor.iryo")
+	r.Append("key", "encrypted key")
+	r.Append("customData", "")
+	if err := r.Sign("patient.iryo", "doctor.iryo", signWith(key)); err != nil {
+		t.Fatalf("Couldn't sign request; %v", err)
+	}
+
+	// api relays the request and adds its own fields
+	delivered := Relay(r, "patient.iryo")
+	delivered.Append("name", "Janez Primer")
+	if delivered.Name != "ImportKey" {
+		t.Errorf("Expected request to be delivered as ImportKey, got %s", delivered.Name)
+	}
+
+	signer, err := delivered.SignerKey("doctor.iryo")
+	if err != nil {
+		t.Fatalf("Couldn't get signer's key; %v", err)
+	}
+	if signer.String() != key.PublicKey().String() {
+		t.Errorf("Expected request to be signed by\n%s\ngot\n%s", key.PublicKey(), signer)
+	}
+
+	if _, _, err := delivered.Nonce(time.Minute); err != nil {
+		t.Errorf("Expected fresh request to be accepted; %v", err)
+	}
+}
+
+func TestForgedRequestIsDetected(t *testing.T) {
+	key, err := ecc.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatalf("Couldn't generate EOS key")
+	}
+
+	r := NewReq("RevokeKey")
+	r.Append("to", "doctor.iryo")
+	if err := r.Sign("patient.iryo", "doctor.iryo", signWith(key)); err != nil {
+		t.Fatalf("Couldn't sign request; %v", err)
+	}
+
+	tests := map[string]func(r *Request) *Request{
+		"different sender": func(r *Request) *Request {
+			return Relay(r, "other.iryo")
+		},
+		"different request": func(r *Request) *Request {
+			out := Relay(r, "patient.iryo")
+			out.Name = "Reencrypt"
+			return out
+		},
+		"changed field": func(r *Request) *Request {
+			out := Relay(r, "patient.iryo")
+			out.Append("customData", "injected")
+			return out
+		},
+	}
+
+	for name, forge := range tests {
+		signer, err := forge(r).SignerKey("doctor.iryo")
+		if err == nil && signer.String() == key.PublicKey().String() {
+			t.Errorf("%s: expected forged request not to verify", name)
+		}
+	}
+
+	// request was meant for someone else
+	signer, err := Relay(r, "patient.iryo").SignerKey("other.iryo")
+	if err == nil && signer.String() == key.PublicKey().String() {
+		t.Errorf("Expected request delivered to wrong recipient not to verify")
+	}
+}
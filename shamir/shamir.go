@@ -0,0 +1,126 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+// Secret is split into n shares, any k of which can reconstruct it,
+// while fewer than k shares reveal nothing about the secret.
+package shamir
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Share is the share's y coordinates followed by its x coordinate (1 byte)
+type Share []byte
+
+// Split splits secret into n shares, k of which are needed to combine it
+func Split(secret []byte, n, k int) ([]Share, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Secret is empty")
+	}
+	if k < 2 || k > n || n > 255 {
+		return nil, fmt.Errorf("Invalid threshold %d of %d shares", k, n)
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = make(Share, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	// random polynomial of degree k-1 for each byte, constant term is the byte of secret
+	coefficients := make([]byte, k)
+	for j, b := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = b
+		for _, share := range shares {
+			share[j] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine reconstructs the secret from shares. If fewer shares than needed are
+// given, the result is not the secret; it can't be detected here
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("At least 2 shares are needed")
+	}
+	length := len(shares[0])
+	if length < 2 {
+		return nil, fmt.Errorf("Share is too short")
+	}
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool)
+	for i, share := range shares {
+		if len(share) != length {
+			return nil, fmt.Errorf("Shares have different lengths")
+		}
+		x := share[length-1]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("Invalid or duplicate share %d", x)
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	// Lagrange interpolation at x = 0
+	secret := make([]byte, length-1)
+	for i, share := range shares {
+		basis := byte(1)
+		for j, x := range xs {
+			if i == j {
+				continue
+			}
+			basis = mul(basis, div(x, x^xs[i]))
+		}
+		for b := range secret {
+			secret[b] ^= mul(share[b], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// evaluate evaluates polynomial at x using Horner's method
+func evaluate(coefficients []byte, x byte) byte {
+	out := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		out = mul(out, x) ^ coefficients[i]
+	}
+	return out
+}
+
+// Tables of powers and logarithms of generator 3 in GF(2^8) with AES polynomial
+var (
+	expTable [255]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		// multiply by 3 = x * 2 + x
+		x ^= x<<1 ^ byte(int8(x)>>7)&0x1b
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if b == 0 {
+		panic("shamir: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
@@ -0,0 +1,52 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := bytes.Repeat([]byte{1, 2, 3, 255}, 8)
+
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+
+	// any 3 shares combine to the secret
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked []Share
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		combined, err := Combine(picked)
+		if err != nil {
+			t.Fatalf("Combine failed: %v", err)
+		}
+		if !bytes.Equal(combined, secret) {
+			t.Errorf("Shares %v did not combine to the secret", subset)
+		}
+	}
+
+	combined, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatalf("Combine failed: %v", err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Error("2 of 3 shares should not combine to the secret")
+	}
+
+	if _, err := Combine([]Share{shares[0], shares[0]}); err == nil {
+		t.Error("Duplicate shares should be rejected")
+	}
+}
+
+func TestField(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if div(mul(byte(a), byte(b)), byte(b)) != byte(a) {
+				t.Fatalf("%d * %d / %d != %d", a, b, b, a)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package state
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/iryonetwork/network-poc/openEHR"
+)
+
+// Identity backup format:
+//
+//	magic (4 bytes) | version (1 byte) | scrypt log2(N) (1 byte) | salt (16 bytes) | nonce (12 bytes) | AES-GCM ciphertext
+//
+// The key is derived from passphrase with scrypt (N, r = 8, p = 1),
+// header up to the nonce is authenticated as associated data
+const (
+	backupVersion    = 1
+	backupLogN       = 15
+	backupSaltLength = 16
+	backupHeader     = 4 + 2 + backupSaltLength
+	backupNonce      = 12
+)
+
+var backupMagic = []byte("IRYB")
+
+// identity is what is needed to continue as the same user on another device
+type identity struct {
+	EosPrivate     string
+	EosAccount     string
+	PersonalData   *openEHR.PersonalData
+	EncryptionKeys map[string][]byte
+	RSAKey         *rsa.PrivateKey
+	Connections    Connections
+	Directory      map[string]string
+	Recovery       Recovery
+	Seed           Seed
+}
+
+// Export exports identity as an archive encrypted with passphrase
+func (s *State) Export(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("Passphrase is required")
+	}
+	data, err := json.Marshal(identity{
+		EosPrivate:     s.EosPrivate,
+		EosAccount:     s.EosAccount,
+		PersonalData:   s.PersonalData,
+		EncryptionKeys: s.EncryptionKeys,
+		RSAKey:         s.RSAKey,
+		Connections:    s.Connections,
+		Directory:      s.Directory,
+		Recovery:       s.Recovery,
+		Seed:           s.Seed,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append([]byte{}, backupMagic...), backupVersion, backupLogN)
+	salt := make([]byte, backupSaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+
+	aesgcm, err := backupCipher(passphrase, backupLogN, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, backupNonce)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aesgcm.Seal(append(header, nonce...), nonce, data, header), nil
+}
+
+// Import restores identity from archive created by Export and saves the state
+func (s *State) Import(archive []byte, passphrase string) error {
+	if len(archive) < backupHeader+backupNonce || !bytes.Equal(archive[:len(backupMagic)], backupMagic) {
+		return fmt.Errorf("Not an identity backup")
+	}
+	if archive[len(backupMagic)] != backupVersion {
+		return fmt.Errorf("Unknown identity backup version %d", archive[len(backupMagic)])
+	}
+	logN := archive[len(backupMagic)+1]
+	if logN < 10 || logN > 20 {
+		return fmt.Errorf("Invalid identity backup parameters")
+	}
+	header := archive[:backupHeader]
+
+	aesgcm, err := backupCipher(passphrase, logN, header[len(header)-backupSaltLength:])
+	if err != nil {
+		return err
+	}
+	nonce := archive[backupHeader : backupHeader+backupNonce]
+	data, err := aesgcm.Open(nil, nonce, archive[backupHeader+backupNonce:], header)
+	if err != nil {
+		return fmt.Errorf("Wrong passphrase or damaged backup")
+	}
+
+	id := identity{}
+	if err := json.Unmarshal(data, &id); err != nil {
+		return err
+	}
+	if id.EosPrivate == "" || id.EosAccount == "" {
+		return fmt.Errorf("Backup does not contain an account")
+	}
+
+	s.EosPrivate = id.EosPrivate
+	s.EosAccount = id.EosAccount
+	s.PersonalData = id.PersonalData
+	s.EncryptionKeys = id.EncryptionKeys
+	s.RSAKey = id.RSAKey
+	s.Connections = id.Connections
+	s.Directory = id.Directory
+	s.Recovery = id.Recovery
+	s.Recovery.init()
+	s.Seed = id.Seed
+	if s.EncryptionKeys == nil {
+		s.EncryptionKeys = make(map[string][]byte)
+	}
+	if s.Directory == nil {
+		s.Directory = make(map[string]string)
+	}
+	if s.Connections.Requested == nil {
+		s.Connections.Requested = make(map[string]Request)
+	}
+	if s.Connections.Categories == nil {
+		s.Connections.Categories = make(map[string][]string)
+	}
+	if s.Connections.Expires == nil {
+		s.Connections.Expires = make(map[string]time.Time)
+	}
+
+	return s.Save()
+}
+
+func backupCipher(passphrase string, logN byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<logN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+)
+
+func TestBackup(t *testing.T) {
+	cfg := &config.Config{}
+	log := logger.New(cfg)
+
+	s, err := New(cfg, log)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	s.EosPrivate = "5KRuLTUU5pzPBhVPv2JkgXGtRoCM8g36PRCAxaCANYwJ7DH15tn"
+	s.EosAccount = "abcdefg.iryo"
+	s.EncryptionKeys[s.EosAccount] = bytes.Repeat([]byte{1}, 32)
+	s.Connections.GrantedTo = []string{"doctor1.iryo"}
+	s.Directory["doctor1.iryo"] = "Doctor"
+
+	archive, err := s.Export("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	restored, err := New(cfg, log)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := restored.Import(archive, "wrong passphrase"); err == nil {
+		t.Error("Import with wrong passphrase should fail")
+	}
+	if err := restored.Import(archive, "correct horse battery staple"); err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+
+	if restored.EosPrivate != s.EosPrivate || restored.EosAccount != s.EosAccount {
+		t.Errorf("Expected account %s, got %s", s.EosAccount, restored.EosAccount)
+	}
+	if !reflect.DeepEqual(restored.EncryptionKeys, s.EncryptionKeys) {
+		t.Errorf("Expected encryption keys %v, got %v", s.EncryptionKeys, restored.EncryptionKeys)
+	}
+	if !reflect.DeepEqual(restored.Connections, s.Connections) {
+		t.Errorf("Expected connections %v, got %v", s.Connections, restored.Connections)
+	}
+	if !reflect.DeepEqual(restored.Directory, s.Directory) {
+		t.Errorf("Expected directory %v, got %v", s.Directory, restored.Directory)
+	}
+
+	// header is authenticated
+	archive[len(backupMagic)+2] ^= 1
+	if err := restored.Import(archive, "correct horse battery staple"); err == nil {
+		t.Error("Import of modified backup should fail")
+	}
+}
@@ -0,0 +1,179 @@
+package state
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/eoscanada/eos-go/ecc"
+	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Keys of the user are derived from BIP39 mnemonic of 24 words, so that the identity can be
+// restored from the phrase alone. Seed of the mnemonic (without passphrase) is expanded with
+// HKDF-SHA256 into
+//
+//	EOS key:     info "iryo eos"
+//	record keys: info "iryo record key <generation>", generation 0 is the initial key
+//
+// X25519 key is derived from the EOS key, so it follows as well. Legacy RSA key stays random.
+// Neither the mnemonic nor the seed are saved, only generation of the record key in use. The seed
+// is derived again from MNEMONIC on start, record keys rotated to without it are random.
+const (
+	mnemonicEntropy = 256
+	// MaxKeyGeneration bounds the search for record key in use when restoring from mnemonic
+	MaxKeyGeneration = 64
+	// MnemonicChallengeWords is number of words user has to type to confirm the phrase was written down
+	MnemonicChallengeWords = 3
+)
+
+// Seed keeps what is needed to derive the keys of the user, only the generation is saved
+type Seed struct {
+	Mnemonic   string `json:"-"` // shown to the user until they confirm they wrote it down or the client stops
+	Challenge  []int  `json:"-"` // positions of words the user has to type to confirm the mnemonic
+	Seed       []byte `json:"-"`
+	Generation int    // generation of the record key in use
+}
+
+// NewMnemonic generates new mnemonic of 24 words
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropy)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// NewMnemonicKey derives EOS key from new mnemonic, which is kept until user confirms
+// they wrote it down
+func (s *State) NewMnemonicKey() error {
+	mnemonic, err := NewMnemonic()
+	if err != nil {
+		return err
+	}
+	if err := s.SetMnemonic(mnemonic); err != nil {
+		return err
+	}
+	s.Seed.Mnemonic = mnemonic
+	return nil
+}
+
+// SetMnemonic derives EOS key from the mnemonic and keeps the seed to derive record keys from.
+// Generation of the record key in use is kept
+func (s *State) SetMnemonic(mnemonic string) error {
+	mnemonic = strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return fmt.Errorf("Invalid mnemonic; %v", err)
+	}
+	key, err := ecc.NewDeterministicPrivateKey(seedReader(seed, "iryo eos"))
+	if err != nil {
+		return err
+	}
+
+	s.EosPrivate = key.String()
+	s.Seed = Seed{Seed: seed, Generation: s.Seed.Generation}
+	return nil
+}
+
+// RecordKey derives record key of generation from the seed
+func (s *State) RecordKey(generation int) ([]byte, error) {
+	if s.Seed.Seed == nil {
+		return nil, fmt.Errorf("Keys are not derived from mnemonic")
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(seedReader(s.Seed.Seed, fmt.Sprintf("iryo record key %d", generation)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NextRecordKey returns key to rotate to, derived from the seed if there is one and random otherwise
+func (s *State) NextRecordKey() ([]byte, error) {
+	if s.Seed.Seed != nil {
+		return s.RecordKey(s.Seed.Generation + 1)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// KeyRotated moves to next generation if key rotated to was derived from the seed
+func (s *State) KeyRotated(key []byte) {
+	for g := s.Seed.Generation + 1; s.Seed.Seed != nil && g <= MaxKeyGeneration; g++ {
+		if derived, err := s.RecordKey(g); err == nil && bytes.Equal(derived, key) {
+			s.Seed.Generation = g
+			return
+		}
+	}
+}
+
+// MnemonicChallenge picks positions (counted from 1) of words user has to type to confirm the phrase.
+// Positions are kept until the mnemonic is confirmed, so the same words are asked for on every page load
+func (s *State) MnemonicChallenge() ([]int, error) {
+	words := len(strings.Fields(s.Seed.Mnemonic))
+	if words == 0 {
+		return nil, fmt.Errorf("There is no mnemonic to confirm")
+	}
+	if len(s.Seed.Challenge) > 0 {
+		return s.Seed.Challenge, nil
+	}
+	positions := []int{}
+	for len(positions) < MnemonicChallengeWords && len(positions) < words {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(words)))
+		if err != nil {
+			return nil, err
+		}
+		position := int(n.Int64()) + 1
+		if !containsInt(positions, position) {
+			positions = append(positions, position)
+		}
+	}
+	s.Seed.Challenge = positions
+	return positions, s.Save()
+}
+
+// ConfirmMnemonic checks words typed by the user at positions picked by MnemonicChallenge against
+// the mnemonic, which is forgotten once they match. `words` maps positions (counted from 1) to the words
+func (s *State) ConfirmMnemonic(words map[int]string) error {
+	mnemonic := strings.Fields(s.Seed.Mnemonic)
+	if len(mnemonic) == 0 {
+		return fmt.Errorf("There is no mnemonic to confirm")
+	}
+	if len(s.Seed.Challenge) == 0 {
+		return fmt.Errorf("Words to confirm the mnemonic were not picked yet")
+	}
+	for _, position := range s.Seed.Challenge {
+		word, ok := words[position]
+		if !ok {
+			return fmt.Errorf("Word %d is missing", position)
+		}
+		if position < 1 || position > len(mnemonic) || mnemonic[position-1] != strings.ToLower(strings.TrimSpace(word)) {
+			return fmt.Errorf("Word %d does not match", position)
+		}
+	}
+
+	s.Seed.Mnemonic = ""
+	s.Seed.Challenge = nil
+	return s.Save()
+}
+
+func seedReader(seed []byte, info string) io.Reader {
+	return hkdf.New(sha256.New, seed, nil, []byte(info))
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
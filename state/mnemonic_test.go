@@ -0,0 +1,132 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+)
+
+func TestMnemonic(t *testing.T) {
+	cfg := &config.Config{}
+	log := logger.New(cfg)
+
+	mnemonic, err := NewMnemonic()
+	if err != nil {
+		t.Fatalf("NewMnemonic failed: %v", err)
+	}
+	if words := len(strings.Fields(mnemonic)); words != 24 {
+		t.Fatalf("Expected 24 words, got %d", words)
+	}
+
+	s, _ := New(cfg, log)
+	if err := s.SetMnemonic(mnemonic); err != nil {
+		t.Fatalf("SetMnemonic failed: %v", err)
+	}
+	key, err := s.RecordKey(0)
+	if err != nil {
+		t.Fatalf("RecordKey failed: %v", err)
+	}
+
+	// Same phrase typed on another device gives the same keys
+	restored, _ := New(cfg, log)
+	if err := restored.SetMnemonic(" " + strings.ToUpper(mnemonic) + "\n"); err != nil {
+		t.Fatalf("SetMnemonic failed: %v", err)
+	}
+	if restored.EosPrivate != s.EosPrivate {
+		t.Error("EOS keys differ")
+	}
+	if restoredKey, _ := restored.RecordKey(0); !bytes.Equal(restoredKey, key) {
+		t.Error("Record keys differ")
+	}
+	if next, _ := s.NextRecordKey(); bytes.Equal(next, key) {
+		t.Error("Next record key equals the initial one")
+	}
+
+	// Rotation to derived key moves to next generation
+	next, _ := s.NextRecordKey()
+	s.KeyRotated(next)
+	if s.Seed.Generation != 1 {
+		t.Errorf("Expected generation 1, got %d", s.Seed.Generation)
+	}
+
+	if err := restored.SetMnemonic(strings.Replace(mnemonic, strings.Fields(mnemonic)[0], "zoo", 1)); err == nil {
+		t.Error("Mnemonic with wrong checksum should be rejected")
+	}
+}
+
+func TestSeedNotSaved(t *testing.T) {
+	s, _ := New(&config.Config{}, logger.New(&config.Config{}))
+	if err := s.NewMnemonicKey(); err != nil {
+		t.Fatalf("NewMnemonicKey failed: %v", err)
+	}
+	mnemonic := s.Seed.Mnemonic
+	s.Seed.Generation = 2
+
+	data, err := json.Marshal(s.Seed)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	saved := Seed{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(saved, Seed{Generation: 2}) {
+		t.Errorf("Expected only generation to be saved, got %s", data)
+	}
+
+	// Seed derived on start keeps the saved generation
+	s.Seed = saved
+	if err := s.SetMnemonic(mnemonic); err != nil {
+		t.Fatalf("SetMnemonic failed: %v", err)
+	}
+	if s.Seed.Generation != 2 || s.Seed.Seed == nil {
+		t.Errorf("Expected seed with generation 2, got generation %d", s.Seed.Generation)
+	}
+}
+
+func TestConfirmMnemonic(t *testing.T) {
+	s, _ := New(&config.Config{}, logger.New(&config.Config{}))
+	s.Seed.Mnemonic, _ = NewMnemonic()
+	words := strings.Fields(s.Seed.Mnemonic)
+
+	positions, err := s.MnemonicChallenge()
+	if err != nil {
+		t.Fatalf("MnemonicChallenge failed: %v", err)
+	}
+	if len(positions) != MnemonicChallengeWords {
+		t.Fatalf("Expected %d positions, got %v", MnemonicChallengeWords, positions)
+	}
+
+	wrong := make(map[int]string)
+	typed := make(map[int]string)
+	for _, p := range positions {
+		wrong[p] = "wrong"
+		typed[p] = words[p-1]
+	}
+	if err := s.ConfirmMnemonic(wrong); err == nil || s.Seed.Mnemonic == "" {
+		t.Error("Wrong words should not confirm the mnemonic")
+	}
+	again, _ := s.MnemonicChallenge()
+	if !reflect.DeepEqual(again, positions) {
+		t.Errorf("Expected the same positions until confirmed, got %v and %v", positions, again)
+	}
+
+	// Correct words at positions that were not asked for don't confirm the mnemonic
+	other := make(map[int]string)
+	for p := 1; len(other) < MnemonicChallengeWords; p++ {
+		if !containsInt(positions, p) {
+			other[p] = words[p-1]
+		}
+	}
+	if err := s.ConfirmMnemonic(other); err == nil || s.Seed.Mnemonic == "" {
+		t.Error("Words at other positions should not confirm the mnemonic")
+	}
+	if err := s.ConfirmMnemonic(typed); err != nil || s.Seed.Mnemonic != "" {
+		t.Errorf("Mnemonic should be confirmed and forgotten, got %v", err)
+	}
+}
@@ -65,6 +65,17 @@ func (s *persistentStorage) Set(key string, value interface{}) error {
 	})
 }
 
+func (s *persistentStorage) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return fmt.Errorf("state bucket does not exist")
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
 // Close closes the database
 func (s *persistentStorage) Close() error {
 	return s.db.Close()
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/eoscanada/eos-go/ecc"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Shares of the master key are bound to recovery key, which is derived from account name and
+// recovery passphrase with scrypt (N = 2^15, r = 8, p = 1). Device that lost the account's EOS key
+// proves it knows the passphrase by signing with the recovery key, so trustees know where to return the shares
+const recoveryLogN = 15
+
+// RecoveryKey derives recovery key of account from the passphrase
+func RecoveryKey(account, passphrase string) (*ecc.PrivateKey, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("Recovery passphrase is required")
+	}
+	seed, err := scrypt.Key([]byte(passphrase), []byte("iryo recovery "+account), 1<<recoveryLogN, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return ecc.NewDeterministicPrivateKey(bytes.NewReader(seed))
+}
+
+// StartRecovery makes this device recover master key of account. It connects without an account,
+// with recovery key as its EOS key
+func (s *State) StartRecovery(account, passphrase string) error {
+	key, err := RecoveryKey(account, passphrase)
+	if err != nil {
+		return err
+	}
+	s.EosPrivate = key.String()
+	s.EosAccount = ""
+	s.Recovery.Account = account
+	return nil
+}
+
+// Sender returns name the api knows us by, public key on a device recovering an account
+func (s *State) Sender() string {
+	if s.EosAccount == "" && s.Recovery.Account != "" {
+		return s.GetEosPublicKey()
+	}
+	return s.EosAccount
+}
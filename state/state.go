@@ -1,8 +1,11 @@
 package state
 
 import (
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"time"
 
 	"github.com/eoscanada/eos-go/ecc"
 
@@ -24,21 +27,78 @@ type (
 		RSAKey         *rsa.PrivateKey
 		Connections    Connections
 		Directory      map[string]string
+		Rotation       *Rotation
+		RotationLog    []RotationRecord
+		Recovery       Recovery
+		Seed           Seed
 		log            *logger.Log
 		persistent     *persistentStorage
 	}
 )
 
 type Connections struct {
-	WithKey    []string           // Access is written on the blockchain and we have the key
-	WithoutKey []string           // Access has been written on the blockchain, but we do not have the key
-	GrantedTo  []string           // We have granted the access to our data to these users. Its on them to make key request
-	Requested  map[string]Request // They are not connected to us, but request for key has been made
+	WithKey    []string             // Access is written on the blockchain and we have the key
+	WithoutKey []string             // Access has been written on the blockchain, but we do not have the key
+	GrantedTo  []string             // We have granted the access to our data to these users. Its on them to make key request
+	Requested  map[string]Request   // They are not connected to us, but request for key has been made
+	Awaiting   []string             // We have requested the key from these users and are waiting for the answer
+	Categories map[string][]string  // Categories of our documents shared with the user, all categories if not set
+	Expires    map[string]time.Time // When access we granted to the user expires, never if not set
+	Legacy     []string             // Users whose clients only exchange keys with RSA
 }
 
 type Request struct {
-	Key        *rsa.PublicKey
-	CustomData string
+	Key           *rsa.PublicKey // set if requester sent RSA key
+	X25519Key     []byte         // set if requester supports sealed boxes
+	CustomData    string
+	CorrelationID string // sent back with the key, so that requester can match it to its request
+}
+
+// Rotation tracks progress of owner's key rotation, so it can be resumed after failure.
+// Old key is kept until all documents are uploaded with the new one
+type Rotation struct {
+	Owner    string
+	OldKey   []byte
+	NewKey   []byte
+	Done     []string // documents uploaded with the new key
+	Reupload []string // legacy documents encrypted anew, they have to be reuploaded as whole
+	Reason   string   // why the key is rotated, e.g. access of an account was revoked
+}
+
+// RotationRecord is entry of local history of finished key rotations
+type RotationRecord struct {
+	Time      time.Time
+	Reason    string
+	Documents int
+}
+
+// Recovery keeps shares of master key we split among trustees and shares others entrusted to us
+type Recovery struct {
+	ID          string            // ID of our latest split, shares of older splits are ignored
+	Trustees    []string          // accounts holding shares of our master key
+	Threshold   int               // number of shares needed to recover our master key
+	KeyHash     []byte            // sha256 of the master key that was split
+	RecoveryKey string            // public key derived from recovery passphrase, shares are returned only to it
+	Pending     map[string][]byte // shares waiting for the trustee to accept the invite
+	Invited     map[string]string // accounts that invited us to hold their share with ID of the split, until the user accepts
+	Accepted    map[string]string // invites the user accepted with ID of the split, until the share arrives
+	Shares      map[string]Share  // shares of master keys entrusted to us
+	Requested   map[string][]byte // owners asking for their share back with X25519 key of their new device
+	Account     string            // account whose master key this device is recovering, it has no account of its own
+	Asked       []string          // trustees we asked to return shares of our master key
+	Collected   map[string]Share  // shares of our master key returned by trustees while recovering it
+}
+
+// Share is a share of master key entrusted to us. Signature is the owner's signature of the share,
+// its threshold, hash of the key and the recovery key, so the owner can verify shares returned
+// to the new device and trustees only return them to the device that knows the recovery passphrase
+type Share struct {
+	ID          string
+	Threshold   int
+	Share       []byte
+	KeyHash     []byte
+	RecoveryKey string
+	Signature   string
 }
 
 const (
@@ -50,6 +110,10 @@ const (
 	StorageKeyRSAKey         = "RSA_KEY"
 	StorageKeyConnections    = "CONNECTIONS"
 	StorageKeyDirectory      = "DIRECTORY"
+	StorageKeyRotation       = "ROTATION"
+	StorageKeyRotationLog    = "ROTATION_LOG"
+	StorageKeyRecovery       = "RECOVERY"
+	StorageKeySeed           = "SEED"
 )
 
 func (s *State) GetEosPublicKey() string {
@@ -60,6 +124,50 @@ func (s *State) GetEosPublicKey() string {
 	return key.PublicKey().String()
 }
 
+// SignHash creates signature of sha256 hash of data with EOS key
+func (s *State) SignHash(data []byte) (string, error) {
+	h := sha256.Sum256(data)
+	return s.SignByte(h[:])
+}
+
+// SignByte creates signature of data with EOS key
+func (s *State) SignByte(data []byte) (string, error) {
+	sk, err := ecc.NewPrivateKey(s.EosPrivate)
+	if err != nil {
+		return "", err
+	}
+	sign, err := sk.Sign(data)
+	return sign.String(), err
+}
+
+// SetLegacy marks `account` as a user whose client only exchanges keys with RSA
+func (s *State) SetLegacy(account string) {
+	if !s.IsLegacy(account) {
+		s.Connections.Legacy = append(s.Connections.Legacy, account)
+	}
+}
+
+func (s *State) IsLegacy(account string) bool {
+	for _, v := range s.Connections.Legacy {
+		if v == account {
+			return true
+		}
+	}
+	return false
+}
+
+// LegacyRSAKey returns RSA key used with legacy clients, generating it on first use
+func (s *State) LegacyRSAKey() (*rsa.PrivateKey, error) {
+	if s.RSAKey == nil {
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return nil, err
+		}
+		s.RSAKey = key
+	}
+	return s.RSAKey, nil
+}
+
 func (s *State) GetNames(list []string) map[string]string {
 	out := make(map[string]string)
 	for _, username := range list {
@@ -125,6 +233,32 @@ func (s *State) Save() error {
 				return err
 			}
 		}
+
+		err = s.persistent.Set(StorageKeyRecovery, s.Recovery)
+		if err != nil {
+			return err
+		}
+
+		err = s.persistent.Set(StorageKeySeed, s.Seed)
+		if err != nil {
+			return err
+		}
+
+		if s.RotationLog != nil {
+			err = s.persistent.Set(StorageKeyRotationLog, s.RotationLog)
+			if err != nil {
+				return err
+			}
+		}
+
+		if s.Rotation != nil {
+			err = s.persistent.Set(StorageKeyRotation, s.Rotation)
+		} else {
+			err = s.persistent.Delete(StorageKeyRotation)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -153,8 +287,12 @@ func New(cfg *config.Config, log *logger.Log) (*State, error) {
 			WithoutKey: []string{},
 			GrantedTo:  []string{},
 			Requested:  make(map[string]Request),
+			Awaiting:   []string{},
+			Categories: make(map[string][]string),
+			Expires:    make(map[string]time.Time),
 		},
 		Directory: make(map[string]string),
+		Recovery:  NewRecovery(),
 		IsDoctor:  false,
 		log:       log,
 	}
@@ -265,5 +403,71 @@ func (s *State) loadPersistentStorage(base64EncodedKey, storagePath string) erro
 		s.Directory = directory
 	}
 
+	var recovery Recovery
+	ok, err = s.persistent.Get(StorageKeyRecovery, &recovery)
+	if err != nil {
+		return err
+	}
+	if ok {
+		s.Recovery = recovery
+		s.Recovery.init()
+	}
+
+	var seed Seed
+	ok, err = s.persistent.Get(StorageKeySeed, &seed)
+	if err != nil {
+		return err
+	}
+	if ok {
+		s.Seed = seed
+	}
+
+	var rotationLog []RotationRecord
+	ok, err = s.persistent.Get(StorageKeyRotationLog, &rotationLog)
+	if err != nil {
+		return err
+	}
+	if ok {
+		s.RotationLog = rotationLog
+	}
+
+	var rotation Rotation
+	ok, err = s.persistent.Get(StorageKeyRotation, &rotation)
+	if err != nil {
+		return err
+	}
+	if ok {
+		s.Rotation = &rotation
+	}
+
 	return nil
 }
+
+// NewRecovery creates empty recovery state
+func NewRecovery() Recovery {
+	r := Recovery{}
+	r.init()
+	return r
+}
+
+// init creates maps missing in recovery state saved by older clients
+func (r *Recovery) init() {
+	if r.Pending == nil {
+		r.Pending = make(map[string][]byte)
+	}
+	if r.Invited == nil {
+		r.Invited = make(map[string]string)
+	}
+	if r.Accepted == nil {
+		r.Accepted = make(map[string]string)
+	}
+	if r.Shares == nil {
+		r.Shares = make(map[string]Share)
+	}
+	if r.Requested == nil {
+		r.Requested = make(map[string][]byte)
+	}
+	if r.Collected == nil {
+		r.Collected = make(map[string]Share)
+	}
+}
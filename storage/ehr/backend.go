@@ -0,0 +1,88 @@
+package ehr
+
+// Backend keeps encrypted documents, wrapped data keys and metadata of each user.
+// Get returns nil if the value does not exist. RemoveUser removes documents and keys,
+// metadata is kept, so that it still applies when the documents are downloaded again
+type Backend interface {
+	Get(kind, user, id string) ([]byte, error)
+	Put(kind, user, id string, value []byte) error
+	Delete(kind, user, id string) error
+	List(kind, user string) ([]string, error)
+	Users() ([]string, error)
+	RemoveUser(user string) error
+	Close() error
+}
+
+// Kinds of values kept in backend
+const (
+	kindDocuments = "documents"
+	kindKeys      = "keys"
+	kindMeta      = "meta"
+)
+
+var (
+	kinds         = []string{kindDocuments, kindKeys, kindMeta}
+	documentKinds = []string{kindDocuments, kindKeys}
+)
+
+// memoryBackend keeps everything in memory, it's lost when the client is closed
+type memoryBackend struct {
+	values map[string]map[string]map[string][]byte
+}
+
+func newMemoryBackend() *memoryBackend {
+	b := &memoryBackend{values: make(map[string]map[string]map[string][]byte)}
+	for _, kind := range kinds {
+		b.values[kind] = make(map[string]map[string][]byte)
+	}
+	return b
+}
+
+// Get returns a copy of the value, so that callers can't change what's stored
+func (b *memoryBackend) Get(kind, user, id string) ([]byte, error) {
+	value, ok := b.values[kind][user][id]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (b *memoryBackend) Put(kind, user, id string, value []byte) error {
+	if _, ok := b.values[kind][user]; !ok {
+		b.values[kind][user] = make(map[string][]byte)
+	}
+	b.values[kind][user][id] = value
+	return nil
+}
+
+func (b *memoryBackend) Delete(kind, user, id string) error {
+	delete(b.values[kind][user], id)
+	return nil
+}
+
+func (b *memoryBackend) List(kind, user string) ([]string, error) {
+	var ret []string
+	for id := range b.values[kind][user] {
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
+
+func (b *memoryBackend) Users() ([]string, error) {
+	var ret []string
+	for user := range b.values[kindDocuments] {
+		ret = append(ret, user)
+	}
+	return ret, nil
+}
+
+func (b *memoryBackend) RemoveUser(user string) error {
+	for _, kind := range documentKinds {
+		delete(b.values[kind], user)
+	}
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,147 @@
+package ehr
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iryonetwork/encrypted-bolt"
+)
+
+var dbPermissions os.FileMode = 0600
+
+// boltBackend keeps documents on disk in encrypted bolt database,
+// each kind in its own bucket with nested bucket for every user
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func newBoltBackend(path string, key []byte) (*boltBackend, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Encryption key must be 32 bytes long")
+	}
+
+	db, err := bolt.Open(key, path, dbPermissions, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// add buckets if they do not exist
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, kind := range kinds {
+			if _, err := tx.CreateBucketIfNotExists([]byte(kind)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) Get(kind, user, id string) ([]byte, error) {
+	var out []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket, err := userBucket(tx, kind, user)
+		if err != nil || bucket == nil {
+			return err
+		}
+
+		if value := bucket.Get([]byte(id)); value != nil {
+			out = append([]byte{}, value...)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (b *boltBackend) Put(kind, user, id string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		kindBucket := tx.Bucket([]byte(kind))
+		if kindBucket == nil {
+			return fmt.Errorf("%s bucket does not exist", kind)
+		}
+		bucket, err := kindBucket.CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(id), value)
+	})
+}
+
+func (b *boltBackend) Delete(kind, user, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := userBucket(tx, kind, user)
+		if err != nil || bucket == nil {
+			return err
+		}
+
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (b *boltBackend) List(kind, user string) ([]string, error) {
+	var ret []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket, err := userBucket(tx, kind, user)
+		if err != nil || bucket == nil {
+			return err
+		}
+
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			ret = append(ret, string(k))
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (b *boltBackend) Users() ([]string, error) {
+	var ret []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		kindBucket := tx.Bucket([]byte(kindDocuments))
+		if kindBucket == nil {
+			return fmt.Errorf("%s bucket does not exist", kindDocuments)
+		}
+
+		c := kindBucket.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			ret = append(ret, string(k))
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (b *boltBackend) RemoveUser(user string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, kind := range documentKinds {
+			kindBucket := tx.Bucket([]byte(kind))
+			if kindBucket == nil || kindBucket.Bucket([]byte(user)) == nil {
+				continue
+			}
+			if err := kindBucket.DeleteBucket([]byte(user)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
+
+// userBucket returns user's bucket of kind, or nil if user has nothing stored
+func userBucket(tx *bolt.Tx, kind, user string) (*bolt.Bucket, error) {
+	kindBucket := tx.Bucket([]byte(kind))
+	if kindBucket == nil {
+		return nil, fmt.Errorf("%s bucket does not exist", kind)
+	}
+	return kindBucket.Bucket([]byte(user)), nil
+}
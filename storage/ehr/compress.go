@@ -0,0 +1,70 @@
+package ehr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// Flags of document header
+const (
+	// flagGzip marks documents compressed with gzip before encryption
+	flagGzip = 1 << 0
+
+	knownFlags = flagGzip
+)
+
+// Compression algorithms, set with EHR_COMPRESSION
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// Stats reports space saved by compressing documents encrypted by this client
+type Stats struct {
+	Documents  int   `json:"documents"`
+	Size       int64 `json:"size"`
+	Compressed int64 `json:"compressed"`
+	Saved      int64 `json:"saved"`
+}
+
+// compress compresses document with algorithm and returns flags to set in the header.
+// Document is left as it is if compression does not make it smaller
+func compress(document []byte, algorithm string) ([]byte, byte, error) {
+	switch algorithm {
+	case "", CompressionNone:
+		return document, 0, nil
+	case CompressionGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(document); err != nil {
+			return nil, 0, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+		if buf.Len() >= len(document) {
+			return document, 0, nil
+		}
+		return buf.Bytes(), flagGzip, nil
+	default:
+		return nil, 0, fmt.Errorf("Unknown compression %s", algorithm)
+	}
+}
+
+func decompress(data []byte, flags byte) ([]byte, error) {
+	if flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("Document has unknown flags %x", flags)
+	}
+	if flags&flagGzip == 0 {
+		return data, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -1,143 +1,495 @@
 package ehr
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"encoding/base64"
 	"fmt"
-	"io"
+	"strings"
+	"sync"
 
-	"github.com/segmentio/ksuid"
+	"github.com/gofrs/uuid"
+
+	"github.com/iryonetwork/network-poc/config"
 )
 
+// Storage is safe for concurrent use. Methods returning more documents
+// return snapshots, which are not affected by later changes
 type Storage struct {
-	documents map[string]map[string][]byte
+	mu          sync.RWMutex
+	backend     Backend
+	compression string
+
+	statsMu sync.Mutex
+	stats   Stats
 }
 
+// New creates storage that keeps documents in memory
 func New() *Storage {
-	return &Storage{documents: make(map[string]map[string][]byte)}
+	return &Storage{backend: newMemoryBackend()}
 }
 
-func (s *Storage) Saveid(user, id string, document []byte) {
-	s.check(user)
+// Open creates storage selected in config. Documents are kept on disk in encrypted
+// bolt database if EHR_STORAGE is bolt, in memory otherwise. Documents are compressed
+// before encryption with EHR_COMPRESSION algorithm
+func Open(cfg *config.Config) (*Storage, error) {
+	if _, _, err := compress(nil, cfg.EhrCompression); err != nil {
+		return nil, err
+	}
+
+	var backend Backend
+	switch cfg.EhrStorage {
+	case "", "memory":
+		backend = newMemoryBackend()
+	case "bolt":
+		key, err := base64.StdEncoding.DecodeString(cfg.EhrStorageEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode ehr storage encryption key")
+		}
+		if backend, err = newBoltBackend(cfg.EhrStoragePath, key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown ehr storage %s", cfg.EhrStorage)
+	}
+
+	return &Storage{backend: backend, compression: cfg.EhrCompression}, nil
+}
 
-	s.documents[user][id] = document
+// Close closes the backend
+func (s *Storage) Close() error {
+	return s.backend.Close()
 }
 
-func (s *Storage) Save(user string, document []byte) string {
-	s.check(user)
+func (s *Storage) Saveid(user, id string, document []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backend.Put(kindDocuments, user, id, document)
+}
+
+func (s *Storage) Save(user string, document []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	id := newID()
-	s.documents[user][id] = document
-	return id
+	return id, s.backend.Put(kindDocuments, user, id, document)
 }
 
-func (s *Storage) Getid(user, id string) []byte {
-	if document, ok := s.documents[user][id]; ok {
-		return document
-	}
-	return nil
+// Getid returns encrypted document or nil if it does not exist
+func (s *Storage) Getid(user, id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getid(user, id)
 }
-func (s *Storage) Get(user string) map[string][]byte {
-	if document, ok := s.documents[user]; ok {
-		return document
+
+// Get returns snapshot of user's encrypted documents
+func (s *Storage) Get(user string) (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids, err := s.listIds(user)
+	if err != nil || ids == nil {
+		return nil, err
 	}
-	return nil
+	out := make(map[string][]byte)
+	for _, id := range ids {
+		document, err := s.getid(user, id)
+		if err != nil {
+			return nil, err
+		}
+		if document != nil {
+			out[id] = document
+		}
+	}
+	return out, nil
+}
+
+// SaveKey saves wrapped data key of document
+func (s *Storage) SaveKey(user, id string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backend.Put(kindKeys, user, id, key)
+}
+
+// GetKey returns wrapped data key of document or nil if document has none
+func (s *Storage) GetKey(user, id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getKey(user, id)
 }
 
 // Exists checks if file exists in docs[user][id]
-func (s *Storage) Exists(user, id string) bool {
-	_, ok := s.documents[user][id]
-	return ok
+func (s *Storage) Exists(user, id string) (bool, error) {
+	document, err := s.Getid(user, id)
+	return document != nil, err
 }
 
-func (s *Storage) RemoveUser(user string) {
-	s.documents[user] = make(map[string][]byte)
+func (s *Storage) RemoveUser(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backend.RemoveUser(user)
 }
 
-func (s *Storage) Rename(user, id, newid string) {
-	s.documents[user][newid] = s.documents[user][id]
-	delete(s.documents[user], id)
+// Users lists users whose documents are stored
+func (s *Storage) Users() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.backend.Users()
+}
+
+func (s *Storage) Rename(user, id, newid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	document, err := s.getid(user, id)
+	if err != nil {
+		return err
+	}
+	if err := s.backend.Put(kindDocuments, user, newid, document); err != nil {
+		return err
+	}
+	if err := s.backend.Delete(kindDocuments, user, id); err != nil {
+		return err
+	}
+
+	key, err := s.getKey(user, id)
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		if err := s.backend.Put(kindKeys, user, newid, key); err != nil {
+			return err
+		}
+		return s.backend.Delete(kindKeys, user, id)
+	}
+	return nil
 }
 
 const nonceLength = 12
 
-// Encrypt encrypts and saves document to user's storage using key
+// Encrypt encrypts and saves document to user's storage
+// using new data key, which is wrapped with the key of category
 // returns ehrID if there is no error. Otherwise returns error
-func (s *Storage) Encrypt(user string, document, key []byte) (string, error) {
-	s.check(user)
-	block, err := aes.NewCipher(key)
+func (s *Storage) Encrypt(user, category string, document, key []byte) (string, error) {
+	keys, err := ParseKeys(key)
 	if err != nil {
 		return "", err
 	}
-
-	nonce := make([]byte, nonceLength)
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	id := newID()
+	sealed, wrapped, err := s.encrypt(document, keys, user, id, category)
+	if err != nil {
 		return "", err
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.backend.Put(kindDocuments, user, id, sealed); err != nil {
+		return "", err
+	}
+	if err := s.backend.Put(kindKeys, user, id, wrapped); err != nil {
 		return "", err
 	}
-	id := newID()
-	s.documents[user][id] = append(nonce, aesgcm.Seal(nil, nonce, document, nil)...)
 
 	return id, nil
 }
 
+// Decrypt decrypts the document with key, which is either owner's master key
+// or encoded keys of categories shared with us
 func (s *Storage) Decrypt(owner, id string, key []byte) ([]byte, error) {
-	document, ok := s.documents[owner][id]
-	if !ok {
-		return nil, fmt.Errorf("Document for %s_%s does not exist", owner, id)
+	keys, err := ParseKeys(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.decrypt(owner, id, keys)
+}
+
+// DecryptAll returns snapshot of owner's documents decrypted with key.
+// Documents of categories not shared with us are skipped. If other documents
+// can't be decrypted, the error is returned together with the rest of documents
+func (s *Storage) DecryptAll(owner string, key []byte) (map[string][]byte, error) {
+	keys, err := ParseKeys(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids, err := s.listIds(owner)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte)
+	var failed []string
+	for _, id := range ids {
+		data, err := s.decrypt(owner, id, keys)
+		if _, ok := err.(*MissingKeyError); ok {
+			continue
+		}
+		if err != nil {
+			failed = append(failed, id)
+			continue
+		}
+		out[id] = data
 	}
+	if len(failed) > 0 {
+		return out, fmt.Errorf("Failed to decrypt %s's documents %s", owner, strings.Join(failed, ", "))
+	}
+	return out, nil
+}
 
-	block, err := aes.NewCipher(key)
+func (s *Storage) decrypt(owner, id string, keys *Keys) ([]byte, error) {
+	document, err := s.getid(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return nil, fmt.Errorf("Document for %s_%s does not exist", owner, id)
+	}
+	wrapped, err := s.getKey(owner, id)
 	if err != nil {
 		return nil, err
 	}
+	envelope := isEnvelope(document, wrapped)
+	upgraded, err := s.upgraded(owner)
+	if err != nil {
+		return nil, err
+	}
+	if upgraded && !(envelope && isBound(document)) {
+		return nil, fmt.Errorf("Document %s_%s is not bound to its owner and ID, %s's documents were upgraded", owner, id, owner)
+	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	if !envelope {
+		// document was encrypted before data keys were introduced
+		if keys.Master == nil {
+			return nil, &MissingKeyError{}
+		}
+		return open(keys.Master, document, nil)
+	}
+
+	dataKey, category, err := unwrapKey(keys, wrapped)
 	if err != nil {
 		return nil, err
 	}
 
-	return aesgcm.Open(nil, document[:nonceLength], document[nonceLength:], nil)
+	return openDocument(dataKey, document, owner, id, category)
+}
+
+// metaUpgraded marks owners whose unbound documents are rejected
+const metaUpgraded = "upgraded"
+
+// RejectUnbound makes legacy and version 1 documents of owner fail to decrypt. It's called once
+// all owner's documents were rewritten in bound format, an unbound document could only be
+// an old document served under another ID afterwards. It's recorded in the backend,
+// so it's kept after restart and when owner's documents are removed
+func (s *Storage) RejectUnbound(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.backend.Put(kindMeta, owner, metaUpgraded, []byte{1})
 }
 
-// Reencrypt reencrypts the whole storage
-// it does NOT upload the data to the api
-func (s *Storage) Reencrypt(owner string, oldkey, newkey []byte) error {
-	// Reencrypt every entry
-	for id, _ := range s.Get(owner) {
-		data, err := s.Decrypt(owner, id, oldkey)
+// Upgraded reports whether unbound documents of owner are rejected
+func (s *Storage) Upgraded(owner string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.upgraded(owner)
+}
+
+func (s *Storage) upgraded(owner string) (bool, error) {
+	value, err := s.backend.Get(kindMeta, owner, metaUpgraded)
+	return value != nil, err
+}
+
+// Unbound lists owner's legacy and version 1 documents
+func (s *Storage) Unbound(owner string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids, err := s.listIds(owner)
+	if err != nil {
+		return nil, err
+	}
+	var unbound []string
+	for _, id := range ids {
+		document, err := s.getid(owner, id)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		newid, err := s.Encrypt(owner, data, newkey)
+		wrapped, err := s.getKey(owner, id)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if !isEnvelope(document, wrapped) || !isBound(document) {
+			unbound = append(unbound, id)
 		}
-		s.Rename(owner, newid, id)
 	}
+	return unbound, nil
+}
 
-	return nil
+// Rewrap wraps data keys of owner's documents with newkey.
+// Legacy documents without data key are encrypted anew, their ids are returned
+// as they have to be reuploaded. Other documents only need the key uploaded.
+// It does NOT upload the data to the api
+func (s *Storage) Rewrap(owner string, oldkey, newkey []byte, categorize func([]byte) string) (reencrypted []string, err error) {
+	ids, err := s.ListIds(owner)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		ok, err := s.RewrapID(owner, id, oldkey, newkey, categorize)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			reencrypted = append(reencrypted, id)
+		}
+	}
+
+	return reencrypted, nil
 }
 
-func newID() string {
-	return ksuid.New().String()
+// RewrapID wraps data key of a single document with newkey. Documents whose data key
+// is already wrapped with newkey are left as they are, so it is safe to call it again
+// after interrupted rotation. Returns true if legacy document, document without
+// associated data or without category was encrypted anew. Documents without category
+// get the one returned by categorize, so they can be shared with grantees.
+// oldkey and newkey are owner's master keys
+func (s *Storage) RewrapID(owner, id string, oldkey, newkey []byte, categorize func([]byte) string) (reencrypted bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	document, err := s.getid(owner, id)
+	if err != nil {
+		return false, err
+	}
+	if document == nil {
+		return false, fmt.Errorf("Document for %s_%s does not exist", owner, id)
+	}
+	oldkeys := &Keys{Master: oldkey}
+	newkeys := &Keys{Master: newkey}
+
+	wrapped, err := s.getKey(owner, id)
+	if err != nil {
+		return false, err
+	}
+	if !isEnvelope(document, wrapped) {
+		data, err := open(oldkey, document, nil)
+		if err != nil {
+			return false, err
+		}
+		return true, s.encryptID(owner, id, categorize(data), data, newkeys)
+	}
+
+	if _, category, err := unwrapKey(newkeys, wrapped); err == nil && category != "" && isBound(document) {
+		// already rewrapped
+		return false, nil
+	}
+	dataKey, category, err := unwrapKey(oldkeys, wrapped)
+	if err != nil {
+		return false, err
+	}
+
+	if !isBound(document) || category == "" {
+		// bind the document to its owner and ID, and to its category
+		data, err := openDocument(dataKey, document, owner, id, category)
+		if err != nil {
+			return false, err
+		}
+		if category == "" {
+			category = categorize(data)
+		}
+		return true, s.encryptID(owner, id, category, data, newkeys)
+	}
+
+	if wrapped, err = wrapKey(newkeys, category, dataKey); err != nil {
+		return false, err
+	}
+	return false, s.backend.Put(kindKeys, owner, id, wrapped)
 }
 
-func (s *Storage) check(user string) {
-	if _, ok := s.documents[user]; !ok {
-		s.documents[user] = make(map[string][]byte)
+// encryptID encrypts document anew and saves it under existing id
+func (s *Storage) encryptID(owner, id, category string, data []byte, keys *Keys) error {
+	sealed, wrapped, err := s.encrypt(data, keys, owner, id, category)
+	if err != nil {
+		return err
 	}
+	if err := s.backend.Put(kindDocuments, owner, id, sealed); err != nil {
+		return err
+	}
+	return s.backend.Put(kindKeys, owner, id, wrapped)
 }
 
-func (s *Storage) ListIds(user string) []string {
-	var ret []string
-	for k := range s.documents[user] {
-		ret = append(ret, k)
+// encrypt compresses and seals document with new data key and wraps the data key with the key of category
+func (s *Storage) encrypt(document []byte, keys *Keys, owner, id, category string) (sealed, wrapped []byte, err error) {
+	payload, flags, err := compress(document, s.compression)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, err := newDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sealed, err = sealDocument(dataKey, payload, flags, owner, id, category); err != nil {
+		return nil, nil, err
+	}
+	if wrapped, err = wrapKey(keys, category, dataKey); err != nil {
+		return nil, nil, err
 	}
-	return ret
+
+	s.statsMu.Lock()
+	s.stats.Documents++
+	s.stats.Size += int64(len(document))
+	s.stats.Compressed += int64(len(payload))
+	s.stats.Saved = s.stats.Size - s.stats.Compressed
+	s.statsMu.Unlock()
+
+	return sealed, wrapped, nil
+}
+
+// Stats returns compression stats of documents encrypted since the client started
+func (s *Storage) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	return s.stats
+}
+
+// newID creates UUIDv1 document ID. API keeps IDs proposed by the client,
+// so the ID can be bound to the document when it's encrypted
+func newID() string {
+	return uuid.Must(uuid.NewV1()).String()
+}
+
+// ListIds returns snapshot of user's document IDs
+func (s *Storage) ListIds(user string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.listIds(user)
+}
+
+// getid, getKey and listIds expect the caller to hold the lock
+
+func (s *Storage) getid(user, id string) ([]byte, error) {
+	return s.backend.Get(kindDocuments, user, id)
+}
+
+func (s *Storage) getKey(user, id string) ([]byte, error) {
+	return s.backend.Get(kindKeys, user, id)
+}
+
+func (s *Storage) listIds(user string) ([]string, error) {
+	return s.backend.List(kindDocuments, user)
 }
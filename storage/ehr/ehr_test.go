@@ -0,0 +1,414 @@
+package ehr
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRewrap(t *testing.T) {
+	oldkey := bytes.Repeat([]byte{1}, 32)
+	newkey := bytes.Repeat([]byte{2}, 32)
+	s := New()
+
+	id, err := s.Encrypt("owner", CategoryVitalSigns, []byte("document"), oldkey)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	sealed := mustGetid(t, s, "owner", id)
+
+	// legacy document, encrypted directly with owner's key
+	legacy, err := seal(oldkey, []byte("legacy"), nil)
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	s.Saveid("owner", "legacy", legacy)
+
+	reencrypted, err := s.Rewrap("owner", oldkey, newkey, vitalSigns)
+	if err != nil {
+		t.Fatalf("Rewrap failed: %v", err)
+	}
+	if len(reencrypted) != 1 || reencrypted[0] != "legacy" {
+		t.Errorf("Expected only legacy document to be reencrypted, got %v", reencrypted)
+	}
+	if !bytes.Equal(mustGetid(t, s, "owner", id), sealed) {
+		t.Error("Document with data key should not be reencrypted")
+	}
+
+	for id, want := range map[string]string{id: "document", "legacy": "legacy"} {
+		got, err := s.Decrypt("owner", id, newkey)
+		if err != nil {
+			t.Fatalf("Decrypt of %s failed: %v", id, err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+		if _, err := s.Decrypt("owner", id, oldkey); err == nil {
+			t.Errorf("Document %s should not decrypt with old key", id)
+		}
+	}
+
+	// legacy document got a category, so grantees of the category can read it
+	shared, err := (&Keys{Master: newkey}).Share([]string{CategoryVitalSigns})
+	if err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	key, err := shared.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if data, err := s.Decrypt("owner", "legacy", key); err != nil || string(data) != "legacy" {
+		t.Errorf("Expected legacy document to decrypt with category key, got %s, %v", data, err)
+	}
+}
+
+func vitalSigns([]byte) string {
+	return CategoryVitalSigns
+}
+
+func TestRewrapIDResumes(t *testing.T) {
+	oldkey := bytes.Repeat([]byte{1}, 32)
+	newkey := bytes.Repeat([]byte{2}, 32)
+	s := New()
+
+	id, err := s.Encrypt("owner", CategoryVitalSigns, []byte("document"), oldkey)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if _, err := s.RewrapID("owner", id, oldkey, newkey, vitalSigns); err != nil {
+		t.Fatalf("RewrapID failed: %v", err)
+	}
+	wrapped := mustGetKey(t, s, "owner", id)
+
+	// Running it again, e.g. after failed upload, must not fail or change the key
+	if _, err := s.RewrapID("owner", id, oldkey, newkey, vitalSigns); err != nil {
+		t.Fatalf("Repeated RewrapID failed: %v", err)
+	}
+	if !bytes.Equal(wrapped, mustGetKey(t, s, "owner", id)) {
+		t.Error("Data key already wrapped with new key should not change")
+	}
+}
+
+func TestRejectUnbound(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := New()
+
+	legacy, err := seal(master, []byte("legacy"), nil)
+	if err != nil {
+		t.Fatalf("seal failed: %v", err)
+	}
+	s.Saveid("owner", "legacy", legacy)
+	id, err := s.Encrypt("owner", CategoryVitalSigns, []byte("document"), master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	if _, err := s.Decrypt("owner", "legacy", master); err != nil {
+		t.Fatalf("Legacy document should decrypt before upgrade: %v", err)
+	}
+	if unbound, err := s.Unbound("owner"); err != nil || len(unbound) != 1 || unbound[0] != "legacy" {
+		t.Errorf("Expected legacy document to be listed as unbound, got %v, %v", unbound, err)
+	}
+	if err := s.RejectUnbound("owner"); err != nil {
+		t.Fatalf("RejectUnbound failed: %v", err)
+	}
+	if _, err := s.Decrypt("owner", "legacy", master); err == nil {
+		t.Error("Legacy document should not decrypt after upgrade")
+	}
+	if _, err := s.Decrypt("owner", id, master); err != nil {
+		t.Errorf("Bound document should decrypt after upgrade: %v", err)
+	}
+
+	// Upgrade is kept when documents are removed and downloaded again
+	if err := s.RemoveUser("owner"); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	s.Saveid("owner", "legacy", legacy)
+	if _, err := s.Decrypt("owner", "legacy", master); err == nil {
+		t.Error("Legacy document should not decrypt after it was downloaded again")
+	}
+}
+
+func TestLegacyWithHeader(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := New()
+
+	// Legacy document whose random nonce starts with the envelope header
+	nonce := append(append([]byte{}, magic...), formatVersion, 0, 1, 2, 3, 4, 5, 6, 7)
+	aesgcm, err := newGCM(master)
+	if err != nil {
+		t.Fatalf("newGCM failed: %v", err)
+	}
+	legacy := aesgcm.Seal(nonce, nonce, []byte("legacy"), nil)
+	s.Saveid("owner", "legacy", legacy)
+
+	if data, err := s.Decrypt("owner", "legacy", master); err != nil || string(data) != "legacy" {
+		t.Errorf("Expected document without data key to decrypt as legacy, got %s, %v", data, err)
+	}
+	if unbound, err := s.Unbound("owner"); err != nil || len(unbound) != 1 {
+		t.Errorf("Expected legacy document to be listed as unbound, got %v, %v", unbound, err)
+	}
+	if err := s.RejectUnbound("owner"); err != nil {
+		t.Fatalf("RejectUnbound failed: %v", err)
+	}
+	if _, err := s.Decrypt("owner", "legacy", master); err == nil {
+		t.Error("Legacy document with header should not pass as bound document after upgrade")
+	}
+}
+
+func TestSharedCategories(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := New()
+
+	vitals, err := s.Encrypt("owner", CategoryVitalSigns, []byte("vitals"), master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	personal, err := s.Encrypt("owner", CategoryPersonal, []byte("personal"), master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	shared, err := (&Keys{Master: master}).Share([]string{CategoryVitalSigns})
+	if err != nil {
+		t.Fatalf("Share failed: %v", err)
+	}
+	key, err := shared.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	if data, err := s.Decrypt("owner", vitals, key); err != nil || string(data) != "vitals" {
+		t.Errorf("Expected shared category to decrypt, got %s, %v", data, err)
+	}
+	if _, err := s.Decrypt("owner", personal, key); err == nil {
+		t.Error("Category that was not shared should not decrypt")
+	} else if _, ok := err.(*MissingKeyError); !ok {
+		t.Errorf("Expected MissingKeyError, got %v", err)
+	}
+	if documents, err := s.DecryptAll("owner", key); err != nil || len(documents) != 1 {
+		t.Errorf("Expected only shared category to decrypt, got %d documents, %v", len(documents), err)
+	}
+}
+
+func TestSwappedDocument(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := New()
+
+	id, err := s.Encrypt("owner", CategoryVitalSigns, []byte("document"), master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	// API serves the document and its key under another ID
+	s.Saveid("owner", "other", mustGetid(t, s, "owner", id))
+	s.SaveKey("owner", "other", mustGetKey(t, s, "owner", id))
+
+	if _, err := s.Decrypt("owner", "other", master); err == nil {
+		t.Error("Document moved to another ID should not decrypt")
+	}
+	if _, err := s.Decrypt("owner", id, master); err != nil {
+		t.Errorf("Decrypt failed: %v", err)
+	}
+}
+
+// failingBackend fails every read, like a corrupted database
+type failingBackend struct {
+	Backend
+}
+
+func (failingBackend) Get(kind, user, id string) ([]byte, error) {
+	return nil, errors.New("read failed")
+}
+
+func (failingBackend) List(kind, user string) ([]string, error) {
+	return nil, errors.New("list failed")
+}
+
+func TestMemoryBackendCopies(t *testing.T) {
+	s := New()
+	s.Saveid("owner", "id", []byte("document"))
+
+	document := mustGetid(t, s, "owner", "id")
+	document[0] = 'X'
+	if got := mustGetid(t, s, "owner", "id"); string(got) != "document" {
+		t.Errorf("Stored document was changed through returned slice: %s", got)
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	s := &Storage{backend: failingBackend{}}
+
+	if _, err := s.Getid("owner", "id"); err == nil {
+		t.Error("Getid should return backend error")
+	}
+	if _, err := s.GetKey("owner", "id"); err == nil {
+		t.Error("GetKey should return backend error")
+	}
+	if _, err := s.ListIds("owner"); err == nil {
+		t.Error("ListIds should return backend error")
+	}
+	if _, err := s.DecryptAll("owner", bytes.Repeat([]byte{1}, 32)); err == nil {
+		t.Error("DecryptAll should return backend error")
+	}
+}
+
+func TestBoltBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ehr")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ehr.db")
+	key := bytes.Repeat([]byte{3}, 32)
+	master := bytes.Repeat([]byte{1}, 32)
+
+	backend, err := newBoltBackend(path, key)
+	if err != nil {
+		t.Fatalf("newBoltBackend failed: %v", err)
+	}
+	s := &Storage{backend: backend}
+	id, err := s.Encrypt("owner", CategoryVitalSigns, []byte("document"), master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	s.Saveid("revoked", "id", []byte("document"))
+	s.Close()
+
+	// Documents survive reopening
+	backend, err = newBoltBackend(path, key)
+	if err != nil {
+		t.Fatalf("newBoltBackend failed: %v", err)
+	}
+	s = &Storage{backend: backend}
+	defer s.Close()
+	if data, err := s.Decrypt("owner", id, master); err != nil || string(data) != "document" {
+		t.Errorf("Expected document, got %s, %v", data, err)
+	}
+
+	if err := s.RemoveUser("revoked"); err != nil {
+		t.Fatalf("RemoveUser failed: %v", err)
+	}
+	if users, _ := s.Users(); len(users) != 1 || users[0] != "owner" {
+		t.Errorf("Expected only owner to be left, got %v", users)
+	}
+}
+
+// Run with -race, sync goroutine changes documents while the page is rendered
+func TestConcurrentSyncAndRead(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := New()
+	first, err := s.Encrypt("owner", CategoryVitalSigns, []byte("document"), master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if _, err := s.Encrypt("owner", CategoryVitalSigns, []byte("document"), master); err != nil {
+				t.Errorf("Encrypt failed: %v", err)
+			}
+			s.Saveid("revoked", "id", []byte("document"))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := s.RemoveUser("revoked"); err != nil {
+				t.Errorf("RemoveUser failed: %v", err)
+			}
+			if _, err := s.RewrapID("owner", first, master, master, vitalSigns); err != nil {
+				t.Errorf("RewrapID failed: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			documents, err := s.Get("owner")
+			if err != nil {
+				t.Errorf("Get failed: %v", err)
+			}
+			decrypted, err := s.DecryptAll("owner", master)
+			if err != nil {
+				t.Errorf("DecryptAll failed: %v", err)
+			}
+			for id, data := range decrypted {
+				if string(data) != "document" {
+					t.Errorf("Expected document %s, got %s", id, data)
+				}
+			}
+			for id := range documents {
+				s.Exists("owner", id)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if ids, err := s.ListIds("owner"); err != nil || len(ids) != 51 {
+		t.Errorf("Expected 51 documents, got %d, %v", len(ids), err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	document := bytes.Repeat([]byte(`"/content[openEHR-EHR-COMPOSITION.encounter.v1]/context/start_time":"2018-01-01",`), 100)
+	s := &Storage{backend: newMemoryBackend(), compression: CompressionGzip}
+
+	// documents encrypted without compression keep working
+	uncompressed := New()
+	old, err := uncompressed.Encrypt("owner", CategoryVitalSigns, document, master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	s.Saveid("owner", old, mustGetid(t, uncompressed, "owner", old))
+	s.SaveKey("owner", old, mustGetKey(t, uncompressed, "owner", old))
+	id, err := s.Encrypt("owner", CategoryVitalSigns, document, master)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	for _, id := range []string{old, id} {
+		if data, err := s.Decrypt("owner", id, master); err != nil || !bytes.Equal(data, document) {
+			t.Errorf("Decrypt failed: %v", err)
+		}
+	}
+	if len(mustGetid(t, s, "owner", id)) >= len(document) {
+		t.Error("Expected compressed document to be smaller")
+	}
+	if stats := s.Stats(); stats.Documents != 1 || stats.Size != int64(len(document)) || stats.Saved <= 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// flags are authenticated
+	sealed := append([]byte{}, mustGetid(t, s, "owner", id)...)
+	sealed[magicLength+1] = 0
+	s.Saveid("owner", id, sealed)
+	if _, err := s.Decrypt("owner", id, master); err == nil {
+		t.Error("Document with changed flags should not decrypt")
+	}
+}
+
+func mustGetid(t *testing.T, s *Storage, user, id string) []byte {
+	document, err := s.Getid(user, id)
+	if err != nil {
+		t.Fatalf("Getid failed: %v", err)
+	}
+	return document
+}
+
+func mustGetKey(t *testing.T, s *Storage, user, id string) []byte {
+	key, err := s.GetKey(user, id)
+	if err != nil {
+		t.Fatalf("GetKey failed: %v", err)
+	}
+	return key
+}
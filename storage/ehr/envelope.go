@@ -0,0 +1,221 @@
+package ehr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// Documents are encrypted with their own random data key. The data key is
+// wrapped with the owner's key (key-encryption key) and stored next to the
+// document, so changing the owner's key only requires rewrapping data keys.
+//
+// Document format:
+//
+//	magic (3 bytes) | version (1 byte) | flags (1 byte) | nonce (12 bytes) | AES-GCM ciphertext
+//
+// Flags of version 2 documents tell how the document was compressed before encryption.
+//
+// Version 2 documents are sealed with associated data
+//
+//	header (5 bytes) | owner | 0x00 | document ID | 0x00 | category
+//
+// so a document can't be passed off as another document or as document of another owner.
+// Version 1 documents have no associated data, they are upgraded when the owner syncs or rotates the key.
+// Version 3 documents are encrypted in chunks, see stream.go
+// Afterwards unbound (version 1 and legacy) documents of that owner are rejected, see RejectUnbound.
+//
+// Wrapped data key format:
+//
+//	version 1 (1 byte) | nonce (12 bytes) | AES-GCM ciphertext of the data key
+//	version 2 (1 byte) | category length (1 byte) | category | nonce (12 bytes) | AES-GCM ciphertext of the data key
+//
+// Version 1 keys are wrapped with owner's master key, version 2 keys with the key of document's category.
+// Documents with version 1 keys and legacy documents get a category when the owner rotates the key.
+//
+// Documents without the header or without data key are legacy documents, encrypted directly
+// with owner's key as nonce (12 bytes) | AES-GCM ciphertext. Nonce of a legacy document can
+// start with the header, so documents are only parsed as envelopes if they have a data key.
+const (
+	formatVersionUnbound = 1
+	formatVersion        = 2
+	keyVersionMaster     = 1
+	keyVersionCategory   = 2
+	dataKeyLength        = 32
+	headerLength         = magicLength + 2
+	keyHeaderLength      = 1
+	magicLength          = 3
+	tagLength            = 16
+)
+
+var magic = []byte("IRY")
+
+// isEnvelope reports whether document with wrapped data key uses envelope encryption.
+// Legacy document starts with random nonce, which can match the header, but it has no data key
+func isEnvelope(document, wrapped []byte) bool {
+	return wrapped != nil && hasHeader(document)
+}
+
+// hasHeader reports whether document starts with known header and is long enough to hold nonce and tag
+func hasHeader(document []byte) bool {
+	if len(document) < headerLength || !bytes.Equal(document[:magicLength], magic) {
+		return false
+	}
+	switch document[magicLength] {
+	case formatVersionUnbound, formatVersion:
+		return len(document) >= headerLength+nonceLength+tagLength
+	case formatVersionStream:
+		return len(document) >= streamHeaderLength+tagLength
+	default:
+		return false
+	}
+}
+
+// isBound reports whether envelope is sealed with owner, ID and category as associated data
+func isBound(document []byte) bool {
+	return hasHeader(document) && document[magicLength] != formatVersionUnbound
+}
+
+// associatedData binds the document to its owner, ID and category
+func associatedData(header []byte, owner, id, category string) []byte {
+	out := append([]byte{}, header...)
+	out = append(out, owner...)
+	out = append(out, 0)
+	out = append(out, id...)
+	out = append(out, 0)
+	return append(out, category...)
+}
+
+func newDataKey() ([]byte, error) {
+	key := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sealDocument encrypts the document with data key and prepends the header
+func sealDocument(dataKey, document []byte, flags byte, owner, id, category string) ([]byte, error) {
+	header := append(append([]byte{}, magic...), formatVersion, flags)
+	sealed, err := seal(dataKey, document, associatedData(header, owner, id, category))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, sealed...), nil
+}
+
+func openDocument(dataKey, document []byte, owner, id, category string) ([]byte, error) {
+	if !hasHeader(document) {
+		return nil, fmt.Errorf("Document has unknown format")
+	}
+	if !isBound(document) {
+		return open(dataKey, document[headerLength:], nil)
+	}
+	if isStream(document) {
+		return openStream(dataKey, document, owner, id, category)
+	}
+
+	data, err := open(dataKey, document[headerLength:], associatedData(document[:headerLength], owner, id, category))
+	if err != nil {
+		return nil, fmt.Errorf("Document %s_%s could not be authenticated; %v", owner, id, err)
+	}
+	// flags are authenticated with the rest of the header
+	return decompress(data, document[magicLength+1])
+}
+
+// wrapKey encrypts data key with the key of category
+func wrapKey(keys *Keys, category string, dataKey []byte) ([]byte, error) {
+	if category == "" {
+		if keys.Master == nil {
+			return nil, &MissingKeyError{}
+		}
+		sealed, err := seal(keys.Master, dataKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{keyVersionMaster}, sealed...), nil
+	}
+
+	if len(category) > 255 {
+		return nil, fmt.Errorf("Category %s is too long", category)
+	}
+	kek, err := keys.Key(category)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(kek, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{keyVersionCategory, byte(len(category))}, category...)
+	return append(header, sealed...), nil
+}
+
+// unwrapKey decrypts data key and returns it with document's category
+func unwrapKey(keys *Keys, wrapped []byte) (dataKey []byte, category string, err error) {
+	if len(wrapped) <= keyHeaderLength {
+		return nil, "", fmt.Errorf("Data key has unknown format")
+	}
+
+	switch wrapped[0] {
+	case keyVersionMaster:
+		if keys.Master == nil {
+			return nil, "", &MissingKeyError{}
+		}
+		dataKey, err = open(keys.Master, wrapped[keyHeaderLength:], nil)
+		return dataKey, "", err
+	case keyVersionCategory:
+		length := int(wrapped[keyHeaderLength])
+		if len(wrapped) < keyHeaderLength+1+length {
+			return nil, "", fmt.Errorf("Data key has unknown format")
+		}
+		category = string(wrapped[keyHeaderLength+1 : keyHeaderLength+1+length])
+		kek, err := keys.Key(category)
+		if err != nil {
+			return nil, category, err
+		}
+		dataKey, err = open(kek, wrapped[keyHeaderLength+1+length:], nil)
+		return dataKey, category, err
+	default:
+		return nil, "", fmt.Errorf("Data key has unknown format")
+	}
+}
+
+// seal encrypts data using AES-GCM and returns nonce followed by ciphertext
+func seal(key, data, additionalData []byte) ([]byte, error) {
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceLength)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aesgcm.Seal(nonce, nonce, data, additionalData), nil
+}
+
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < nonceLength {
+		return nil, fmt.Errorf("Ciphertext too short")
+	}
+
+	return aesgcm.Open(nil, sealed[:nonceLength], sealed[nonceLength:], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
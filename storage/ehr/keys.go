@@ -0,0 +1,97 @@
+package ehr
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Categories of documents. Documents of each category are encrypted with their own key,
+// so that only some categories can be shared with a user
+const (
+	CategoryPersonal   = "personal"
+	CategoryVitalSigns = "vitalsigns"
+	CategoryECG        = "ecg"
+)
+
+// Categories lists all known categories
+var Categories = []string{CategoryPersonal, CategoryVitalSigns, CategoryECG}
+
+const masterKeyLength = 32
+
+// Keys give access to owner's documents. Owner has the master key from which
+// category keys are derived, others only get keys of categories shared with them
+type Keys struct {
+	Master     []byte            `json:"master,omitempty"`
+	Categories map[string][]byte `json:"categories,omitempty"`
+}
+
+// ParseKeys reads keys stored in state. A plain 32 byte key is the master key
+func ParseKeys(data []byte) (*Keys, error) {
+	if len(data) == masterKeyLength {
+		return &Keys{Master: data}, nil
+	}
+
+	keys := &Keys{}
+	if err := json.Unmarshal(data, keys); err != nil {
+		return nil, fmt.Errorf("Invalid keys; %v", err)
+	}
+	return keys, nil
+}
+
+// Encode encodes keys so they can be stored in state or sent to other user
+func (k *Keys) Encode() ([]byte, error) {
+	if k.Master != nil {
+		return k.Master, nil
+	}
+	return json.Marshal(k)
+}
+
+// Key returns key of category
+func (k *Keys) Key(category string) ([]byte, error) {
+	if k.Master != nil {
+		return deriveKey(k.Master, category)
+	}
+	if key, ok := k.Categories[category]; ok {
+		return key, nil
+	}
+	return nil, &MissingKeyError{Category: category}
+}
+
+// MissingKeyError is returned when document can't be decrypted because its category
+// was not shared with us. Category is empty for documents only the master key opens
+type MissingKeyError struct {
+	Category string
+}
+
+func (e *MissingKeyError) Error() string {
+	if e.Category == "" {
+		return "Master key is required for documents without category"
+	}
+	return fmt.Sprintf("No key for category %s", e.Category)
+}
+
+// Share returns keys of listed categories only
+func (k *Keys) Share(categories []string) (*Keys, error) {
+	out := &Keys{Categories: make(map[string][]byte)}
+	for _, category := range categories {
+		key, err := k.Key(category)
+		if err != nil {
+			return nil, err
+		}
+		out.Categories[category] = key
+	}
+	return out, nil
+}
+
+// deriveKey derives category key from the master key using HKDF-SHA256
+func deriveKey(master []byte, category string) ([]byte, error) {
+	key := make([]byte, masterKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte("iryo category "+category)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,306 @@
+package ehr
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Large documents, e.g. ECG attachments and images, are encrypted in chunks using
+// the STREAM construction, so they can be processed without holding the whole
+// document in memory. Stream format:
+//
+//	header (5 bytes) | nonce prefix (7 bytes) | chunk | chunk | ... | final chunk
+//
+// Each chunk is AES-GCM ciphertext of up to 64 KiB of the document, sealed with
+//
+//	nonce = nonce prefix (7 bytes) | chunk counter (4 bytes, big endian) | final flag (1 byte)
+//
+// and the same associated data as version 2 documents. Counter prevents chunks from being
+// reordered, final flag prevents the stream from being truncated at chunk boundary.
+const (
+	formatVersionStream = 3
+	noncePrefixLength   = 7
+	streamHeaderLength  = headerLength + noncePrefixLength
+	chunkSize           = 64 * 1024
+	sealedChunkSize     = chunkSize + tagLength
+)
+
+// EncryptReader encrypts document read from r in chunks with new data key, which is wrapped
+// with the key of category and saved. Returns ID of the document and reader of the sealed document,
+// which is meant to be streamed to the api or a file. Read returns error if r does
+func (s *Storage) EncryptReader(user, category string, r io.Reader, key []byte) (string, io.Reader, error) {
+	keys, err := ParseKeys(key)
+	if err != nil {
+		return "", nil, err
+	}
+	dataKey, err := newDataKey()
+	if err != nil {
+		return "", nil, err
+	}
+	wrapped, err := wrapKey(keys, category, dataKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := newID()
+	sealed, err := newEncryptReader(r, dataKey, user, id, category)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.SaveKey(user, id, wrapped); err != nil {
+		return "", nil, err
+	}
+
+	return id, sealed, nil
+}
+
+// DecryptWriter returns writer that decrypts sealed document written to it and writes
+// the document to w. Chunks are written to w as soon as they are authenticated, the whole
+// document is only authenticated once Close returns no error. Close does not close w
+func (s *Storage) DecryptWriter(owner, id string, w io.Writer, key []byte) (io.WriteCloser, error) {
+	keys, err := ParseKeys(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.GetKey(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	if wrapped == nil {
+		return nil, fmt.Errorf("Data key for %s_%s does not exist", owner, id)
+	}
+	dataKey, category, err := unwrapKey(keys, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecryptWriter(w, dataKey, owner, id, category), nil
+}
+
+// isStream reports whether document starts with the header of document encrypted in chunks
+func isStream(document []byte) bool {
+	return len(document) >= headerLength &&
+		bytes.Equal(document[:magicLength], magic) &&
+		document[magicLength] == formatVersionStream
+}
+
+// openStream decrypts whole sealed stream at once, used for streamed documents kept in storage
+func openStream(dataKey, document []byte, owner, id, category string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	w := newDecryptWriter(out, dataKey, owner, id, category)
+	if _, err := w.Write(document); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+type encryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	ad      []byte
+	counter uint32
+	// in holds one byte over chunk size, to know if the chunk is the final one
+	in       []byte
+	buffered int
+	sealed   []byte
+	out      []byte
+	done     bool
+	err      error
+}
+
+func newEncryptReader(r io.Reader, dataKey []byte, owner, id, category string) (*encryptReader, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixLength)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte{}, magic...), formatVersionStream, 0)
+
+	return &encryptReader{
+		r:      r,
+		aead:   aead,
+		prefix: prefix,
+		ad:     associatedData(header, owner, id, category),
+		in:     make([]byte, chunkSize+1),
+		sealed: make([]byte, 0, sealedChunkSize),
+		out:    append(header, prefix...),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		if e.done {
+			return 0, io.EOF
+		}
+		e.err = e.sealChunk()
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// sealChunk reads and seals next chunk of the document
+func (e *encryptReader) sealChunk() error {
+	n, err := io.ReadFull(e.r, e.in[e.buffered:])
+	n += e.buffered
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		e.done = true
+	default:
+		return err
+	}
+
+	chunk := e.in[:n]
+	if !e.done {
+		chunk = e.in[:chunkSize]
+		if e.counter == math.MaxUint32 {
+			return fmt.Errorf("Document is too large")
+		}
+	}
+	e.out = e.aead.Seal(e.sealed[:0], chunkNonce(e.prefix, e.counter, e.done), chunk, e.ad)
+	e.counter++
+
+	// keep the byte read over chunk size for the next chunk
+	e.in[0] = e.in[chunkSize]
+	e.buffered = 1
+	return nil
+}
+
+type decryptWriter struct {
+	w        io.Writer
+	dataKey  []byte
+	owner    string
+	id       string
+	category string
+	aead     cipher.AEAD
+	header   []byte
+	ad       []byte
+	counter  uint32
+	buf      []byte
+	plain    []byte
+	done     bool
+	err      error
+}
+
+func newDecryptWriter(w io.Writer, dataKey []byte, owner, id, category string) *decryptWriter {
+	return &decryptWriter{
+		w:        w,
+		dataKey:  dataKey,
+		owner:    owner,
+		id:       id,
+		category: category,
+		header:   make([]byte, 0, streamHeaderLength),
+		buf:      make([]byte, 0, sealedChunkSize),
+		plain:    make([]byte, 0, chunkSize),
+	}
+}
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.done {
+		return 0, fmt.Errorf("Document %s_%s is closed", d.owner, d.id)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(d.header) < streamHeaderLength {
+			n := copy(d.header[len(d.header):streamHeaderLength], p)
+			d.header = d.header[:len(d.header)+n]
+			written, p = written+n, p[n:]
+			if len(d.header) == streamHeaderLength {
+				if d.err = d.readHeader(); d.err != nil {
+					return written, d.err
+				}
+			}
+			continue
+		}
+
+		// chunk is known not to be the final one only when more data follows
+		if len(d.buf) == sealedChunkSize {
+			if d.err = d.openChunk(false); d.err != nil {
+				return written, d.err
+			}
+		}
+		n := copy(d.buf[len(d.buf):sealedChunkSize], p)
+		d.buf = d.buf[:len(d.buf)+n]
+		written, p = written+n, p[n:]
+	}
+
+	return written, nil
+}
+
+// Close opens the final chunk. Document is truncated if Close returns error
+func (d *decryptWriter) Close() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.done {
+		return nil
+	}
+	if len(d.header) < streamHeaderLength {
+		return fmt.Errorf("Document %s_%s is truncated", d.owner, d.id)
+	}
+	if d.err = d.openChunk(true); d.err != nil {
+		return d.err
+	}
+	d.done = true
+	return nil
+}
+
+func (d *decryptWriter) readHeader() error {
+	if !isStream(d.header) {
+		return fmt.Errorf("Document %s_%s has unknown format", d.owner, d.id)
+	}
+	aead, err := newGCM(d.dataKey)
+	if err != nil {
+		return err
+	}
+	d.aead = aead
+	d.ad = associatedData(d.header[:headerLength], d.owner, d.id, d.category)
+	return nil
+}
+
+func (d *decryptWriter) openChunk(final bool) error {
+	if !final && d.counter == math.MaxUint32 {
+		return fmt.Errorf("Document %s_%s is too large", d.owner, d.id)
+	}
+	nonce := chunkNonce(d.header[headerLength:], d.counter, final)
+	plain, err := d.aead.Open(d.plain[:0], nonce, d.buf, d.ad)
+	if err != nil {
+		return fmt.Errorf("Document %s_%s could not be authenticated; %v", d.owner, d.id, err)
+	}
+	d.counter++
+	d.buf = d.buf[:0]
+
+	_, err = d.w.Write(plain)
+	return err
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, nonceLength)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixLength:], counter)
+	if final {
+		nonce[nonceLength-1] = 1
+	}
+	return nonce
+}
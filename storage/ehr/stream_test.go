@@ -0,0 +1,87 @@
+package ehr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := New()
+
+	// sizes around chunk boundaries
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		document := make([]byte, size)
+		rand.Read(document)
+
+		id, r, err := s.EncryptReader("owner", CategoryECG, bytes.NewReader(document), master)
+		if err != nil {
+			t.Fatalf("EncryptReader failed: %v", err)
+		}
+		sealed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+
+		out := &bytes.Buffer{}
+		w, err := s.DecryptWriter("owner", id, out, master)
+		if err != nil {
+			t.Fatalf("DecryptWriter failed: %v", err)
+		}
+		// write in pieces not aligned to chunks
+		if _, err := io.CopyBuffer(w, bytes.NewReader(sealed), make([]byte, 1000)); err != nil {
+			t.Fatalf("Write of %d bytes failed: %v", size, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close of %d bytes failed: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), document) {
+			t.Errorf("Document of %d bytes does not match", size)
+		}
+
+		// streamed documents can be kept in storage as well
+		s.Saveid("owner", id, sealed)
+		if data, err := s.Decrypt("owner", id, master); err != nil || !bytes.Equal(data, document) {
+			t.Errorf("Decrypt of %d bytes failed: %v", size, err)
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+	s := New()
+
+	id, r, err := s.EncryptReader("owner", CategoryECG, bytes.NewReader(make([]byte, 2*chunkSize)), master)
+	if err != nil {
+		t.Fatalf("EncryptReader failed: %v", err)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	// cut at chunk boundary
+	w, err := s.DecryptWriter("owner", id, ioutil.Discard, master)
+	if err != nil {
+		t.Fatalf("DecryptWriter failed: %v", err)
+	}
+	w.Write(sealed[:streamHeaderLength+sealedChunkSize])
+	if err := w.Close(); err == nil {
+		t.Error("Truncated document should not be authenticated")
+	}
+
+	// moved to another ID
+	s.SaveKey("owner", "other", mustGetKey(t, s, "owner", id))
+	w, err = s.DecryptWriter("owner", "other", ioutil.Discard, master)
+	if err != nil {
+		t.Fatalf("DecryptWriter failed: %v", err)
+	}
+	if _, err := w.Write(sealed); err == nil {
+		if err := w.Close(); err == nil {
+			t.Error("Document moved to another ID should not decrypt")
+		}
+	}
+}
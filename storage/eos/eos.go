@@ -1,7 +1,6 @@
 package eos
 
 import (
-	"crypto/sha256"
 	"fmt"
 	"log"
 	"math"
@@ -39,9 +38,27 @@ type AccessReq struct {
 	Account eos.AccountName `json:"account"`
 }
 
-// GrantAccess adds `to` field in contract table
-func (s *Storage) GrantAccess(to string) error {
-	s.log.Debugf("Eos::grantAccess(%s) called", to)
+// GrantReq contains fields of grantaccess action, Expires is unix time in seconds or 0 if access never expires
+type GrantReq struct {
+	Patient     eos.AccountName `json:"patient"`
+	Account     eos.AccountName `json:"account"`
+	Permissions uint8           `json:"permissions"`
+	Expires     uint32          `json:"expires"`
+}
+
+// GrantAccess adds `to` field in contract table with `permissions`. Access is granted until `expires`,
+// forever if it's zero. Permissions and expiry of access already granted are changed
+func (s *Storage) GrantAccess(to string, permissions Permission, expires time.Time) error {
+	s.log.Debugf("Eos::grantAccess(%s, %s, %v) called", to, permissions, expires)
+
+	if permissions == 0 {
+		return fmt.Errorf("No permission to grant")
+	}
+
+	var expiresUnix uint32
+	if !expires.IsZero() {
+		expiresUnix = uint32(expires.Unix())
+	}
 
 	// Give access action
 	action := &eos.Action{
@@ -50,7 +67,7 @@ func (s *Storage) GrantAccess(to string) error {
 		Authorization: []eos.PermissionLevel{
 			{eos.AN(s.state.EosAccount), eos.PermissionName("active")},
 		},
-		ActionData: eos.NewActionData(AccessReq{eos.AN(s.state.EosAccount), eos.AN(to)}),
+		ActionData: eos.NewActionData(GrantReq{eos.AN(s.state.EosAccount), eos.AN(to), uint8(permissions), expiresUnix}),
 	}
 	_, err := s.api.SignPushActions(action)
 	s.log.Debugf("Granted access to user; %+v", to)
@@ -73,35 +90,147 @@ func (s *Storage) RevokeAccess(to string) error {
 	return err
 }
 
+// RelinquishAccess removes access `patient` granted to account in state, signed by the grantee
+func (s *Storage) RelinquishAccess(patient string) error {
+	s.log.Debugf("Eos::relinquishAccess(%s) called", patient)
+	action := &eos.Action{
+		Account: eos.AN(s.config.EosContractAccount),
+		Name:    eos.ActN("revokeaccess2"),
+		Authorization: []eos.PermissionLevel{
+			{eos.AN(s.state.EosAccount), eos.PermissionName("active")},
+		},
+		ActionData: eos.NewActionData(AccessReq{eos.AN(patient), eos.AN(s.state.EosAccount)}),
+	}
+	_, err := s.api.SignPushActions(action)
+	return err
+}
+
 // AccessGranted checks if connection between `patient` and `to` is establisehd
-// return true if connection is established and false if it is not
-// Due to uint32 limitations this functions allows connection for up to 4294967295 doctors to a single client
+// return true if connection is established and not expired and false if it is not
 func (s *Storage) AccessGranted(patient, to string) (bool, error) {
 	s.log.Debugf("Eos::accessGranted(%s, %s) called", patient, to)
+	permissions, err := s.Permissions(patient, to)
+	return permissions != 0, err
+}
+
+type TableEntry struct {
+	AccountName string `json:"account_name"`
+	Permissions uint8  `json:"permissions"`
+	Expires     uint32 `json:"expires"`
+}
+
+// Permission returns permissions granted in the entry
+func (e TableEntry) Permission() Permission {
+	if e.Permissions == 0 {
+		return PermissionDefault
+	}
+	return Permission(e.Permissions)
+}
+
+// ExpiresAt returns when access expires, zero time if it never does
+func (e TableEntry) ExpiresAt() time.Time {
+	if e.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(e.Expires), 0)
+}
+
+// Expired reports whether access has expired
+func (e TableEntry) Expired() bool {
+	return e.Expires != 0 && time.Now().Unix() >= int64(e.Expires)
+}
+
+// ListConnected lists accounts with access to `patient`'s documents that has not expired
+func (s *Storage) ListConnected(patient string) ([]string, error) {
+	entries, err := s.listEntries(patient)
+	if err != nil {
+		return nil, err
+	}
+
+	// fill the list
+	ret := []string{}
+	for _, entry := range entries {
+		s.log.Debugf("Adding %s to list", entry.AccountName)
+		ret = append(ret, entry.AccountName)
+	}
+
+	return ret, nil
+}
+
+// Permissions returns permissions `patient` granted to `to`, zero if access is not granted or expired
+func (s *Storage) Permissions(patient, to string) (Permission, error) {
+	permissions, _, err := s.Grant(patient, to)
+	return permissions, err
+}
+
+// Grant returns permissions `patient` granted to `to` and when they expire, zero time if never.
+// Permissions are zero if access is not granted or expired. Only the row of `to` is read instead of the whole table
+func (s *Storage) Grant(patient, to string) (Permission, time.Time, error) {
+	s.log.Debugf("Eos::grant(%s, %s) called", patient, to)
 	if patient == to {
-		return true, nil
+		return PermissionDefault, time.Time{}, nil
 	}
-	// Check if `patient` has its field in the table
-	b := false
-	list, err := s.ListConnected(patient)
-	s.log.Debugf("Got connected users: %s", list)
+	r, err := s.api.GetTableRows(eos.GetTableRowsRequest{
+		Code:       s.config.EosContractAccount,
+		JSON:       true,
+		Scope:      patient,
+		Table:      "person",
+		KeyType:    "name",
+		LowerBound: to,
+		UpperBound: to,
+		Limit:      1})
 	if err != nil {
-		return b, nil
+		return 0, time.Time{}, err
 	}
-	for _, entry := range list {
-		if entry == to {
-			b = true
-			break
+
+	entries := make([]TableEntry, 0)
+	r.JSONToStructs(&entries)
+	for _, entry := range entries {
+		if entry.AccountName == to && !entry.Expired() {
+			return entry.Permission(), entry.ExpiresAt(), nil
 		}
 	}
-	return b, nil
+	return 0, time.Time{}, nil
 }
 
-type TableEntry struct {
-	AccountName string `json:"account_name"`
+// granteeEntry is row of grantee's table, Key is the patient who granted the access
+type granteeEntry struct {
+	Key string `json:"key"`
+	TableEntry
 }
 
-func (s *Storage) ListConnected(patient string) ([]string, error) {
+// ListGrantedBy lists patients who granted `grantee` access that has not expired
+func (s *Storage) ListGrantedBy(grantee string) ([]string, error) {
+	s.log.Debugf("Eos::listGrantedBy(%s) called", grantee)
+
+	r, err := s.api.GetTableRows(eos.GetTableRowsRequest{
+		Code:    s.config.EosContractAccount,
+		JSON:    true,
+		Scope:   grantee,
+		Table:   "grantee",
+		KeyType: "i64",
+		Limit:   math.MaxUint32})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]granteeEntry, 0)
+	r.JSONToStructs(&entries)
+
+	ret := []string{}
+	for _, entry := range entries {
+		if entry.Expired() {
+			s.log.Debugf("Access to %s has expired", entry.Key)
+			continue
+		}
+		ret = append(ret, entry.Key)
+	}
+
+	return ret, nil
+}
+
+// listEntries reads entries of `patient`'s table that has not expired
+func (s *Storage) listEntries(patient string) ([]TableEntry, error) {
 	s.log.Debugf("Eos::listAccountFromTable(%s) called", patient)
 
 	// Get the table
@@ -120,11 +249,13 @@ func (s *Storage) ListConnected(patient string) ([]string, error) {
 	a := make([]TableEntry, 0)
 	r.JSONToStructs(&a)
 
-	// fill the list
-	ret := []string{}
+	ret := []TableEntry{}
 	for _, entry := range a {
-		s.log.Debugf("Adding %s to list", entry.AccountName)
-		ret = append(ret, entry.AccountName)
+		if entry.Expired() {
+			s.log.Debugf("Access of %s has expired", entry.AccountName)
+			continue
+		}
+		ret = append(ret, entry)
 	}
 
 	return ret, nil
@@ -233,15 +364,13 @@ func (s *Storage) CreateAccount(account, keyStr string) error {
 	return nil
 }
 
-// NewKey creates new private key and saves it to config
+// NewKey creates new private key derived from new mnemonic and saves it to state
 func (s *Storage) NewKey() error {
-	key, err := ecc.NewRandomPrivateKey()
-	if err != nil {
+	if err := s.state.NewMnemonicKey(); err != nil {
 		return err
 	}
-	s.ImportKey(key.String())
-	s.state.EosPrivate = key.String()
-	return nil
+	_, err := s.ImportKey(s.state.EosPrivate)
+	return err
 }
 
 // ImportKey imports private key
@@ -274,18 +403,11 @@ func (s *Storage) CheckAccountKey(account, key string) (bool, error) {
 
 // Sign creates string signature of data
 func (s *Storage) SignHash(data []byte) (string, error) {
-	h := sha256.New()
-	h.Write(data)
-	return s.SignByte(h.Sum(nil))
+	return s.state.SignHash(data)
 }
 
 func (s *Storage) SignByte(data []byte) (string, error) {
-	sk, err := ecc.NewPrivateKey(s.state.EosPrivate)
-	if err != nil {
-		return "", err
-	}
-	sign, err := sk.Sign(data)
-	return sign.String(), err
+	return s.state.SignByte(data)
 }
 
 func (s *Storage) CheckAccountExists(account string) bool {
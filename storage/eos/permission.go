@@ -0,0 +1,73 @@
+package eos
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permission is bitmask of what grantee is allowed to do with patient's documents
+type Permission uint8
+
+const (
+	// PermissionRead allows listing and downloading documents
+	PermissionRead Permission = 1 << iota
+	// PermissionWrite allows uploading documents and replacing their data keys
+	PermissionWrite
+	// PermissionEmergency allows reading documents in emergency, it's meant for emergency services.
+	// Unlike reads with PermissionRead, the api records every read in the patient's audit log
+	PermissionEmergency
+
+	// PermissionDefault is granted when no permission is selected, and to grants written before
+	// permissions were introduced
+	PermissionDefault = PermissionRead | PermissionWrite
+)
+
+var permissionNames = []struct {
+	permission Permission
+	name       string
+}{
+	{PermissionRead, "read"},
+	{PermissionWrite, "write"},
+	{PermissionEmergency, "emergency"},
+}
+
+// ParsePermissions combines permissions with listed names, default permission if none are listed
+func ParsePermissions(names []string) (Permission, error) {
+	var p Permission
+	for _, name := range names {
+		found := false
+		for _, n := range permissionNames {
+			if n.name == name {
+				p |= n.permission
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Unknown permission %s", name)
+		}
+	}
+	if p == 0 {
+		p = PermissionDefault
+	}
+	return p, nil
+}
+
+// Has reports whether all permissions in q are granted
+func (p Permission) Has(q Permission) bool {
+	return p&q == q
+}
+
+// CanRead reports whether documents can be read, in emergency or not. Only users that can read get the key
+func (p Permission) CanRead() bool {
+	return p.Has(PermissionRead) || p.Has(PermissionEmergency)
+}
+
+func (p Permission) String() string {
+	names := []string{}
+	for _, n := range permissionNames {
+		if p.Has(n.permission) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
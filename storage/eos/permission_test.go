@@ -0,0 +1,31 @@
+package eos
+
+import "testing"
+
+func TestParsePermissions(t *testing.T) {
+	tests := []struct {
+		names    []string
+		expected Permission
+	}{
+		{nil, PermissionRead | PermissionWrite},
+		{[]string{"read"}, PermissionRead},
+		{[]string{"write", "emergency"}, PermissionWrite | PermissionEmergency},
+	}
+	for _, test := range tests {
+		p, err := ParsePermissions(test.names)
+		if err != nil {
+			t.Fatalf("ParsePermissions(%v) failed: %v", test.names, err)
+		}
+		if p != test.expected {
+			t.Errorf("ParsePermissions(%v) = %s, expected %s", test.names, p, test.expected)
+		}
+	}
+
+	if _, err := ParsePermissions([]string{"delete"}); err == nil {
+		t.Error("Unknown permission should be rejected")
+	}
+
+	if !PermissionEmergency.CanRead() || PermissionWrite.CanRead() {
+		t.Error("CanRead returned wrong result")
+	}
+}
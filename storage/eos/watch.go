@@ -0,0 +1,100 @@
+package eos
+
+import (
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// AccessEvent is grant or revoke of access found in a block
+type AccessEvent struct {
+	Granted     bool
+	Patient     string
+	Account     string
+	Permissions Permission // set if access was granted
+	Expires     time.Time  // set if granted access expires
+}
+
+// LastIrreversibleBlock returns number of the newest block that can no longer be reverted
+func (s *Storage) LastIrreversibleBlock() (uint32, error) {
+	info, err := s.api.GetInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.LastIrreversibleBlockNum, nil
+}
+
+// AccessEvents reads grants and revokes of the contract in block `num`. Only actions of
+// transactions signed by users are read, deferred transactions and inline actions sent by
+// other contracts are not in the block. Transactions and actions that can't be decoded are
+// skipped, so that one bad action doesn't stop the watcher
+func (s *Storage) AccessEvents(num uint32) ([]AccessEvent, error) {
+	block, err := s.api.GetBlockByNum(num)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []AccessEvent{}
+	for _, receipt := range block.Transactions {
+		// deferred transactions are listed by id only
+		if receipt.Status != eos.TransactionStatusExecuted || receipt.Transaction.Packed == nil {
+			continue
+		}
+		tx, err := receipt.Transaction.Packed.UnpackBare()
+		if err != nil {
+			s.log.Printf("Eos:: Skipping transaction %s in block %d, failed to unpack it; %v", receipt.Transaction.ID, num, err)
+			continue
+		}
+		events = append(events, s.accessEvents(tx.Actions, num)...)
+	}
+
+	return events, nil
+}
+
+// accessEvents decodes grants and revokes among actions of block `num`
+func (s *Storage) accessEvents(actions []*eos.Action, num uint32) []AccessEvent {
+	events := []AccessEvent{}
+	for _, action := range actions {
+		if string(action.Account) != s.config.EosContractAccount {
+			continue
+		}
+		event, ok, err := accessEvent(action)
+		if err != nil {
+			s.log.Printf("Eos:: Skipping %s in block %d, failed to decode it; %v", action.Name, num, err)
+			continue
+		}
+		if ok {
+			s.log.Debugf("Eos:: Found %+v in block %d", event, num)
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func accessEvent(action *eos.Action) (AccessEvent, bool, error) {
+	switch action.Name {
+	case eos.ActN("grantaccess"):
+		req := GrantReq{}
+		if err := eos.UnmarshalBinary(action.HexData, &req); err != nil {
+			return AccessEvent{}, false, err
+		}
+		event := AccessEvent{
+			Granted:     true,
+			Patient:     string(req.Patient),
+			Account:     string(req.Account),
+			Permissions: TableEntry{Permissions: req.Permissions}.Permission(),
+		}
+		if req.Expires != 0 {
+			event.Expires = time.Unix(int64(req.Expires), 0)
+		}
+		return event, true, nil
+
+	case eos.ActN("revokeaccess"), eos.ActN("revokeaccess2"):
+		req := AccessReq{}
+		if err := eos.UnmarshalBinary(action.HexData, &req); err != nil {
+			return AccessEvent{}, false, err
+		}
+		return AccessEvent{Patient: string(req.Patient), Account: string(req.Account)}, true, nil
+	}
+	return AccessEvent{}, false, nil
+}
@@ -0,0 +1,64 @@
+package eos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+)
+
+func TestAccessEvent(t *testing.T) {
+	action := &eos.Action{
+		Name:       eos.ActN("grantaccess"),
+		ActionData: eos.NewActionData(GrantReq{eos.AN("patient.iryo"), eos.AN("doctor1.iryo"), uint8(PermissionRead), 1600000000}),
+	}
+	data, err := eos.MarshalBinary(action.ActionData.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	action.HexData = data
+
+	event, ok, err := accessEvent(action)
+	if err != nil || !ok {
+		t.Fatalf("accessEvent failed: %v, %v", ok, err)
+	}
+	expected := AccessEvent{true, "patient.iryo", "doctor1.iryo", PermissionRead, time.Unix(1600000000, 0)}
+	if event != expected {
+		t.Errorf("Expected %+v, got %+v", expected, event)
+	}
+
+	action.Name = eos.ActN("revokeaccess2")
+	if action.HexData, err = eos.MarshalBinary(AccessReq{eos.AN("patient.iryo"), eos.AN("doctor1.iryo")}); err != nil {
+		t.Fatal(err)
+	}
+	if event, ok, _ := accessEvent(action); !ok || event.Granted || event.Account != "doctor1.iryo" {
+		t.Errorf("Revoke was not decoded: %+v", event)
+	}
+
+	action.Name = eos.ActN("transfer")
+	if _, ok, _ := accessEvent(action); ok {
+		t.Error("Unrelated action should be ignored")
+	}
+}
+
+func TestAccessEventsSkipsUndecodable(t *testing.T) {
+	cfg := &config.Config{EosContractAccount: "iryo"}
+	s := &Storage{config: cfg, log: logger.New(cfg)}
+
+	data, err := eos.MarshalBinary(AccessReq{eos.AN("patient.iryo"), eos.AN("doctor1.iryo")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []*eos.Action{
+		{Account: eos.AN("iryo"), Name: eos.ActN("grantaccess"), ActionData: eos.ActionData{HexData: []byte{1}}},
+		{Account: eos.AN("iryo"), Name: eos.ActN("revokeaccess"), ActionData: eos.ActionData{HexData: data}},
+	}
+
+	events := s.accessEvents(actions, 1)
+	if len(events) != 1 || events[0].Granted || events[0].Patient != "patient.iryo" {
+		t.Errorf("Expected only the revoke, got %+v", events)
+	}
+}
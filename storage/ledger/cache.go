@@ -0,0 +1,91 @@
+package ledger
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache caches permissions looked up in the ledger for ttl, so that every request does not
+// have to reach the chain. Granted permissions are not cached past their expiry. Entries are
+// invalidated when grant or revoke is observed on the chain, ttl bounds how long changes that
+// were not observed take to be noticed. It's safe for concurrent use
+type Cache struct {
+	Ledger
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+type cacheKey struct {
+	patient string
+	to      string
+}
+
+type cacheEntry struct {
+	permissions Permission
+	granted     time.Time // when the grant expires, zero if never
+	expires     time.Time // when the entry expires
+}
+
+// NewCache creates cache of permissions in `l`
+func NewCache(l Ledger, ttl time.Duration) *Cache {
+	return &Cache{Ledger: l, ttl: ttl, entries: make(map[cacheKey]cacheEntry)}
+}
+
+// Permissions returns cached permissions `patient` granted to `to`, they are looked up if not cached
+func (c *Cache) Permissions(patient, to string) (Permission, error) {
+	permissions, _, err := c.Grant(patient, to)
+	return permissions, err
+}
+
+// Grant returns cached permissions `patient` granted to `to` with their expiry, they are looked up if not cached
+func (c *Cache) Grant(patient, to string) (Permission, time.Time, error) {
+	key := cacheKey{patient, to}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.permissions, entry.granted, nil
+	}
+
+	permissions, granted, err := c.Ledger.Grant(patient, to)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	// access is looked up again once it expires
+	expires := time.Now().Add(c.ttl)
+	if permissions != 0 && !granted.IsZero() && granted.Before(expires) {
+		expires = granted
+	}
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{permissions, granted, expires}
+	c.mu.Unlock()
+	return permissions, granted, nil
+}
+
+// AccessGranted checks if `patient` granted `to` any permission, using the cache
+func (c *Cache) AccessGranted(patient, to string) (bool, error) {
+	permissions, err := c.Permissions(patient, to)
+	return permissions != 0, err
+}
+
+// Invalidate removes cached permissions `patient` granted to `to`. It should only be called
+// when the change is observed on the chain, messages of clients can't be trusted to report it
+func (c *Cache) Invalidate(patient, to string) {
+	c.mu.Lock()
+	delete(c.entries, cacheKey{patient, to})
+	c.mu.Unlock()
+}
+
+// Expire removes entries that expired, it should be called periodically so that the cache doesn't grow
+func (c *Cache) Expire() {
+	now := time.Now()
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.mu.Unlock()
+}
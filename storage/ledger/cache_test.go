@@ -0,0 +1,78 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/state"
+)
+
+func TestCache(t *testing.T) {
+	patient := newTestState(t, "patient.iryo")
+	doctor := newTestState(t, "doctor1.iryo")
+	m := NewMemory(patient, "", logger.New(&config.Config{}))
+	for _, s := range []*state.State{patient, doctor} {
+		if err := m.CreateAccount(s.EosAccount, s.GetEosPublicKey()); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+	}
+	c := NewCache(m, time.Hour)
+
+	if ok, _ := c.AccessGranted("patient.iryo", "doctor1.iryo"); ok {
+		t.Error("Access should not be granted")
+	}
+	if err := m.GrantAccess("doctor1.iryo", PermissionRead, time.Time{}); err != nil {
+		t.Fatalf("GrantAccess failed: %v", err)
+	}
+	if ok, _ := c.AccessGranted("patient.iryo", "doctor1.iryo"); ok {
+		t.Error("Cached result should be returned before invalidation")
+	}
+	c.Invalidate("patient.iryo", "doctor1.iryo")
+	if p, _ := c.Permissions("patient.iryo", "doctor1.iryo"); p != PermissionRead {
+		t.Errorf("Expected read permission after invalidation, got %s", p)
+	}
+
+	if err := m.RevokeAccess("doctor1.iryo"); err != nil {
+		t.Fatalf("RevokeAccess failed: %v", err)
+	}
+	c.Invalidate("patient.iryo", "doctor1.iryo")
+	if ok, _ := c.AccessGranted("patient.iryo", "doctor1.iryo"); ok {
+		t.Error("Access should be revoked after invalidation")
+	}
+
+	c = NewCache(m, 0)
+	c.AccessGranted("patient.iryo", "doctor1.iryo")
+	c.Expire()
+	if len(c.entries) != 0 {
+		t.Error("Expired entries were not removed")
+	}
+}
+
+func TestCacheGrantExpiry(t *testing.T) {
+	patient := newTestState(t, "patient.iryo")
+	doctor := newTestState(t, "doctor1.iryo")
+	m := NewMemory(patient, "", logger.New(&config.Config{}))
+	for _, s := range []*state.State{patient, doctor} {
+		if err := m.CreateAccount(s.EosAccount, s.GetEosPublicKey()); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+	}
+	c := NewCache(m, time.Hour)
+
+	expires := time.Now().Add(200 * time.Millisecond)
+	if err := m.GrantAccess("doctor1.iryo", PermissionRead, expires); err != nil {
+		t.Fatalf("GrantAccess failed: %v", err)
+	}
+	p, granted, err := c.Grant("patient.iryo", "doctor1.iryo")
+	if err != nil || p != PermissionRead || !granted.Equal(expires) {
+		t.Errorf("Expected read permission until %v, got %s until %v, %v", expires, p, granted, err)
+	}
+
+	// Access is not cached past the grant's expiry, even without invalidation
+	time.Sleep(time.Until(expires) + 10*time.Millisecond)
+	if ok, _ := c.AccessGranted("patient.iryo", "doctor1.iryo"); ok {
+		t.Error("Expired access should not be returned from the cache")
+	}
+}
@@ -0,0 +1,85 @@
+package ledger
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/eoscanada/eos-go/ecc"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/state"
+	"github.com/iryonetwork/network-poc/storage/eos"
+)
+
+// Permission is bitmask of what grantee is allowed to do with patient's documents
+type Permission = eos.Permission
+
+// Permissions that can be granted
+const (
+	PermissionRead      = eos.PermissionRead
+	PermissionWrite     = eos.PermissionWrite
+	PermissionEmergency = eos.PermissionEmergency
+	PermissionDefault   = eos.PermissionDefault
+)
+
+// ParsePermissions combines permissions with listed names, default permission if none are listed
+var ParsePermissions = eos.ParsePermissions
+
+// Ledger keeps accounts and the access control list of the network. Access is granted,
+// revoked and accounts are created by the account in state, signed with its EOS key.
+// Grantee can give up access it was granted with RelinquishAccess.
+// Access is granted until expiry, forever if it's zero time. Expired access is not listed.
+// Grant returns permissions with their expiry, Permissions only the permissions.
+// ListConnected lists grantees of a patient, ListGrantedBy patients of a grantee
+type Ledger interface {
+	GrantAccess(to string, permissions Permission, expires time.Time) error
+	RevokeAccess(to string) error
+	RelinquishAccess(patient string) error
+	AccessGranted(patient, to string) (bool, error)
+	Permissions(patient, to string) (Permission, error)
+	Grant(patient, to string) (Permission, time.Time, error)
+	ListConnected(patient string) ([]string, error)
+	ListGrantedBy(grantee string) ([]string, error)
+	CheckAccountKey(account, key string) (bool, error)
+	CheckAccountExists(account string) bool
+	CreateAccount(account, key string) error
+
+	NewKey() error
+	ImportKey(key string) (*ecc.PrivateKey, error)
+	SignHash(data []byte) (string, error)
+}
+
+// AccessEvent is grant or revoke of access found in a block
+type AccessEvent = eos.AccessEvent
+
+// Watcher is implemented by ledgers that are kept in blocks, so that changes to access
+// can be followed. Only blocks that can no longer be reverted are read
+type Watcher interface {
+	LastIrreversibleBlock() (uint32, error)
+	AccessEvents(block uint32) ([]AccessEvent, error)
+}
+
+var (
+	_ Ledger  = (*eos.Storage)(nil)
+	_ Ledger  = (*Memory)(nil)
+	_ Watcher = (*eos.Storage)(nil)
+)
+
+// Open creates ledger selected in config. Access control list is kept in EOS contract
+// if LEDGER is eos, in memory if it is memory. Memory ledger is shared with other processes
+// through LEDGER_PATH file if it is set
+func Open(cfg *config.Config, state *state.State, log *logger.Log) (Ledger, error) {
+	switch cfg.Ledger {
+	case "", "eos":
+		s, err := eos.New(cfg, state, log)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "memory":
+		return NewMemory(state, cfg.LedgerPath, log), nil
+	default:
+		return nil, fmt.Errorf("Unknown ledger %s", cfg.Ledger)
+	}
+}
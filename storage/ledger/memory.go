@@ -0,0 +1,293 @@
+package ledger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eoscanada/eos-go/ecc"
+
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/state"
+)
+
+// Memory keeps accounts and access control list in memory, it's meant for tests and
+// development without nodeos. If path is set, the ledger is loaded from the file before
+// each call and saved after each change, so it can be shared by api and clients running
+// on the same machine. It's safe for concurrent use within one process
+type Memory struct {
+	mu    sync.Mutex
+	state *state.State
+	path  string
+	log   *logger.Log
+	data  memoryData
+}
+
+type memoryData struct {
+	Accounts map[string]string        // public keys of accounts
+	Access   map[string][]memoryGrant // accounts patients granted access to
+}
+
+type memoryGrant struct {
+	Account     string
+	Permissions Permission
+	Expires     time.Time
+}
+
+func (g memoryGrant) expired() bool {
+	return !g.Expires.IsZero() && !time.Now().Before(g.Expires)
+}
+
+// NewMemory creates empty memory ledger, or one shared through file at path
+func NewMemory(state *state.State, path string, log *logger.Log) *Memory {
+	return &Memory{
+		state: state,
+		path:  path,
+		log:   log,
+		data: memoryData{
+			Accounts: make(map[string]string),
+			Access:   make(map[string][]memoryGrant),
+		},
+	}
+}
+
+// GrantAccess grants `to` access with `permissions` to documents of account in state until `expires`,
+// forever if it's zero. Permissions and expiry of access already granted are changed
+func (m *Memory) GrantAccess(to string, permissions Permission, expires time.Time) error {
+	m.log.Debugf("Ledger::grantAccess(%s, %s, %v) called", to, permissions, expires)
+	if permissions == 0 {
+		return fmt.Errorf("No permission to grant")
+	}
+	if !expires.IsZero() && !expires.After(time.Now()) {
+		return fmt.Errorf("Expiry is in the past")
+	}
+	return m.update(func(d *memoryData) error {
+		patient := m.state.EosAccount
+		if _, ok := d.Accounts[to]; !ok {
+			return fmt.Errorf("Account %s does not exist", to)
+		}
+		for i, g := range d.Access[patient] {
+			if g.Account == to {
+				d.Access[patient][i].Permissions = permissions
+				d.Access[patient][i].Expires = expires
+				return nil
+			}
+		}
+		d.Access[patient] = append(d.Access[patient], memoryGrant{Account: to, Permissions: permissions, Expires: expires})
+		return nil
+	})
+}
+
+// RevokeAccess revokes access of `to` to documents of account in state
+func (m *Memory) RevokeAccess(to string) error {
+	m.log.Debugf("Ledger::revokeAccess(%s) called", to)
+	return m.removeAccess(m.state.EosAccount, to)
+}
+
+// RelinquishAccess gives up access `patient` granted to account in state
+func (m *Memory) RelinquishAccess(patient string) error {
+	m.log.Debugf("Ledger::relinquishAccess(%s) called", patient)
+	return m.removeAccess(patient, m.state.EosAccount)
+}
+
+func (m *Memory) removeAccess(patient, to string) error {
+	return m.update(func(d *memoryData) error {
+		for i, g := range d.Access[patient] {
+			if g.Account == to {
+				d.Access[patient] = append(d.Access[patient][:i], d.Access[patient][i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s has no access", to)
+	})
+}
+
+// AccessGranted checks if `patient` granted `to` access to their documents
+func (m *Memory) AccessGranted(patient, to string) (bool, error) {
+	if patient == to {
+		return true, nil
+	}
+	list, err := m.ListConnected(patient)
+	if err != nil {
+		return false, err
+	}
+	return contains(list, to), nil
+}
+
+// Permissions returns permissions `patient` granted to `to`, zero if access is not granted or expired
+func (m *Memory) Permissions(patient, to string) (Permission, error) {
+	p, _, err := m.Grant(patient, to)
+	return p, err
+}
+
+// Grant returns permissions `patient` granted to `to` that have not expired and when they expire
+func (m *Memory) Grant(patient, to string) (Permission, time.Time, error) {
+	if patient == to {
+		return PermissionDefault, time.Time{}, nil
+	}
+	var p Permission
+	var expires time.Time
+	err := m.view(func(d *memoryData) {
+		for _, g := range d.Access[patient] {
+			if g.Account == to && !g.expired() {
+				p, expires = g.Permissions, g.Expires
+			}
+		}
+	})
+	return p, expires, err
+}
+
+// ListConnected lists accounts `patient` granted access to that has not expired
+func (m *Memory) ListConnected(patient string) ([]string, error) {
+	list := []string{}
+	err := m.view(func(d *memoryData) {
+		for _, g := range d.Access[patient] {
+			if !g.expired() {
+				list = append(list, g.Account)
+			}
+		}
+	})
+	return list, err
+}
+
+// ListGrantedBy lists patients who granted `grantee` access that has not expired
+func (m *Memory) ListGrantedBy(grantee string) ([]string, error) {
+	list := []string{}
+	err := m.view(func(d *memoryData) {
+		for patient, grants := range d.Access {
+			for _, g := range grants {
+				if g.Account == grantee && !g.expired() {
+					list = append(list, patient)
+				}
+			}
+		}
+	})
+	sort.Strings(list)
+	return list, err
+}
+
+// CheckAccountKey checks if the key is the key of account
+func (m *Memory) CheckAccountKey(account, key string) (bool, error) {
+	var ok bool
+	err := m.view(func(d *memoryData) {
+		ok = d.Accounts[account] == key
+	})
+	return ok, err
+}
+
+// CheckAccountExists checks if account was created
+func (m *Memory) CheckAccountExists(account string) bool {
+	var ok bool
+	if err := m.view(func(d *memoryData) {
+		_, ok = d.Accounts[account]
+	}); err != nil {
+		m.log.Debugf("Error checking account: %v\nReturning false", err)
+	}
+	return ok
+}
+
+// CreateAccount creates account named `account` with public key `key`
+func (m *Memory) CreateAccount(account, key string) error {
+	m.log.Debugf("Ledger::createAccount(%s) called", account)
+	if _, err := ecc.NewPublicKey(key); err != nil {
+		return err
+	}
+	return m.update(func(d *memoryData) error {
+		if _, ok := d.Accounts[account]; ok {
+			return fmt.Errorf("Account %s already exists", account)
+		}
+		d.Accounts[account] = key
+		return nil
+	})
+}
+
+// NewKey creates new private key derived from new mnemonic and saves it to state
+func (m *Memory) NewKey() error {
+	return m.state.NewMnemonicKey()
+}
+
+// ImportKey checks the private key, there is nothing to sign transactions with
+func (m *Memory) ImportKey(key string) (*ecc.PrivateKey, error) {
+	return ecc.NewPrivateKey(key)
+}
+
+// SignHash creates string signature of data
+func (m *Memory) SignHash(data []byte) (string, error) {
+	return m.state.SignHash(data)
+}
+
+func (m *Memory) view(f func(d *memoryData)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return err
+	}
+	f(&m.data)
+	return nil
+}
+
+func (m *Memory) update(f func(d *memoryData) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return err
+	}
+	if err := f(&m.data); err != nil {
+		return err
+	}
+	return m.save()
+}
+
+func (m *Memory) load() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d := memoryData{}
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	if d.Accounts == nil {
+		d.Accounts = make(map[string]string)
+	}
+	if d.Access == nil {
+		d.Access = make(map[string][]memoryGrant)
+	}
+	m.data = d
+	return nil
+}
+
+func (m *Memory) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(m.data)
+	if err != nil {
+		return err
+	}
+	// Written to temporary file first, so other processes never read it half written
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
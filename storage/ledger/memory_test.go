@@ -0,0 +1,136 @@
+package ledger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/state"
+)
+
+func newTestState(t *testing.T, account string) *state.State {
+	cfg := &config.Config{EosAccount: account}
+	s, err := state.New(cfg, logger.New(cfg))
+	if err != nil {
+		t.Fatalf("state.New failed: %v", err)
+	}
+	if err := s.NewMnemonicKey(); err != nil {
+		t.Fatalf("NewMnemonicKey failed: %v", err)
+	}
+	return s
+}
+
+func TestMemory(t *testing.T) {
+	patient := newTestState(t, "patient.iryo")
+	doctor := newTestState(t, "doctor1.iryo")
+	m := NewMemory(patient, "", logger.New(&config.Config{}))
+
+	if err := m.GrantAccess("doctor1.iryo", PermissionDefault, time.Time{}); err == nil {
+		t.Error("Granting access to account that does not exist should fail")
+	}
+	for _, s := range []*state.State{patient, doctor} {
+		if err := m.CreateAccount(s.EosAccount, s.GetEosPublicKey()); err != nil {
+			t.Fatalf("CreateAccount failed: %v", err)
+		}
+	}
+	if err := m.CreateAccount("doctor1.iryo", doctor.GetEosPublicKey()); err == nil {
+		t.Error("Creating existing account should fail")
+	}
+	if !m.CheckAccountExists("doctor1.iryo") || m.CheckAccountExists("doctor2.iryo") {
+		t.Error("CheckAccountExists returned wrong result")
+	}
+	if ok, _ := m.CheckAccountKey("doctor1.iryo", doctor.GetEosPublicKey()); !ok {
+		t.Error("Account key was not recognized")
+	}
+	if ok, _ := m.CheckAccountKey("doctor1.iryo", patient.GetEosPublicKey()); ok {
+		t.Error("Key of another account was accepted")
+	}
+
+	if err := m.GrantAccess("doctor1.iryo", PermissionDefault, time.Time{}); err != nil {
+		t.Fatalf("GrantAccess failed: %v", err)
+	}
+	if ok, _ := m.AccessGranted("patient.iryo", "doctor1.iryo"); !ok {
+		t.Error("Access was not granted")
+	}
+	if list, _ := m.ListConnected("patient.iryo"); !reflect.DeepEqual(list, []string{"doctor1.iryo"}) {
+		t.Errorf("Unexpected connected accounts %v", list)
+	}
+	if list, _ := m.ListGrantedBy("doctor1.iryo"); !reflect.DeepEqual(list, []string{"patient.iryo"}) {
+		t.Errorf("Unexpected patients of grantee %v", list)
+	}
+
+	// Granting again changes the expiry
+	if err := m.GrantAccess("doctor1.iryo", PermissionDefault, time.Now().Add(-time.Hour)); err == nil {
+		t.Error("Granting access that already expired should fail")
+	}
+	if err := m.GrantAccess("doctor1.iryo", PermissionRead, time.Now().Add(100*time.Millisecond)); err != nil {
+		t.Fatalf("GrantAccess failed: %v", err)
+	}
+	if p, _ := m.Permissions("patient.iryo", "doctor1.iryo"); p != PermissionRead {
+		t.Errorf("Expected read permission until expiry, got %s", p)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if ok, _ := m.AccessGranted("patient.iryo", "doctor1.iryo"); ok {
+		t.Error("Access has not expired")
+	}
+	if list, _ := m.ListConnected("patient.iryo"); len(list) != 0 {
+		t.Errorf("Expired access is listed: %v", list)
+	}
+	if list, _ := m.ListGrantedBy("doctor1.iryo"); len(list) != 0 {
+		t.Errorf("Expired access is listed for grantee: %v", list)
+	}
+	if p, _ := m.Permissions("patient.iryo", "doctor1.iryo"); p != 0 {
+		t.Errorf("Expired access has permissions %s", p)
+	}
+
+	if err := m.RevokeAccess("doctor1.iryo"); err != nil {
+		t.Fatalf("RevokeAccess failed: %v", err)
+	}
+	if ok, _ := m.AccessGranted("patient.iryo", "doctor1.iryo"); ok {
+		t.Error("Access was not revoked")
+	}
+}
+
+func TestMemoryShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ledger.json")
+	log := logger.New(&config.Config{})
+
+	patient := newTestState(t, "patient.iryo")
+	api := NewMemory(newTestState(t, "iryo"), path, log)
+	client := NewMemory(patient, path, log)
+
+	if err := api.CreateAccount("patient.iryo", patient.GetEosPublicKey()); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+	if err := api.CreateAccount("doctor1.iryo", patient.GetEosPublicKey()); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+	if err := client.GrantAccess("doctor1.iryo", PermissionDefault, time.Time{}); err != nil {
+		t.Fatalf("GrantAccess failed: %v", err)
+	}
+	if ok, _ := api.AccessGranted("patient.iryo", "doctor1.iryo"); !ok {
+		t.Error("Access granted by the client is not seen by the api")
+	}
+
+	// grantee gives the access up
+	doctor := NewMemory(newTestState(t, "doctor1.iryo"), path, log)
+	if err := doctor.RelinquishAccess("patient.iryo"); err != nil {
+		t.Fatalf("RelinquishAccess failed: %v", err)
+	}
+	if ok, _ := api.AccessGranted("patient.iryo", "doctor1.iryo"); ok {
+		t.Error("Relinquished access is still granted")
+	}
+	if err := doctor.RelinquishAccess("patient.iryo"); err == nil {
+		t.Error("Relinquishing access that is not granted should fail")
+	}
+}
@@ -2,86 +2,232 @@ package hub
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/requests"
 )
 
-// Hub maintains the set of active clients
+// Hub maintains the set of active clients. Account can be connected from several devices
+// if all of them negotiated multi-device, otherwise a new connection replaces the old ones.
+// Messages to clients that negotiated acks are kept until the client acknowledges them,
+// the ones left when the connection is closed are sent to the next connection of the account
 type Hub struct {
-	log        *logger.Log
-	clients    map[string]*websocket.Conn
-	register   chan *client
-	unregister chan *client
-	storage    map[string][][]byte
+	log     *logger.Log
+	mu      sync.Mutex
+	clients map[string][]*client
+	storage map[string][]*requests.Request
+	nextID  uint64
 }
+
 type client struct {
-	conn *websocket.Conn
-	name string
+	conn         *websocket.Conn
+	name         string
+	capabilities requests.Capabilities
+	mu           sync.Mutex                   // serializes writes to conn
+	unacked      map[uint64]*requests.Request // delivered messages waiting for Ack, by delivery ID
 }
 
 func NewHub(log *logger.Log) *Hub {
 	return &Hub{
-		log:        log,
-		register:   make(chan *client),
-		unregister: make(chan *client),
-		clients:    make(map[string]*websocket.Conn),
-		storage:    make(map[string][][]byte),
+		log:     log,
+		clients: make(map[string][]*client),
+		storage: make(map[string][]*requests.Request),
 	}
 }
 
-func (h *Hub) Run() {
-	h.log.Debugf("HUB:: Starting the hub")
-	for {
-		select {
-		case client := <-h.register:
-			h.log.Debugf("HUB:: Registering user %s", client.name)
-			h.clients[client.name] = client.conn
-			go h.sendSavedRequests(client)
-		case client := <-h.unregister:
-			h.log.Debugf("HUB:: Unegistering user %s", client.name)
-			if _, ok := h.clients[client.name]; ok {
-				delete(h.clients, client.name)
-				client.conn.Close()
-				h.log.Debugf("HUB:: %s unregistered", client.name)
-
-			}
+// Register adds connection of user `name` that negotiated `capabilities`
+// and sends it messages saved while the user was offline
+func (h *Hub) Register(c *websocket.Conn, name string, capabilities requests.Capabilities) {
+	h.log.Debugf("HUB:: Registering user %s", name)
+	cl := &client{conn: c, name: name, capabilities: capabilities, unacked: make(map[uint64]*requests.Request)}
+	multiDevice := capabilities.Has(requests.FeatureMultiDevice)
+
+	h.mu.Lock()
+	kept := []*client{}
+	replaced := []*client{}
+	for _, other := range h.clients[name] {
+		if multiDevice && other.capabilities.Has(requests.FeatureMultiDevice) {
+			kept = append(kept, other)
+		} else {
+			replaced = append(replaced, other)
 		}
 	}
-}
+	h.clients[name] = append(kept, cl)
+	h.mu.Unlock()
 
-func (h *Hub) sendSavedRequests(client *client) {
-	for i := 0; i < len(h.storage[client.name]); i++ {
-		err := client.conn.WriteMessage(2, h.storage[client.name][i])
-		if err != nil {
+	for _, other := range replaced {
+		h.log.Debugf("HUB:: %s connected from another device, closing the old connection", name)
+		other.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Connected from another device"))
+		h.requeue(other)
+	}
+
+	h.mu.Lock()
+	saved := h.storage[name]
+	delete(h.storage, name)
+	h.mu.Unlock()
+	for _, r := range saved {
+		if err := h.deliver(cl, r); err != nil {
 			h.log.Printf("Error sending saved data: %v", err)
 		}
-		h.storage[client.name] = append(h.storage[client.name][:i], h.storage[client.name][i+1:]...)
-		i--
 	}
 }
 
-func (h *Hub) Register(c *websocket.Conn, name string) {
-	h.register <- &client{c, name}
-}
-
+// Unregister removes the connection, messages it did not acknowledge are saved for the next one
 func (h *Hub) Unregister(c *websocket.Conn, name string) {
-	h.unregister <- &client{c, name}
+	h.log.Debugf("HUB:: Unegistering user %s", name)
+
+	h.mu.Lock()
+	kept := []*client{}
+	removed := []*client{}
+	for _, cl := range h.clients[name] {
+		if cl.conn == c {
+			removed = append(removed, cl)
+		} else {
+			kept = append(kept, cl)
+		}
+	}
+	if len(kept) == 0 {
+		delete(h.clients, name)
+	} else {
+		h.clients[name] = kept
+	}
+	h.mu.Unlock()
+
+	for _, cl := range removed {
+		h.requeue(cl)
+	}
+	c.Close()
+	h.log.Debugf("HUB:: %s unregistered", name)
 }
 
 func (h *Hub) Connected(who string) bool {
-	_, ok := h.clients[who]
-	return ok
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.clients[who]) > 0
 }
 
-func (h *Hub) GetConn(user string) (*websocket.Conn, error) {
-	if h.Connected(user) {
-		return h.clients[user], nil
-	} else {
-		return nil, fmt.Errorf("Connection for user %s not found", user)
+// Send delivers the request to all connections of user `to`.
+// It's saved and sent when the user connects if they are offline
+func (h *Hub) Send(to string, r *requests.Request) error {
+	h.mu.Lock()
+	clients := h.clients[to]
+	if len(clients) == 0 {
+		h.log.Debugf("HUB:: User %s not connected, message will be sent when connected", to)
+		h.storage[to] = append(h.storage[to], r)
+	}
+	h.mu.Unlock()
+
+	var err error
+	for _, cl := range clients {
+		if e := h.deliver(cl, r); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Reply writes data to the connection of user `name` that sent a request
+func (h *Hub) Reply(c *websocket.Conn, name string, data []byte) error {
+	cl := h.find(c, name)
+	if cl == nil {
+		return fmt.Errorf("Connection for user %s not found", name)
+	}
+	return cl.write(websocket.BinaryMessage, data)
+}
+
+// Ack forgets the message with `deliveryID` delivered to the connection of user `name`
+func (h *Hub) Ack(c *websocket.Conn, name, deliveryID string) error {
+	id, err := strconv.ParseUint(deliveryID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid delivery ID %s", deliveryID)
+	}
+	cl := h.find(c, name)
+	if cl == nil {
+		return fmt.Errorf("Connection for user %s not found", name)
 	}
+
+	cl.mu.Lock()
+	delete(cl.unacked, id)
+	cl.mu.Unlock()
+	return nil
 }
 
-func (h *Hub) AddRequest(to string, request []byte) {
-	h.storage[to] = append(h.storage[to], request)
+func (h *Hub) find(c *websocket.Conn, name string) *client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, cl := range h.clients[name] {
+		if cl.conn == c {
+			return cl
+		}
+	}
+	return nil
+}
+
+// deliver writes the request to the connection, with delivery ID if the client negotiated acks
+func (h *Hub) deliver(cl *client, r *requests.Request) error {
+	if !cl.capabilities.Has(requests.FeatureAcks) {
+		data, err := r.Encode()
+		if err != nil {
+			return err
+		}
+		return cl.write(websocket.BinaryMessage, data)
+	}
+
+	h.mu.Lock()
+	h.nextID++
+	id := h.nextID
+	h.mu.Unlock()
+
+	out := requests.NewReq(r.Name)
+	for k, v := range r.Fields {
+		out.Append(k, v)
+	}
+	out.Append(requests.FieldDeliveryID, strconv.FormatUint(id, 10))
+	data, err := out.Encode()
+	if err != nil {
+		return err
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.unacked[id] = r
+	return cl.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// requeue saves messages the connection did not acknowledge in the order they were sent,
+// so they are delivered to the next connection of the account
+func (h *Hub) requeue(cl *client) {
+	cl.mu.Lock()
+	ids := make([]uint64, 0, len(cl.unacked))
+	for id := range cl.unacked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	unacked := make([]*requests.Request, 0, len(ids))
+	for _, id := range ids {
+		unacked = append(unacked, cl.unacked[id])
+	}
+	cl.unacked = make(map[uint64]*requests.Request)
+	cl.mu.Unlock()
+
+	if len(unacked) == 0 {
+		return
+	}
+	h.log.Debugf("HUB:: %d messages to %s were not acknowledged, they will be sent again", len(unacked), cl.name)
+	h.mu.Lock()
+	h.storage[cl.name] = append(unacked, h.storage[cl.name]...)
+	h.mu.Unlock()
+}
+
+func (cl *client) write(messageType int, data []byte) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.conn.WriteMessage(messageType, data)
 }
@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iryonetwork/network-poc/config"
+	"github.com/iryonetwork/network-poc/logger"
+	"github.com/iryonetwork/network-poc/requests"
+)
+
+// testServer registers connections of user in `name` query param
+// with features listed in `features` and handles their acks
+func testServer(h *Hub) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		capabilities := requests.Capabilities{Features: strings.Split(r.URL.Query().Get("features"), ",")}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		h.Register(c, name, capabilities)
+		defer h.Unregister(c, name)
+
+		for {
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if ack, err := requests.Decode(msg); err == nil && ack.Name == "Ack" {
+				id, _ := ack.GetDataString(requests.FieldDeliveryID)
+				h.Ack(c, name, id)
+			}
+		}
+	}))
+}
+
+func (h *Hub) connections(name string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.clients[name])
+}
+
+func dial(t *testing.T, h *Hub, server *httptest.Server, name string, features ...string) *websocket.Conn {
+	before := h.connections(name)
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/?name=" + name + "&features=" + strings.Join(features, ",")
+	c, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); h.connections(name) == before && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return c
+}
+
+func read(t *testing.T, c *websocket.Conn) *requests.Request {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	r, err := requests.Decode(msg)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	return r
+}
+
+func waitDisconnected(h *Hub, name string) {
+	for deadline := time.Now().Add(time.Second); h.Connected(name) && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMultiDevice(t *testing.T) {
+	h := NewHub(logger.New(&config.Config{}))
+	server := testServer(h)
+	defer server.Close()
+
+	phone := dial(t, h, server, "patient.iryo", requests.FeatureMultiDevice)
+	defer phone.Close()
+	tablet := dial(t, h, server, "patient.iryo", requests.FeatureMultiDevice)
+	defer tablet.Close()
+
+	if err := h.Send("patient.iryo", requests.NewReq("NewUpload")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	for _, c := range []*websocket.Conn{phone, tablet} {
+		if r := read(t, c); r.Name != "NewUpload" {
+			t.Errorf("Expected NewUpload on every device, got %s", r.Name)
+		}
+	}
+
+	// Device without multi-device replaces the others
+	old := dial(t, h, server, "patient.iryo")
+	defer old.Close()
+	if n := h.connections("patient.iryo"); n != 1 {
+		t.Errorf("Expected one connection after device without multi-device connected, got %d", n)
+	}
+	phone.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := phone.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected replaced connection to be closed, got %v", err)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	h := NewHub(logger.New(&config.Config{}))
+	server := testServer(h)
+	defer server.Close()
+
+	// Message sent while offline is delivered on connect
+	if err := h.Send("doctor1.iryo", requests.NewReq("AccessGranted")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	c := dial(t, h, server, "doctor1.iryo", requests.FeatureAcks)
+	r := read(t, c)
+	if r.Name != "AccessGranted" {
+		t.Fatalf("Expected AccessGranted, got %s", r.Name)
+	}
+	first, err := r.GetDataString(requests.FieldDeliveryID)
+	if err != nil {
+		t.Fatalf("Expected delivery ID: %v", err)
+	}
+
+	// Unacknowledged message is delivered again after reconnect
+	c.Close()
+	waitDisconnected(h, "doctor1.iryo")
+	c = dial(t, h, server, "doctor1.iryo", requests.FeatureAcks)
+	r = read(t, c)
+	if r.Name != "AccessGranted" {
+		t.Fatalf("Expected AccessGranted again, got %s", r.Name)
+	}
+	second, _ := r.GetDataString(requests.FieldDeliveryID)
+	if second == first {
+		t.Errorf("Expected new delivery ID, got %s twice", first)
+	}
+	ack, _ := requests.NewAck(second).Encode()
+	if err := c.WriteMessage(websocket.BinaryMessage, ack); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	// Acknowledged message is not delivered again
+	if err := h.Send("doctor1.iryo", requests.NewReq("NewUpload")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if r := read(t, c); r.Name != "NewUpload" {
+		t.Fatalf("Expected NewUpload, got %s", r.Name)
+	}
+	c.Close()
+	waitDisconnected(h, "doctor1.iryo")
+	c = dial(t, h, server, "doctor1.iryo", requests.FeatureAcks)
+	defer c.Close()
+	if r := read(t, c); r.Name != "NewUpload" {
+		t.Errorf("Expected only unacknowledged NewUpload to be sent again, got %s", r.Name)
+	}
+
+	// Clients without acks get messages as they are
+	plain := dial(t, h, server, "nurse.iryo")
+	defer plain.Close()
+	h.Send("nurse.iryo", requests.NewReq("NewUpload"))
+	if _, err := read(t, plain).GetDataString(requests.FieldDeliveryID); err == nil {
+		t.Error("Expected no delivery ID for client without acks")
+	}
+}